@@ -8,6 +8,7 @@ import (
 	"os/signal"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -67,13 +68,26 @@ func main() {
 				&cli.StringFlag{
 					Name:    "output",
 					Aliases: []string{"o", "out"},
-					Usage:   "The output file location",
+					Usage:   "The output file location, or - to stream a CAR to stdout",
 				},
 				&cli.BoolFlag{
 					Name:    "car",
 					Aliases: []string{"c"},
 					Usage:   "If set, will export result as CAR, otherwise will export as UnixFS",
 				},
+				&cli.StringFlag{
+					Name:  "transport",
+					Usage: "The retrieval transport to use (graphsync, bitswap or http), or auto for the best one the provider supports",
+					Value: "graphsync",
+				},
+				&cli.StringFlag{
+					Name:  "piece",
+					Usage: "The piece CID to retrieve the payload from, if it's in more than one",
+				},
+				&cli.Uint64Flag{
+					Name:  "deal",
+					Usage: "Retrieve the content of an on-chain storage deal by its ID, instead of by provider and payload CID",
+				},
 			},
 		},
 		{
@@ -106,6 +120,72 @@ func main() {
 				},
 			},
 		},
+		{
+			Name: "provider",
+			Subcommands: []*cli.Command{
+				{
+					Name:      "info",
+					Usage:     "Show everything that can be found out about a storage provider",
+					ArgsUsage: "<address or peer ID>",
+					Action:    cmdProviderInfo,
+				},
+			},
+		},
+		{
+			Name:  "providers",
+			Usage: "Manage which storage providers may be used",
+			Subcommands: []*cli.Command{
+				{
+					Name:      "block",
+					Usage:     "Stop a storage provider from being used",
+					ArgsUsage: "<address or peer ID>",
+					Action:    cmdProvidersBlock,
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:  "reason",
+							Usage: "Why the provider is blocked, shown when it's used",
+						},
+						&cli.DurationFlag{
+							Name:  "for",
+							Usage: "Unblock the provider again after this long (blocked permanently if unset)",
+						},
+					},
+				},
+				{
+					Name:      "unblock",
+					Usage:     "Allow a blocked storage provider to be used again",
+					ArgsUsage: "<address or peer ID>",
+					Action:    cmdProvidersUnblock,
+				},
+				{
+					Name:   "list",
+					Usage:  "List the allowed and denied storage providers",
+					Action: cmdProvidersList,
+				},
+			},
+		},
+		{
+			Name:      "doctor",
+			Usage:     "Check each step of reaching a storage provider, to find which one fails",
+			ArgsUsage: "<address or peer ID>",
+			Action:    cmdDoctor,
+		},
+		{
+			Name:   "stats",
+			Usage:  "Show how reliable storage providers have been for retrievals",
+			Action: cmdStats,
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:    "provider",
+					Aliases: []string{"p", "miner", "m"},
+					Usage:   "Show stats for only this storage provider address or peer ID",
+				},
+				&cli.BoolFlag{
+					Name:  "history",
+					Usage: "With --provider, also list each recorded retrieval attempt",
+				},
+			},
+		},
 		{
 			Name:   "clear-blockstore",
 			Action: cmdClearBlockstore,
@@ -223,7 +303,7 @@ func cmdFindDeals(ctx *cli.Context) error {
 					continue
 				}
 
-				payloadCid, err := findPayloadCid(*proposal)
+				payloadCid, err := filclient.FindPayloadCid(*proposal)
 				if err != nil {
 					log.Debugf("Could not extract payload CID from deal ID %d: %v", copiedDealID, err)
 					continue
@@ -265,59 +345,99 @@ func cmdRetrieve(ctx *cli.Context) error {
 
 	queryOnly := ctx.Bool("query")
 
-	// Parse the provider handle
 	var handle *filclient.StorageProviderHandle
-	addr, err := address.NewFromString(ctx.String("provider"))
-	if err != nil {
-		peerID, err2 := peer.Decode(ctx.String("provider"))
-		if err2 != nil {
-			return fmt.Errorf("could not parse provider string as addr (%v) or peer ID (%v)", err, err2)
-		} else {
-			handle = filctl.client.StorageProviderByPeerID(peerID)
+	var payloadCid cid.Cid
+	var pieceCid cid.Cid
+	var options []filclient.RetrievalOption
+	if ctx.IsSet("deal") {
+		// The deal says which provider has the content, and which piece it's
+		// in
+		deal, err := filctl.client.LookupRetrievalDeal(ctx.Context, abi.DealID(ctx.Uint64("deal")))
+		if err != nil {
+			return err
 		}
+		handle = deal.Provider
+		payloadCid = deal.PayloadCID
+		pieceCid = deal.PieceCID
 	} else {
-		handle = filctl.client.StorageProviderByAddress(addr)
-	}
+		handle, err = parseProvider(filctl, ctx.String("provider"))
+		if err != nil {
+			return err
+		}
 
-	// Parse the payload CID
-	payloadCid, err := cid.Parse(ctx.Args().First())
-	if err != nil {
-		return fmt.Errorf("could not parse payload CID: %v", err)
+		// Parse the payload CID
+		payloadCid, err = cid.Parse(ctx.Args().First())
+		if err != nil {
+			return fmt.Errorf("could not parse payload CID: %v", err)
+		}
 	}
 
-	outPath := ctx.String("output")
-	exportAsCAR := ctx.Bool("car")
+	if ctx.String("transport") == "auto" {
+		options = append(options, filclient.RetrievalWithAutoTransport())
+	} else {
+		transport, err := filclient.ParseRetrievalTransport(ctx.String("transport"))
+		if err != nil {
+			return err
+		}
+		options = append(options, filclient.RetrievalWithTransport(transport))
+	}
 
-	// If no output path specified, default to current directory / cid
-	if outPath == "" {
-		wd, err := os.Getwd()
+	if ctx.IsSet("piece") {
+		pieceCid, err = cid.Parse(ctx.String("piece"))
 		if err != nil {
-			return fmt.Errorf("cannot determine current working directory '%s'", err)
+			return fmt.Errorf("could not parse piece CID: %v", err)
 		}
-		outPath = path.Join(wd, payloadCid.String())
 	}
+	if pieceCid.Defined() {
+		options = append(options, filclient.RetrievalWithPieceCID(pieceCid))
+	}
+
+	outPath := ctx.String("output")
+	exportAsCAR := ctx.Bool("car")
 
-	// Add .car extension, if not already specified
-	if exportAsCAR && !strings.HasSuffix(outPath, ".car") {
-		outPath += ".car"
+	// Streaming to stdout skips the blockstore entirely, so there is nothing
+	// to export afterwards
+	toStdout := outPath == "-"
+	if toStdout {
+		options = append(
+			options,
+			filclient.RetrievalWithCARWriter(os.Stdout),
+			filclient.RetrievalWithoutPersisting(),
+		)
 	}
 
-	if FileExists(outPath) {
-		// Allow user to confirm the overwrite
-		if !prompt(ctx, fmt.Sprintf("Output file %s already exists, continue and overwrite?", outPath), true) {
-			return nil
+	if !toStdout {
+		// If no output path specified, default to current directory / cid
+		if outPath == "" {
+			wd, err := os.Getwd()
+			if err != nil {
+				return fmt.Errorf("cannot determine current working directory '%s'", err)
+			}
+			outPath = path.Join(wd, payloadCid.String())
 		}
-	} else {
-		// Verify the path can be written to by creating a file there
-		_, err := os.Create(outPath)
-		if err != nil {
-			return fmt.Errorf("cannot create output path '%s'", outPath)
+
+		// Add .car extension, if not already specified
+		if exportAsCAR && !strings.HasSuffix(outPath, ".car") {
+			outPath += ".car"
+		}
+
+		if FileExists(outPath) {
+			// Allow user to confirm the overwrite
+			if !prompt(ctx, fmt.Sprintf("Output file %s already exists, continue and overwrite?", outPath), true) {
+				return nil
+			}
+		} else {
+			// Verify the path can be written to by creating a file there
+			_, err := os.Create(outPath)
+			if err != nil {
+				return fmt.Errorf("cannot create output path '%s'", outPath)
+			}
+			os.Remove(outPath)
 		}
-		os.Remove(outPath)
 	}
 
 	// Do retrieval query
-	res, err := handle.QueryRetrievalAsk(ctx.Context, payloadCid)
+	res, err := handle.QueryRetrievalAsk(ctx.Context, payloadCid, options...)
 	if err != nil {
 		return fmt.Errorf("retrieval query failed: %v", err)
 	}
@@ -331,6 +451,12 @@ func cmdRetrieve(ctx *cli.Context) error {
 			types.BigMul(res.MinPricePerByte, types.NewInt(res.Size)),
 		)
 
+		if ctx.IsSet("deal") {
+			t.AppendRow(table.Row{"Payload CID", payloadCid})
+		}
+		if pieceCid.Defined() {
+			t.AppendRow(table.Row{"Piece", pieceCid})
+		}
 		t.AppendRow(table.Row{"Retrievable", res.PieceCIDFound == retrievalmarket.QueryItemAvailable})
 		t.AppendRow(table.Row{"Size", humanize.IBytes(res.Size)})
 		t.AppendSeparator()
@@ -342,7 +468,7 @@ func cmdRetrieve(ctx *cli.Context) error {
 		t.AppendRow(table.Row{"Payment Address", res.PaymentAddress})
 	}
 	t.SetCaption(res.Message)
-	fmt.Printf("%s\n", t.Render())
+	fmt.Fprintf(os.Stderr, "%s\n", t.Render())
 
 	if res.Status != retrievalmarket.QueryResponseAvailable {
 		return nil
@@ -358,42 +484,437 @@ func cmdRetrieve(ctx *cli.Context) error {
 		return nil
 	}
 
-	transfer, err := handle.StartRetrievalTransfer(ctx.Context, payloadCid)
+	// The ask was just queried, so the transfer doesn't need to again
+	options = append(options, filclient.RetrievalWithAsk(res))
+
+	transfer, err := handle.StartRetrievalTransfer(ctx.Context, payloadCid, options...)
 	if err != nil {
 		return err
 	}
 
-	success := false
+	unsubscribe := transfer.Subscribe(func(event filclient.RetrievalEvent) {
+		switch event.Code {
+		case filclient.RetrievalEventProgress:
+			metrics := transfer.Metrics()
+
+			eta := "unknown"
+			if metrics.ETAKnown {
+				eta = metrics.ETA.Round(time.Second).String()
+			}
 
-	for range time.Tick(time.Millisecond * 100) {
-		if ctx.Err() != nil {
-			break
+			// Padded to cover up any longer line before it
+			fmt.Fprintf(
+				os.Stderr,
+				"\r%-80s",
+				fmt.Sprintf(
+					"%s / %s (%s/s, %d blocks, ETA %s)",
+					humanize.IBytes(event.Progress),
+					humanize.IBytes(transfer.Size()),
+					humanize.IBytes(uint64(metrics.Throughput)),
+					metrics.BlocksReceived,
+					eta,
+				),
+			)
+		case filclient.RetrievalEventPaymentRequested:
+			fmt.Fprintf(os.Stderr, "\nProvider requested payment of %s\n", types.FIL(event.Payment))
+		case filclient.RetrievalEventUnsealing:
+			fmt.Fprintf(os.Stderr, "\rWaiting for provider to unseal data...")
 		}
+	})
+	defer unsubscribe()
 
-		if transfer.State().IsDone() {
-			success = true
-			break
+	select {
+	case <-transfer.Done():
+	case <-ctx.Done():
+		// Stop the transfer before exiting, so nothing more is written to the
+		// output, and fail so that a truncated CAR isn't taken for a whole one
+		fmt.Fprintf(os.Stderr, "\n")
+		if err := transfer.Cancel(context.Background()); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to cancel retrieval: %v\n", err)
 		}
+		return ctx.Err()
+	}
 
-		fmt.Fprintf(
-			os.Stderr,
-			"\r%s / %s (%d / %d)",
-			humanize.IBytes(transfer.Progress()),
-			humanize.IBytes(transfer.Size()),
-			transfer.Progress(),
-			transfer.Size(),
-		)
+	fmt.Fprintf(os.Stderr, "\n")
+
+	printRetrievalSummary(transfer)
+
+	if err := transfer.Err(); err != nil {
+		return err
+	}
+
+	if toStdout {
+		return nil
+	}
+
+	filctl.client.ExportToFile(ctx.Context, payloadCid, outPath, exportAsCAR)
+
+	return nil
+}
+
+func printRetrievalSummary(transfer *filclient.RetrievalTransfer) {
+	metrics := transfer.Metrics()
+	duration := time.Since(metrics.StartTime)
+
+	var averageThroughput float64
+	if duration > 0 {
+		averageThroughput = float64(metrics.RetrievedBytes) / duration.Seconds()
+	}
+
+	t := table.NewWriter()
+	t.SetStyle(table.StyleLight)
+	t.AppendRow(table.Row{"Status", transfer.State()})
+	t.AppendRow(table.Row{"Transport", transfer.Transport()})
+	t.AppendRow(table.Row{"Duration", duration.Round(time.Millisecond)})
+	if metrics.TimeToFirstByte != 0 {
+		t.AppendRow(table.Row{"Time to First Byte", metrics.TimeToFirstByte.Round(time.Millisecond)})
+	}
+	t.AppendRow(table.Row{"Average Throughput", fmt.Sprintf("%s/s", humanize.IBytes(uint64(averageThroughput)))})
+	t.AppendRow(table.Row{"Blocks Received", metrics.BlocksReceived})
+	t.AppendRow(table.Row{"From Network", humanize.IBytes(metrics.RetrievedBytes)})
+	t.AppendRow(table.Row{"From Cache", humanize.IBytes(metrics.CachedBytes)})
+	fmt.Fprintf(os.Stderr, "%s\n", t.Render())
+}
+
+func cmdStats(ctx *cli.Context) error {
+	filctl, err := New(ctx, dataDir(ctx))
+	if err != nil {
+		return err
+	}
+
+	if !ctx.IsSet("provider") {
+		allStats, err := filctl.client.AllRetrievalProviderStats(ctx.Context)
+		if err != nil {
+			return err
+		}
+
+		if len(allStats) == 0 {
+			fmt.Printf("No retrievals recorded yet\n")
+			return nil
+		}
+
+		// Most reliable first
+		sort.SliceStable(allStats, func(i, j int) bool {
+			return allStats[i].SuccessRate > allStats[j].SuccessRate
+		})
+
+		t := table.NewWriter()
+		t.SetStyle(table.StyleLight)
+		t.AppendHeader(table.Row{
+			"Provider",
+			"Attempts",
+			"Success Rate",
+			"Median Throughput",
+			"Median TTFB",
+			"Total Size",
+			"Last Success",
+		})
+		for _, stats := range allStats {
+			t.AppendRow(table.Row{
+				stats.Provider,
+				stats.Attempts,
+				fmt.Sprintf("%.0f%%", stats.SuccessRate*100),
+				fmt.Sprintf("%s/s", humanize.IBytes(uint64(stats.MedianThroughput))),
+				stats.MedianTimeToFirstByte.Round(time.Millisecond),
+				humanize.IBytes(stats.TotalBytes),
+				formatStatsTime(stats.LastSuccess),
+			})
+		}
+		fmt.Printf("%s\n", t.Render())
+
+		return nil
+	}
+
+	handle, err := parseProvider(filctl, ctx.String("provider"))
+	if err != nil {
+		return err
+	}
+
+	peerID, err := handle.PeerID(ctx.Context)
+	if err != nil {
+		return err
+	}
+
+	stats, err := filctl.client.RetrievalProviderStats(ctx.Context, peerID)
+	if err != nil {
+		return err
+	}
+
+	t := table.NewWriter()
+	t.SetStyle(table.StyleLight)
+	t.AppendRow(table.Row{"Provider", peerID})
+	t.AppendRow(table.Row{"Attempts", stats.Attempts})
+	t.AppendRow(table.Row{"Successes", stats.Successes})
+	t.AppendRow(table.Row{"Success Rate", fmt.Sprintf("%.0f%%", stats.SuccessRate*100)})
+	t.AppendRow(table.Row{"Median Throughput", fmt.Sprintf("%s/s", humanize.IBytes(uint64(stats.MedianThroughput)))})
+	t.AppendRow(table.Row{"Median TTFB", stats.MedianTimeToFirstByte.Round(time.Millisecond)})
+	t.AppendRow(table.Row{"Total Size", humanize.IBytes(stats.TotalBytes)})
+	t.AppendRow(table.Row{"Total Price Paid", types.FIL(stats.TotalPricePaid)})
+	t.AppendRow(table.Row{"Last Attempt", formatStatsTime(stats.LastAttempt)})
+	t.AppendRow(table.Row{"Last Success", formatStatsTime(stats.LastSuccess)})
+	if len(stats.Failures) > 0 {
+		t.AppendSeparator()
+		var kinds []string
+		for kind := range stats.Failures {
+			kinds = append(kinds, kind)
+		}
+		sort.Strings(kinds)
+		for _, kind := range kinds {
+			t.AppendRow(table.Row{kind, stats.Failures[kind]})
+		}
+	}
+	fmt.Printf("%s\n", t.Render())
+
+	if !ctx.Bool("history") {
+		return nil
 	}
 
-	fmt.Fprintf(os.Stdout, "\n")
+	attempts, err := filctl.client.RetrievalHistory(ctx.Context, peerID)
+	if err != nil {
+		return err
+	}
 
-	if success {
-		filctl.client.ExportToFile(ctx.Context, payloadCid, outPath, exportAsCAR)
+	history := table.NewWriter()
+	history.SetStyle(table.StyleLight)
+	history.AppendHeader(table.Row{"Finished", "Payload CID", "Transport", "Status", "Size", "Duration", "Error"})
+	for _, attempt := range attempts {
+		history.AppendRow(table.Row{
+			formatStatsTime(attempt.FinishedAt),
+			attempt.PayloadCID,
+			attempt.Transport,
+			attempt.Status,
+			humanize.IBytes(attempt.Bytes),
+			attempt.Duration.Round(time.Millisecond),
+			attempt.ErrorKind,
+		})
 	}
+	fmt.Printf("%s\n", history.Render())
 
 	return nil
 }
 
+func cmdProviderInfo(ctx *cli.Context) error {
+	filctl, err := New(ctx, dataDir(ctx))
+	if err != nil {
+		return err
+	}
+
+	handle, err := parseProvider(filctl, ctx.Args().First())
+	if err != nil {
+		return err
+	}
+
+	info := handle.Info(ctx.Context)
+
+	// Missing parts show the reason they're missing instead
+	valueOr := func(part filclient.ProviderInfoPart, value interface{}) interface{} {
+		if err, ok := info.Errors[part]; ok {
+			return fmt.Sprintf("error: %v", err)
+		}
+		return value
+	}
+
+	t := table.NewWriter()
+	t.SetStyle(table.StyleLight)
+
+	t.AppendRow(table.Row{"Address", valueOr(filclient.ProviderInfoPartAddress, info.Address)})
+	t.AppendRow(table.Row{"Peer ID", info.PeerID})
+	if info.MinerInfo != nil {
+		t.AppendRow(table.Row{"Owner", info.MinerInfo.Owner})
+		t.AppendRow(table.Row{"Worker", info.MinerInfo.Worker})
+		t.AppendRow(table.Row{"Sector Size", humanize.IBytes(uint64(info.MinerInfo.SectorSize))})
+		var multiaddrs []string
+		for _, maddr := range info.Multiaddrs {
+			multiaddrs = append(multiaddrs, maddr.String())
+		}
+		t.AppendRow(table.Row{"Multiaddrs", formatList(multiaddrs)})
+	} else {
+		t.AppendRow(table.Row{"Miner Info", valueOr(filclient.ProviderInfoPartMinerInfo, "")})
+	}
+
+	if info.Power != nil {
+		t.AppendRow(table.Row{"Raw Byte Power", types.SizeStr(info.Power.RawBytePower)})
+		t.AppendRow(table.Row{"Quality Adjusted Power", types.SizeStr(info.Power.QualityAdjPower)})
+		t.AppendRow(table.Row{"Has Min Power", info.Power.HasMinPower})
+	} else {
+		t.AppendRow(table.Row{"Power", valueOr(filclient.ProviderInfoPartPower, "")})
+	}
+
+	t.AppendSeparator()
+	if err, ok := info.Errors[filclient.ProviderInfoPartConnect]; ok {
+		t.AppendRow(table.Row{"Connect", fmt.Sprintf("error: %v", err)})
+	} else {
+		t.AppendRow(table.Row{"Connected Via", handle.AddrSource()})
+		t.AppendRow(table.Row{"Agent Version", valueOr(filclient.ProviderInfoPartAgentVersion, info.AgentVersion)})
+		t.AppendRow(table.Row{"Protocols", valueOr(filclient.ProviderInfoPartProtocols, formatList(info.Protocols))})
+
+		var transports []string
+		for _, transport := range info.RetrievalTransports {
+			transports = append(transports, transport.Transport.String())
+		}
+		t.AppendRow(table.Row{
+			"Retrieval Transports",
+			valueOr(filclient.ProviderInfoPartRetrievalTransports, formatList(transports)),
+		})
+
+		if info.StorageAsk != nil {
+			t.AppendSeparator()
+			t.AppendRow(table.Row{"Storage Price", types.FIL(info.StorageAsk.Price)})
+			t.AppendRow(table.Row{"Verified Storage Price", types.FIL(info.StorageAsk.VerifiedPrice)})
+			t.AppendRow(table.Row{"Min Piece Size", humanize.IBytes(uint64(info.StorageAsk.MinPieceSize))})
+			t.AppendRow(table.Row{"Max Piece Size", humanize.IBytes(uint64(info.StorageAsk.MaxPieceSize))})
+		} else {
+			t.AppendRow(table.Row{"Storage Ask", valueOr(filclient.ProviderInfoPartStorageAsk, "")})
+		}
+	}
+
+	fmt.Printf("%s\n", t.Render())
+
+	return nil
+}
+
+func cmdProvidersBlock(ctx *cli.Context) error {
+	provider, err := filclient.ParseProviderPolicyTarget(ctx.Args().First())
+	if err != nil {
+		return err
+	}
+
+	filctl, err := New(ctx, dataDir(ctx))
+	if err != nil {
+		return err
+	}
+
+	duration := ctx.Duration("for")
+	if err := filctl.client.BlockProvider(ctx.Context, provider, ctx.String("reason"), duration); err != nil {
+		return err
+	}
+
+	if duration != 0 {
+		fmt.Printf("Blocked %s for %s\n", provider, duration)
+	} else {
+		fmt.Printf("Blocked %s\n", provider)
+	}
+
+	return nil
+}
+
+func cmdProvidersUnblock(ctx *cli.Context) error {
+	provider, err := filclient.ParseProviderPolicyTarget(ctx.Args().First())
+	if err != nil {
+		return err
+	}
+
+	filctl, err := New(ctx, dataDir(ctx))
+	if err != nil {
+		return err
+	}
+
+	if err := filctl.client.UnblockProvider(ctx.Context, provider); err != nil {
+		return err
+	}
+
+	fmt.Printf("Unblocked %s\n", provider)
+
+	return nil
+}
+
+func cmdProvidersList(ctx *cli.Context) error {
+	filctl, err := New(ctx, dataDir(ctx))
+	if err != nil {
+		return err
+	}
+
+	rules := filctl.client.ProviderPolicyRules()
+	if len(rules) == 0 {
+		fmt.Printf("No providers are allowed or denied\n")
+		return nil
+	}
+
+	t := table.NewWriter()
+	t.SetStyle(table.StyleLight)
+	t.AppendHeader(table.Row{"Action", "Provider", "Reason", "Since", "Expires"})
+
+	for _, rule := range rules {
+		since := "config"
+		if !rule.FromConfig {
+			since = humanize.Time(rule.CreatedAt)
+		}
+
+		expires := "never"
+		if !rule.ExpiresAt.IsZero() {
+			expires = humanize.Time(rule.ExpiresAt)
+		}
+
+		t.AppendRow(table.Row{rule.Action, rule.Provider, rule.Reason, since, expires})
+	}
+
+	fmt.Printf("%s\n", t.Render())
+
+	return nil
+}
+
+func cmdDoctor(ctx *cli.Context) error {
+	filctl, err := New(ctx, dataDir(ctx))
+	if err != nil {
+		return err
+	}
+
+	handle, err := parseProvider(filctl, ctx.Args().First())
+	if err != nil {
+		return err
+	}
+
+	diagnostics := handle.Diagnose(ctx.Context)
+
+	t := table.NewWriter()
+	t.SetStyle(table.StyleLight)
+	t.AppendHeader(table.Row{"Step", "Target", "Time", "Result"})
+
+	failed := 0
+	for _, diagnostic := range diagnostics {
+		var result string
+		switch {
+		case diagnostic.Skipped:
+			result = fmt.Sprintf("skipped: %v", diagnostic.Err)
+		case diagnostic.Err != nil:
+			result = fmt.Sprintf("error: %v", diagnostic.Err)
+		default:
+			result = fmt.Sprintf("ok: %s", diagnostic.Detail)
+		}
+
+		duration := ""
+		if !diagnostic.Skipped {
+			duration = diagnostic.Duration.Round(time.Millisecond).String()
+		}
+
+		if !diagnostic.OK() {
+			failed++
+		}
+
+		t.AppendRow(table.Row{diagnostic.Step, diagnostic.Target, duration, result})
+	}
+
+	fmt.Printf("%s\n", t.Render())
+
+	if failed != 0 {
+		return fmt.Errorf("%d of %d steps did not succeed", failed, len(diagnostics))
+	}
+
+	return nil
+}
+
+// One item per line
+func formatList(items []string) string {
+	return strings.Join(items, "\n")
+}
+
+func formatStatsTime(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return humanize.Time(t)
+}
+
 func cmdClearBlockstore(ctx *cli.Context) error {
 	blockstorePath := filepath.Join(dataDir(ctx), "blockstore")
 
@@ -410,18 +931,31 @@ func cmdClearBlockstore(ctx *cli.Context) error {
 	return nil
 }
 
+// Parses a storage provider from either its address or its peer ID
+func parseProvider(filctl *Filctl, str string) (*filclient.StorageProviderHandle, error) {
+	addr, err := address.NewFromString(str)
+	if err != nil {
+		peerID, err2 := peer.Decode(str)
+		if err2 != nil {
+			return nil, fmt.Errorf("could not parse provider string as addr (%v) or peer ID (%v)", err, err2)
+		}
+		return filctl.client.StorageProviderByPeerID(peerID), nil
+	}
+	return filctl.client.StorageProviderByAddress(addr), nil
+}
+
 func prompt(ctx *cli.Context, question string, defaultYes bool) bool {
 	result := make(chan bool, 1)
 
 	go func() {
 		if defaultYes {
-			fmt.Printf("%s [Y/n] ", question)
+			fmt.Fprintf(os.Stderr, "%s [Y/n] ", question)
 		} else {
-			fmt.Printf("%s [y/N] ", question)
+			fmt.Fprintf(os.Stderr, "%s [y/N] ", question)
 		}
 
 		if ctx.Bool("yes") {
-			fmt.Printf("\n")
+			fmt.Fprintf(os.Stderr, "\n")
 			result <- defaultYes
 			return
 		}
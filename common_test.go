@@ -8,6 +8,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/filecoin-project/go-address"
 	"github.com/filecoin-project/go-state-types/abi"
 	lotusactors "github.com/filecoin-project/lotus/chain/actors"
 	lotustypes "github.com/filecoin-project/lotus/chain/types"
@@ -21,6 +22,7 @@ import (
 	leveldb "github.com/ipfs/go-ds-leveldb"
 	blockstore "github.com/ipfs/go-ipfs-blockstore"
 	logging "github.com/ipfs/go-log"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
 	"github.com/multiformats/go-multiaddr"
 	"github.com/stretchr/testify/require"
 )
@@ -99,7 +101,8 @@ func initEnsemble(t *testing.T, ctx context.Context) (*kit.TestFullNode, *kit.Te
 		client.DefaultKey.Address,
 		bs,
 		ds,
-	) // WithWallet(wallet)
+		WithWallet(wallet),
+	)
 	if err != nil {
 		t.Fatalf("Could not initialize FilClient: %v", err)
 	}
@@ -117,6 +120,21 @@ func initEnsemble(t *testing.T, ctx context.Context) (*kit.TestFullNode, *kit.Te
 	return client, miner, ensemble, fc, func() {}
 }
 
+// Create a filclient with no chain connection, for tests that only need the
+// local blockstore, datastore and libp2p host
+func initStandaloneClient(t *testing.T, ctx context.Context, ds datastore.Batching, opts ...Option) *Client {
+	h, err := mocknet.New().GenPeer()
+	require.NoError(t, err)
+
+	fc, err := New(ctx, h, nil, address.Undef, initBlockstore(t), ds, opts...)
+	if err != nil {
+		t.Fatalf("Could not initialize FilClient: %v", err)
+	}
+	t.Cleanup(fc.Close)
+
+	return fc
+}
+
 func initBlockstore(t *testing.T) blockstore.Blockstore {
 	parseShardFunc, err := flatfs.ParseShardFunc("/repo/flatfs/shard/v1/next-to-last/3")
 	if err != nil {
@@ -0,0 +1,215 @@
+package filclient
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-data-transfer/channelmonitor"
+	"github.com/filecoin-project/lotus/api"
+	logging "github.com/ipfs/go-log"
+	"github.com/libp2p/go-libp2p/core/routing"
+)
+
+// config.go - client configuration, its defaults and validation
+
+var (
+	ErrInvalidConfig = errors.New("invalid config")
+)
+
+const (
+	// How long connecting to a storage provider may take, if not configured
+	DefaultConnectTimeout = 30 * time.Second
+
+	// How long a single request/response exchange with a storage provider
+	// (e.g. a retrieval query) may take, if not configured
+	DefaultRPCTimeout = 30 * time.Second
+
+	// How long a candidate in Client.Retrieve may go without sending data
+	// before the next one is tried, if not configured
+	DefaultRetrievalStallTimeout = time.Minute
+
+	// How many miners are looked up at once while indexing peer IDs, if not
+	// configured
+	DefaultStorageProviderIndexWorkers = 16
+
+	// How many of a provider's most recent retrieval attempts are kept in the
+	// history, if not configured
+	DefaultRetrievalHistoryLimit = 1000
+)
+
+// Settings for the client - the zero value of each field picks its default, so
+// only fields that differ from the defaults need to be set
+type Config struct {
+	// Base URL of the IPNI indexer used to find providers for content -
+	// defaults to DefaultIndexerURL
+	IndexerURL string
+
+	// How long connecting to a storage provider may take - defaults to
+	// DefaultConnectTimeout, and negative means no limit beyond the context's
+	ConnectTimeout time.Duration
+
+	// How long a single request/response exchange with a storage provider may
+	// take - defaults to DefaultRPCTimeout, and negative means no limit beyond
+	// the context's
+	RPCTimeout time.Duration
+
+	// How long a candidate in Client.Retrieve may go without sending data
+	// before the next one is tried, unless the retrieval sets its own - this
+	// includes the wait for the first byte, unless the retrieval sets a first
+	// byte timeout. Defaults to DefaultRetrievalStallTimeout, and negative
+	// disables stall detection
+	RetrievalStallTimeout time.Duration
+
+	// Most retrievals started with StartRetrievalTransfer that may run at
+	// once, in total and per provider - the rest wait in a queue (0 means no
+	// limit)
+	MaxConcurrentRetrievals            int
+	MaxConcurrentRetrievalsPerProvider int
+
+	// How many of each provider's most recent retrieval attempts are kept in
+	// the history, older ones being dropped as new ones are recorded - defaults
+	// to DefaultRetrievalHistoryLimit, and negative keeps every attempt
+	RetrievalHistoryLimit int
+
+	// How many miners are looked up at once while indexing peer IDs - defaults
+	// to DefaultStorageProviderIndexWorkers
+	StorageProviderIndexWorkers int
+
+	// Used to find the multiaddrs of providers that have none on chain, or
+	// whose on-chain ones can't be dialed (e.g. a DHT) - optional
+	PeerRouting routing.PeerRouting
+
+	// How long on-chain miner info is cached for before being looked up again
+	// - defaults to DefaultMinerInfoTTL, and negative disables caching
+	MinerInfoTTL time.Duration
+
+	// Whether cached miner info is also written to the datastore, so that it
+	// survives restarts
+	PersistMinerInfo bool
+
+	// Providers to always allow or deny - more can be blocked at runtime, and
+	// those rules are kept in the datastore
+	ProviderPolicy ProviderPolicyConfig
+
+	// Graphsync tuning - 0 leaves each at graphsync's own default
+	GraphsyncMaxInProgressOutgoingRequests uint64
+	GraphsyncMaxLinksPerOutgoingRequest    uint64
+	GraphsyncMessageSendRetries            int
+	GraphsyncSendMessageTimeout            time.Duration
+
+	// Restarts stalled or disconnected data transfer channels according to
+	// the config - nil disables restarts
+	DataTransferRestartConfig *channelmonitor.Config
+
+	// Holds the key of the client's address, for signing - optional, but if
+	// set, it must have the address the client was created with. Nothing is
+	// signed with it until paid retrievals are supported
+	Wallet api.Wallet
+
+	// Level of the client's logger (e.g. "debug" or "warn") - left as it is
+	// if empty
+	LogLevel string
+
+	// Key prefix of everything the client keeps in the datastore, so that the
+	// datastore can be shared - empty means the root
+	DatastoreNamespace string
+
+	// Key prefix of data transfer channel state, under DatastoreNamespace -
+	// empty means the same namespace as the rest of the client
+	DataTransferDatastoreNamespace string
+}
+
+// The config with every default filled in
+func DefaultConfig() Config {
+	return Config{}.withDefaults()
+}
+
+// Checks every field, returning an ErrInvalidConfig listing all the problems
+// found, or nil if there are none
+//
+// Zero values are valid, since they pick defaults
+func (cfg Config) Validate() error {
+	var problems []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+
+	if cfg.IndexerURL != "" {
+		indexerURL, err := url.Parse(cfg.IndexerURL)
+		check(
+			err == nil && (indexerURL.Scheme == "http" || indexerURL.Scheme == "https") && indexerURL.Host != "",
+			"IndexerURL %q is not an HTTP(S) URL",
+			cfg.IndexerURL,
+		)
+	}
+
+	check(cfg.MaxConcurrentRetrievals >= 0, "MaxConcurrentRetrievals must not be negative")
+	check(cfg.MaxConcurrentRetrievalsPerProvider >= 0, "MaxConcurrentRetrievalsPerProvider must not be negative")
+	check(cfg.StorageProviderIndexWorkers >= 0, "StorageProviderIndexWorkers must not be negative")
+	check(cfg.GraphsyncMessageSendRetries >= 0, "GraphsyncMessageSendRetries must not be negative")
+	check(cfg.GraphsyncSendMessageTimeout >= 0, "GraphsyncSendMessageTimeout must not be negative")
+
+	for i, target := range cfg.ProviderPolicy.Allow {
+		check(
+			(target.Address != address.Undef) != (target.PeerID != ""),
+			"ProviderPolicy.Allow[%d] must have exactly one of Address and PeerID",
+			i,
+		)
+	}
+	for i, target := range cfg.ProviderPolicy.Deny {
+		check(
+			(target.Address != address.Undef) != (target.PeerID != ""),
+			"ProviderPolicy.Deny[%d] must have exactly one of Address and PeerID",
+			i,
+		)
+	}
+
+	if cfg.LogLevel != "" {
+		_, err := logging.LevelFromString(cfg.LogLevel)
+		check(err == nil, "LogLevel %q is not a log level", cfg.LogLevel)
+	}
+
+	if len(problems) != 0 {
+		return fmt.Errorf("%w: %s", ErrInvalidConfig, strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
+func (cfg Config) withDefaults() Config {
+	if cfg.IndexerURL == "" {
+		cfg.IndexerURL = DefaultIndexerURL
+	}
+
+	if cfg.ConnectTimeout == 0 {
+		cfg.ConnectTimeout = DefaultConnectTimeout
+	}
+
+	if cfg.RPCTimeout == 0 {
+		cfg.RPCTimeout = DefaultRPCTimeout
+	}
+
+	if cfg.RetrievalStallTimeout == 0 {
+		cfg.RetrievalStallTimeout = DefaultRetrievalStallTimeout
+	}
+
+	if cfg.StorageProviderIndexWorkers == 0 {
+		cfg.StorageProviderIndexWorkers = DefaultStorageProviderIndexWorkers
+	}
+
+	if cfg.RetrievalHistoryLimit == 0 {
+		cfg.RetrievalHistoryLimit = DefaultRetrievalHistoryLimit
+	}
+
+	if cfg.MinerInfoTTL == 0 {
+		cfg.MinerInfoTTL = DefaultMinerInfoTTL
+	}
+
+	return cfg
+}
@@ -0,0 +1,100 @@
+package filclient
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/libp2p/go-libp2p/core/test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigValidate(t *testing.T) {
+	require.NoError(t, Config{}.Validate())
+	require.NoError(t, DefaultConfig().Validate())
+
+	defaults := DefaultConfig()
+	require.Equal(t, DefaultIndexerURL, defaults.IndexerURL)
+	require.Equal(t, DefaultConnectTimeout, defaults.ConnectTimeout)
+	require.Equal(t, DefaultRPCTimeout, defaults.RPCTimeout)
+	require.Equal(t, DefaultRetrievalStallTimeout, defaults.RetrievalStallTimeout)
+	require.Equal(t, DefaultStorageProviderIndexWorkers, defaults.StorageProviderIndexWorkers)
+	require.Equal(t, DefaultRetrievalHistoryLimit, defaults.RetrievalHistoryLimit)
+	require.Equal(t, DefaultMinerInfoTTL, defaults.MinerInfoTTL)
+
+	// Negative timeouts disable them rather than being invalid
+	require.NoError(t, Config{ConnectTimeout: -1, RetrievalStallTimeout: -1, MinerInfoTTL: -1}.Validate())
+
+	addr, err := address.NewIDAddress(1000)
+	require.NoError(t, err)
+
+	err = Config{
+		IndexerURL:                  "cid.contact",
+		MaxConcurrentRetrievals:     -1,
+		StorageProviderIndexWorkers: -1,
+		LogLevel:                    "loud",
+		ProviderPolicy: ProviderPolicyConfig{
+			Deny: []ProviderPolicyTarget{{Address: addr, PeerID: test.RandPeerIDFatal(t)}},
+		},
+	}.Validate()
+	require.ErrorIs(t, err, ErrInvalidConfig)
+
+	// Every problem is reported at once
+	for _, field := range []string{
+		"IndexerURL",
+		"MaxConcurrentRetrievals",
+		"StorageProviderIndexWorkers",
+		"LogLevel",
+		"ProviderPolicy.Deny[0]",
+	} {
+		require.True(t, strings.Contains(err.Error(), field), "missing %s in %q", field, err)
+	}
+}
+
+// Has no keys at all
+type testWallet struct {
+	api.Wallet
+}
+
+func (testWallet) WalletHas(ctx context.Context, addr address.Address) (bool, error) {
+	return false, nil
+}
+
+func TestConfigApplied(t *testing.T) {
+	ctx := context.Background()
+	ds := initDatastore(t)
+
+	// Invalid config is refused
+	_, err := New(ctx, nil, nil, address.Undef, initBlockstore(t), ds, WithMaxConcurrentRetrievals(-1))
+	require.ErrorIs(t, err, ErrInvalidConfig)
+
+	// So is a wallet without the client's key
+	addr, err := address.NewIDAddress(1000)
+	require.NoError(t, err)
+	_, err = New(ctx, nil, nil, addr, initBlockstore(t), ds, WithWallet(testWallet{}))
+	require.ErrorIs(t, err, ErrInvalidConfig)
+
+	fc := initStandaloneClient(
+		t,
+		ctx,
+		ds,
+		WithDatastoreNamespace("/service/filclient"),
+		WithConnectTimeout(time.Second),
+		WithRetrievalStallTimeout(-1),
+	)
+	require.Equal(t, time.Second, fc.connectTimeout)
+	require.Equal(t, DefaultRPCTimeout, fc.rpcTimeout)
+	require.Equal(t, time.Duration(-1), fc.retrievalStallTimeout)
+
+	// The client's keys end up under the namespace
+	require.NoError(t, fc.BlockProvider(ctx, ProviderPolicyTarget{PeerID: test.RandPeerIDFatal(t)}, "", 0))
+	results, err := ds.Query(ctx, query.Query{Prefix: "/service/filclient/ProviderPolicy"})
+	require.NoError(t, err)
+	entries, err := results.Rest()
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+}
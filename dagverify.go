@@ -0,0 +1,202 @@
+package filclient
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	dagpb "github.com/ipld/go-codec-dagpb"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/linking"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/ipld/go-ipld-prime/traversal"
+	"github.com/ipld/go-ipld-prime/traversal/selector"
+	selectorparse "github.com/ipld/go-ipld-prime/traversal/selector/parse"
+
+	_ "github.com/ipld/go-ipld-prime/codec/dagcbor"
+	_ "github.com/ipld/go-ipld-prime/codec/dagjson"
+	_ "github.com/ipld/go-ipld-prime/codec/raw"
+)
+
+// dagverify.go - checking that a DAG is fully and correctly stored locally
+
+var (
+	ErrDAGBlockMissing = errors.New("DAG block missing")
+	ErrDAGBlockCorrupt = errors.New("DAG block corrupt")
+)
+
+// Walks the selector over the DAG in the local blockstore, checking that every
+// block it reaches is present and matches its CID - if the selector is nil, the
+// whole DAG is checked
+//
+// The walk can't continue past a missing block, so only the first problem
+// found is reported, as an ErrDAGBlockMissing or ErrDAGBlockCorrupt error
+func (client *Client) VerifyDAG(ctx context.Context, root cid.Cid, selector ipld.Node) error {
+	return verifyDAG(ctx, root, selector, func(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+		has, err := client.bs.Has(ctx, c)
+		if err != nil || !has {
+			return nil, err
+		}
+
+		return client.bs.Get(ctx, c)
+	})
+}
+
+// Verifies the DAG the transfer retrieved, from wherever its blocks were put
+func (transfer *RetrievalTransfer) verify(ctx context.Context) error {
+	// Pieces are retrieved without knowing the payload CID, and their blocks
+	// were already checked against their CIDs as they arrived
+	if !transfer.proposal.PayloadCID.Defined() {
+		return nil
+	}
+
+	return verifyDAG(ctx, transfer.proposal.PayloadCID, transfer.selector, transfer.localBlock)
+}
+
+// Load returns nil if the block isn't available
+func verifyDAG(
+	ctx context.Context,
+	root cid.Cid,
+	sel ipld.Node,
+	load func(context.Context, cid.Cid) (blocks.Block, error),
+) error {
+	// Errors from load may come back wrapped by the traversal, so keep hold of
+	// the original
+	var problem error
+
+	err := walkDAG(ctx, root, sel, func(ctx context.Context, c cid.Cid) ([]byte, error) {
+		block, err := load(ctx, c)
+		if err != nil {
+			return nil, err
+		}
+		if block == nil {
+			problem = fmt.Errorf("%w: %s", ErrDAGBlockMissing, c)
+			return nil, problem
+		}
+
+		// Blockstores don't necessarily check the data on read
+		actual, err := c.Prefix().Sum(block.RawData())
+		if err != nil {
+			return nil, err
+		}
+		if !actual.Equals(c) {
+			problem = fmt.Errorf("%w: %s has data for %s", ErrDAGBlockCorrupt, c, actual)
+			return nil, problem
+		}
+
+		return block.RawData(), nil
+	})
+	if problem != nil {
+		return problem
+	}
+
+	return err
+}
+
+// Walks the selector over whatever part of the DAG is in the local blockstore,
+// returning the total size of the blocks reached, and whether none of the
+// blocks the selector needs were missing
+//
+// Blocks reached more than once through different paths are only counted the
+// first time, so that the size matches what's actually stored
+func (client *Client) localDAGSize(ctx context.Context, root cid.Cid, sel ipld.Node) (uint64, bool, error) {
+	var size uint64
+	complete := true
+	counted := cid.NewSet()
+
+	if err := walkDAG(ctx, root, sel, func(ctx context.Context, c cid.Cid) ([]byte, error) {
+		has, err := client.bs.Has(ctx, c)
+		if err != nil {
+			return nil, err
+		}
+		if !has {
+			complete = false
+			return nil, traversal.SkipMe{}
+		}
+
+		block, err := client.bs.Get(ctx, c)
+		if err != nil {
+			return nil, err
+		}
+
+		if counted.Visit(c) {
+			size += uint64(len(block.RawData()))
+		}
+
+		return block.RawData(), nil
+	}); err != nil {
+		return 0, false, err
+	}
+
+	return size, complete, nil
+}
+
+// Walks the selector over the DAG, getting the blocks from load - load may
+// return traversal.SkipMe to leave out a block and everything under it, which
+// for the root ends the walk straight away
+//
+// A nil selector walks the whole DAG
+func walkDAG(
+	ctx context.Context,
+	root cid.Cid,
+	sel ipld.Node,
+	load func(context.Context, cid.Cid) ([]byte, error),
+) error {
+	if sel == nil {
+		sel = selectorparse.CommonSelector_ExploreAllRecursively
+	}
+
+	compiled, err := selector.CompileSelector(sel)
+	if err != nil {
+		return err
+	}
+
+	lsys := cidlink.DefaultLinkSystem()
+	lsys.StorageReadOpener = func(lctx linking.LinkContext, link datamodel.Link) (io.Reader, error) {
+		cidLink, ok := link.(cidlink.Link)
+		if !ok {
+			return nil, fmt.Errorf("unsupported link type %T", link)
+		}
+
+		data, err := load(lctx.Ctx, cidLink.Cid)
+		if err != nil {
+			return nil, err
+		}
+
+		return bytes.NewReader(data), nil
+	}
+
+	chooser := dagpb.AddSupportToChooser(basicnode.Chooser)
+
+	rootLink := cidlink.Link{Cid: root}
+	rootPrototype, err := chooser(rootLink, linking.LinkContext{Ctx: ctx})
+	if err != nil {
+		return err
+	}
+
+	rootNode, err := lsys.Load(linking.LinkContext{Ctx: ctx}, rootLink, rootPrototype)
+	if err != nil {
+		if _, ok := err.(traversal.SkipMe); ok {
+			return nil
+		}
+		return err
+	}
+
+	progress := traversal.Progress{
+		Cfg: &traversal.Config{
+			Ctx:                            ctx,
+			LinkSystem:                     lsys,
+			LinkTargetNodePrototypeChooser: chooser,
+		},
+	}
+
+	return progress.WalkAdv(rootNode, compiled, func(traversal.Progress, datamodel.Node, traversal.VisitReason) error {
+		return nil
+	})
+}
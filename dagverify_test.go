@@ -0,0 +1,149 @@
+package filclient
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/ipfs/go-merkledag"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/fluent/qp"
+	"github.com/ipld/go-ipld-prime/linking"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	selectorparse "github.com/ipld/go-ipld-prime/traversal/selector/parse"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyDAG(t *testing.T) {
+	ctx := context.Background()
+
+	fc := initStandaloneClient(t, ctx, initDatastore(t))
+
+	root := merkledag.NodeWithData([]byte("root"))
+	var leaves []*merkledag.RawNode
+	for _, data := range []string{"foo", "bar", "baz"} {
+		leaf := merkledag.NewRawNode([]byte(data))
+		require.NoError(t, root.AddNodeLink(data, leaf))
+		require.NoError(t, fc.bs.Put(ctx, leaf))
+		leaves = append(leaves, leaf)
+	}
+	require.NoError(t, fc.bs.Put(ctx, root))
+
+	require.NoError(t, fc.VerifyDAG(ctx, root.Cid(), nil))
+
+	// Missing leaves don't matter if the selector doesn't reach them
+	require.NoError(t, fc.bs.DeleteBlock(ctx, leaves[0].Cid()))
+	require.NoError(t, fc.VerifyDAG(ctx, root.Cid(), selectorparse.CommonSelector_MatchPoint))
+	require.ErrorIs(t, fc.VerifyDAG(ctx, root.Cid(), nil), ErrDAGBlockMissing)
+
+	// Put the wrong data under one of the leaves
+	corrupt, err := blocks.NewBlockWithCid([]byte("qux"), leaves[0].Cid())
+	require.NoError(t, err)
+	require.NoError(t, fc.bs.Put(ctx, corrupt))
+	require.ErrorIs(t, fc.VerifyDAG(ctx, root.Cid(), nil), ErrDAGBlockCorrupt)
+
+	require.ErrorIs(t, fc.VerifyDAG(ctx, merkledag.NewRawNode([]byte("other")).Cid(), nil), ErrDAGBlockMissing)
+}
+
+func TestLocalDAGSize(t *testing.T) {
+	ctx := context.Background()
+
+	fc := initStandaloneClient(t, ctx, initDatastore(t))
+
+	root, leaves, size := testDAGCBOR(t, ctx, fc.bs)
+
+	localSize, complete, err := fc.localDAGSize(ctx, root, nil)
+	require.NoError(t, err)
+	require.True(t, complete)
+	require.Equal(t, size, localSize)
+
+	leaf, err := fc.bs.Get(ctx, leaves[0])
+	require.NoError(t, err)
+	require.NoError(t, fc.bs.DeleteBlock(ctx, leaves[0]))
+
+	// The rest of the DAG is still counted
+	localSize, complete, err = fc.localDAGSize(ctx, root, nil)
+	require.NoError(t, err)
+	require.False(t, complete)
+	require.Equal(t, size-uint64(len(leaf.RawData())), localSize)
+
+	// The missing leaf doesn't matter if the selector doesn't reach it
+	_, complete, err = fc.localDAGSize(ctx, root, selectorparse.CommonSelector_MatchPoint)
+	require.NoError(t, err)
+	require.True(t, complete)
+
+	localSize, complete, err = fc.localDAGSize(ctx, merkledag.NewRawNode([]byte("other")).Cid(), nil)
+	require.NoError(t, err)
+	require.False(t, complete)
+	require.Zero(t, localSize)
+
+	// A block linked from more than one place is only stored, and counted, once
+	shared := merkledag.NewRawNode([]byte("shared"))
+	sharedRoot := merkledag.NodeWithData([]byte("root"))
+	require.NoError(t, sharedRoot.AddNodeLink("a", shared))
+	require.NoError(t, sharedRoot.AddNodeLink("b", shared))
+	require.NoError(t, fc.bs.Put(ctx, shared))
+	require.NoError(t, fc.bs.Put(ctx, sharedRoot))
+
+	localSize, complete, err = fc.localDAGSize(ctx, sharedRoot.Cid(), nil)
+	require.NoError(t, err)
+	require.True(t, complete)
+	require.Equal(t, uint64(len(sharedRoot.RawData())+len(shared.RawData())), localSize)
+}
+
+// Stores a small dag-cbor DAG in the blockstore and returns its root, its
+// leaves, and the total size of its blocks
+func testDAGCBOR(t *testing.T, ctx context.Context, bs blockstore.Blockstore) (cid.Cid, []cid.Cid, uint64) {
+	var size uint64
+
+	lsys := cidlink.DefaultLinkSystem()
+	lsys.StorageWriteOpener = func(lctx linking.LinkContext) (io.Writer, linking.BlockWriteCommitter, error) {
+		var buf bytes.Buffer
+		return &buf, func(link datamodel.Link) error {
+			block, err := blocks.NewBlockWithCid(buf.Bytes(), link.(cidlink.Link).Cid)
+			if err != nil {
+				return err
+			}
+			size += uint64(len(block.RawData()))
+			return bs.Put(ctx, block)
+		}, nil
+	}
+
+	linkPrototype := cidlink.LinkPrototype{Prefix: cid.Prefix{
+		Version:  1,
+		Codec:    cid.DagCBOR,
+		MhType:   0x12,
+		MhLength: 32,
+	}}
+
+	var leaves []cid.Cid
+	for _, name := range []string{"foo", "bar"} {
+		node, err := qp.BuildMap(basicnode.Prototype.Any, 1, func(ma datamodel.MapAssembler) {
+			qp.MapEntry(ma, "name", qp.String(name))
+		})
+		require.NoError(t, err)
+
+		link, err := lsys.Store(linking.LinkContext{Ctx: ctx}, linkPrototype, node)
+		require.NoError(t, err)
+		leaves = append(leaves, link.(cidlink.Link).Cid)
+	}
+
+	root, err := qp.BuildMap(basicnode.Prototype.Any, 1, func(ma datamodel.MapAssembler) {
+		qp.MapEntry(ma, "children", qp.List(int64(len(leaves)), func(la datamodel.ListAssembler) {
+			for _, leaf := range leaves {
+				qp.ListEntry(la, qp.Link(cidlink.Link{Cid: leaf}))
+			}
+		}))
+	})
+	require.NoError(t, err)
+
+	rootLink, err := lsys.Store(linking.LinkContext{Ctx: ctx}, linkPrototype, root)
+	require.NoError(t, err)
+
+	return rootLink.(cidlink.Link).Cid, leaves, size
+}
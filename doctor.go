@@ -0,0 +1,303 @@
+package filclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/go-fil-markets/storagemarket/network"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/transport"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/multiformats/go-multihash"
+)
+
+// doctor.go - step by step diagnosis of why a storage provider can't be
+// reached
+
+// The steps of reaching a storage provider, in the order they're diagnosed
+type ProviderDiagnosticStep string
+
+const (
+	ProviderDiagnosticStepChainLookup     ProviderDiagnosticStep = "chain lookup"
+	ProviderDiagnosticStepParseMultiaddrs ProviderDiagnosticStep = "multiaddr parsing"
+	ProviderDiagnosticStepDial            ProviderDiagnosticStep = "dial"
+	ProviderDiagnosticStepIdentify        ProviderDiagnosticStep = "identify"
+	ProviderDiagnosticStepProtocols       ProviderDiagnosticStep = "protocols"
+	ProviderDiagnosticStepRetrievalQuery  ProviderDiagnosticStep = "retrieval query"
+	ProviderDiagnosticStepStorageAsk      ProviderDiagnosticStep = "storage ask"
+)
+
+// Each step gets this long on its own, so that one hanging step doesn't use up
+// the time of the rest
+const providerDiagnosticStepTimeout = 30 * time.Second
+
+// How one step of a diagnosis went
+type ProviderDiagnostic struct {
+	Step ProviderDiagnosticStep
+
+	// What the step was run against if there are several of the step (e.g.
+	// the multiaddr of a dial)
+	Target string
+
+	Duration time.Duration
+
+	// What the step found
+	Detail string
+
+	// Nil if the step succeeded
+	Err error
+
+	// Set if the step couldn't run at all because of an earlier step, with the
+	// reason in Err
+	Skipped bool
+}
+
+func (diagnostic ProviderDiagnostic) OK() bool {
+	return diagnostic.Err == nil
+}
+
+// Used as the payload of the diagnostic retrieval query - the provider won't
+// have it, but answering at all shows the protocol works
+var diagnosticPayloadCid = func() cid.Cid {
+	hash, err := multihash.Sum([]byte("filclient diagnostic query"), multihash.IDENTITY, -1)
+	if err != nil {
+		panic(err)
+	}
+	return cid.NewCidV1(cid.Raw, hash)
+}()
+
+// Runs each step of reaching the provider separately, timing them and
+// recording how each went - unlike Connect, nothing falls back on anything
+// else, so a failure points at the step that broke
+//
+// Later steps still run when earlier ones fail, unless they can't without
+// them, in which case they're marked as skipped. Each step times out on its
+// own (see providerDiagnosticStepTimeout)
+func (handle *StorageProviderHandle) Diagnose(ctx context.Context) []ProviderDiagnostic {
+	var diagnostics []ProviderDiagnostic
+
+	run := func(step ProviderDiagnosticStep, target string, f func(ctx context.Context) (string, error)) error {
+		ctx, cancel := context.WithTimeout(ctx, providerDiagnosticStepTimeout)
+		defer cancel()
+
+		start := time.Now()
+		detail, err := f(ctx)
+		diagnostics = append(diagnostics, ProviderDiagnostic{
+			Step:     step,
+			Target:   target,
+			Duration: time.Since(start),
+			Detail:   detail,
+			Err:      err,
+		})
+
+		return err
+	}
+
+	skip := func(step ProviderDiagnosticStep, reason string) {
+		diagnostics = append(diagnostics, ProviderDiagnostic{
+			Step:    step,
+			Err:     errors.New(reason),
+			Skipped: true,
+		})
+	}
+
+	// Chain lookup - the cache is bypassed, so that the lookup itself is
+	// what gets timed
+	var rawMultiaddrs []abi.Multiaddrs
+	run(ProviderDiagnosticStepChainLookup, "", func(ctx context.Context) (string, error) {
+		if handle.client.api == nil {
+			return "", fmt.Errorf("%w: no chain connection", ErrLotusError)
+		}
+
+		addr, err := handle.Address(ctx)
+		if err != nil {
+			return "", err
+		}
+
+		info, err := handle.client.api.StateMinerInfo(ctx, addr, types.EmptyTSK)
+		if err != nil {
+			return "", fmt.Errorf("%w: %v", ErrLotusError, err)
+		}
+
+		rawMultiaddrs = info.Multiaddrs
+
+		if info.PeerId == nil {
+			return "", fmt.Errorf("%w: miner info has no peer ID set on chain", ErrLotusError)
+		}
+
+		if handle.peerID != "" && handle.peerID != *info.PeerId {
+			return "", fmt.Errorf("chain has peer ID %s, but the handle has %s", *info.PeerId, handle.peerID)
+		}
+		handle.peerID = *info.PeerId
+
+		return fmt.Sprintf("%s has peer ID %s and %d multiaddrs", addr, handle.peerID, len(info.Multiaddrs)), nil
+	})
+
+	// Multiaddr parsing - with nothing on chain, fall back on whatever's known
+	// already, which is what Connect would do
+	var multiaddrs []multiaddr.Multiaddr
+	if len(rawMultiaddrs) == 0 {
+		multiaddrs = append(multiaddrs, handle.addrs...)
+		if handle.peerID != "" {
+			multiaddrs = append(multiaddrs, handle.client.host.Peerstore().Addrs(handle.peerID)...)
+		}
+		skip(ProviderDiagnosticStepParseMultiaddrs, "no multiaddrs on chain to parse")
+	} else {
+		run(ProviderDiagnosticStepParseMultiaddrs, "", func(ctx context.Context) (string, error) {
+			var invalid int
+			var firstErr error
+			for _, addrBytes := range rawMultiaddrs {
+				maddr, err := multiaddr.NewMultiaddrBytes(addrBytes)
+				if err != nil {
+					invalid++
+					if firstErr == nil {
+						firstErr = err
+					}
+					continue
+				}
+				multiaddrs = append(multiaddrs, maddr)
+			}
+
+			if invalid != 0 {
+				return "", fmt.Errorf("%d of %d multiaddrs are invalid (first error: %v)", invalid, len(rawMultiaddrs), firstErr)
+			}
+
+			return fmt.Sprintf("all %d multiaddrs are valid", len(multiaddrs)), nil
+		})
+	}
+
+	if handle.peerID == "" {
+		for _, step := range []ProviderDiagnosticStep{
+			ProviderDiagnosticStepDial,
+			ProviderDiagnosticStepIdentify,
+			ProviderDiagnosticStepProtocols,
+			ProviderDiagnosticStepRetrievalQuery,
+			ProviderDiagnosticStepStorageAsk,
+		} {
+			skip(step, "peer ID is unknown")
+		}
+		return diagnostics
+	}
+
+	// Dialing each multiaddr
+	if len(multiaddrs) == 0 {
+		skip(ProviderDiagnosticStepDial, "no multiaddrs to dial")
+	}
+	var dialable []multiaddr.Multiaddr
+	for _, maddr := range multiaddrs {
+		maddr := maddr
+		err := run(ProviderDiagnosticStepDial, maddr.String(), func(ctx context.Context) (string, error) {
+			return handle.client.diagnoseDial(ctx, handle.peerID, maddr)
+		})
+		if err == nil {
+			dialable = append(dialable, maddr)
+		}
+	}
+
+	// Identify, over a connection made with the multiaddrs that dialed
+	run(ProviderDiagnosticStepIdentify, "", func(ctx context.Context) (string, error) {
+		if err := handle.client.host.Connect(ctx, peer.AddrInfo{
+			ID:    handle.peerID,
+			Addrs: dialable,
+		}); err != nil {
+			return "", fmt.Errorf("%w: %v", ErrMinerConnectionFailed, err)
+		}
+
+		handle.client.waitIdentify(ctx, handle.peerID)
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+
+		version, err := handle.client.host.Peerstore().Get(handle.peerID, "AgentVersion")
+		if err != nil {
+			return "", fmt.Errorf("no agent version after identify: %v", err)
+		}
+
+		return fmt.Sprintf("agent version %v", version), nil
+	})
+
+	// Protocol listing
+	run(ProviderDiagnosticStepProtocols, "", func(ctx context.Context) (string, error) {
+		protocols, err := handle.client.host.Peerstore().GetProtocols(handle.peerID)
+		if err != nil {
+			return "", err
+		}
+
+		if len(protocols) == 0 {
+			return "", fmt.Errorf("provider advertises no protocols")
+		}
+
+		return fmt.Sprintf("%d protocols advertised", len(protocols)), nil
+	})
+
+	// The retrieval query protocol
+	run(ProviderDiagnosticStepRetrievalQuery, "", func(ctx context.Context) (string, error) {
+		resp, version, err := runRPC(ctx, handle, retrievalQueryProtocol, retrievalmarket.Query{
+			PayloadCID: diagnosticPayloadCid,
+		})
+		if err != nil {
+			return "", err
+		}
+
+		return fmt.Sprintf("answered over %s (status %d)", version, resp.Status), nil
+	})
+
+	// The storage ask protocol
+	if handle.addr == address.Undef {
+		skip(ProviderDiagnosticStepStorageAsk, "address is unknown")
+	} else {
+		run(ProviderDiagnosticStepStorageAsk, "", func(ctx context.Context) (string, error) {
+			resp, version, err := runRPC(ctx, handle, storageAskProtocol, network.AskRequest{Miner: handle.addr})
+			if err != nil {
+				return "", err
+			}
+
+			if resp.Ask == nil || resp.Ask.Ask == nil {
+				return "", fmt.Errorf("answered over %s without an ask", version)
+			}
+
+			return fmt.Sprintf("answered over %s (price %s)", version, types.FIL(resp.Ask.Ask.Price)), nil
+		})
+	}
+
+	return diagnostics
+}
+
+// Dials just the one multiaddr, on a connection of its own that's closed
+// again straight away - if the host's network doesn't expose its transports,
+// the host connects with only that multiaddr instead, which may reuse an
+// existing connection
+func (client *Client) diagnoseDial(ctx context.Context, peerID peer.ID, maddr multiaddr.Multiaddr) (string, error) {
+	transports, ok := client.host.Network().(interface {
+		TransportForDialing(multiaddr.Multiaddr) transport.Transport
+	})
+	if !ok {
+		if err := client.host.Connect(ctx, peer.AddrInfo{
+			ID:    peerID,
+			Addrs: []multiaddr.Multiaddr{maddr},
+		}); err != nil {
+			return "", err
+		}
+		return "connected (may have reused an existing connection)", nil
+	}
+
+	tpt := transports.TransportForDialing(maddr)
+	if tpt == nil {
+		return "", fmt.Errorf("no transport for multiaddr")
+	}
+
+	conn, err := tpt.Dial(ctx, maddr, peerID)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	return fmt.Sprintf("connected from %s", conn.LocalMultiaddr()), nil
+}
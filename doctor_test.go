@@ -0,0 +1,87 @@
+package filclient
+
+import (
+	"context"
+	"testing"
+
+	"github.com/filecoin-project/go-address"
+	cborutil "github.com/filecoin-project/go-cbor-util"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiagnose(t *testing.T) {
+	ctx := context.Background()
+
+	fc, provider := initTransportsTestClient(t, ctx, retrievalTransportsResponse{})
+	provider.SetStreamHandler(retrievalmarket.QueryProtocolID, func(stream network.Stream) {
+		defer stream.Close()
+
+		var query retrievalmarket.Query
+		if err := cborutil.ReadCborRPC(stream, &query); err != nil {
+			return
+		}
+
+		resp := retrievalmarket.QueryResponse{Status: retrievalmarket.QueryResponseUnavailable}
+		resp.PaymentAddress, _ = address.NewIDAddress(1000)
+		cborutil.WriteCborRPC(stream, &resp)
+	})
+
+	addr, err := address.NewIDAddress(1000)
+	require.NoError(t, err)
+	fc.api = &testMinerGateway{
+		miners: map[address.Address]peer.ID{addr: provider.ID()},
+		multiaddrs: map[address.Address][]abi.Multiaddrs{addr: {
+			multiaddr.StringCast("/ip4/127.0.0.1/tcp/1234").Bytes(),
+			[]byte("invalid"),
+		}},
+	}
+
+	diagnostics := fc.StorageProviderByAddress(addr).Diagnose(ctx)
+
+	results := make(map[ProviderDiagnosticStep]ProviderDiagnostic)
+	var steps []ProviderDiagnosticStep
+	for _, diagnostic := range diagnostics {
+		results[diagnostic.Step] = diagnostic
+		steps = append(steps, diagnostic.Step)
+	}
+
+	require.Equal(t, []ProviderDiagnosticStep{
+		ProviderDiagnosticStepChainLookup,
+		ProviderDiagnosticStepParseMultiaddrs,
+		ProviderDiagnosticStepDial,
+		ProviderDiagnosticStepIdentify,
+		ProviderDiagnosticStepProtocols,
+		ProviderDiagnosticStepRetrievalQuery,
+		ProviderDiagnosticStepStorageAsk,
+	}, steps)
+
+	require.True(t, results[ProviderDiagnosticStepChainLookup].OK())
+
+	// The invalid multiaddr is reported, but the valid one still gets dialed
+	require.Error(t, results[ProviderDiagnosticStepParseMultiaddrs].Err)
+	require.Equal(t, "/ip4/127.0.0.1/tcp/1234", results[ProviderDiagnosticStepDial].Target)
+	require.True(t, results[ProviderDiagnosticStepDial].OK())
+
+	require.True(t, results[ProviderDiagnosticStepIdentify].OK())
+	require.True(t, results[ProviderDiagnosticStepProtocols].OK())
+	require.True(t, results[ProviderDiagnosticStepRetrievalQuery].OK())
+	require.Contains(t, results[ProviderDiagnosticStepRetrievalQuery].Detail, string(retrievalmarket.QueryProtocolID))
+
+	// The provider doesn't serve storage asks
+	require.Error(t, results[ProviderDiagnosticStepStorageAsk].Err)
+	require.False(t, results[ProviderDiagnosticStepStorageAsk].Skipped)
+
+	// Without a peer ID, nothing past the chain can be checked
+	unknown, err := address.NewIDAddress(1001)
+	require.NoError(t, err)
+	diagnostics = fc.StorageProviderByAddress(unknown).Diagnose(ctx)
+	require.False(t, diagnostics[0].OK())
+	for _, diagnostic := range diagnostics[2:] {
+		require.True(t, diagnostic.Skipped, diagnostic.Step)
+	}
+}
@@ -3,7 +3,9 @@ package filclient
 import (
 	"context"
 	"errors"
+	"fmt"
 	"sync"
+	"time"
 
 	"github.com/filecoin-project/go-address"
 	datatransfer "github.com/filecoin-project/go-data-transfer"
@@ -13,13 +15,18 @@ import (
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
 	"github.com/filecoin-project/go-fil-markets/storagemarket/impl/requestvalidation"
 	"github.com/filecoin-project/lotus/api"
+	bsnet "github.com/ipfs/go-bitswap/network"
 	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/namespace"
 	gsimpl "github.com/ipfs/go-graphsync/impl"
 	gsnet "github.com/ipfs/go-graphsync/network"
 	"github.com/ipfs/go-graphsync/storeutil"
 	blockstore "github.com/ipfs/go-ipfs-blockstore"
 	logging "github.com/ipfs/go-log"
+	"github.com/ipld/go-ipld-prime/linking"
+	routinghelpers "github.com/libp2p/go-libp2p-routing-helpers"
 	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/routing"
 )
 
 // filclient.go - code related to initialization and management of the core
@@ -31,9 +38,6 @@ var (
 	ErrLotusError = errors.New("lotus error")
 )
 
-type Config struct {
-}
-
 type Client struct {
 	host          host.Host
 	api           api.Gateway
@@ -42,9 +46,46 @@ type Client struct {
 	bs            blockstore.Blockstore
 	ds            datastore.Datastore
 
+	// Each bitswap retrieval runs its own bitswap client over the network,
+	// with the router handing it only what its provider sends
+	bitswapNetwork bsnet.BitSwapNetwork
+	bitswapRouter  *bitswapRouter
+
+	// The client's own address, and the wallet with its key - either may be
+	// unset
+	addr   address.Address
+	wallet api.Wallet
+
+	indexerURL string
+
+	connectTimeout              time.Duration
+	rpcTimeout                  time.Duration
+	retrievalStallTimeout       time.Duration
+	retrievalHistoryLimit       int
+	storageProviderIndexWorkers int
+
+	// May be nil
+	peerRouting routing.PeerRouting
+
+	retrievalScheduler *retrievalScheduler
+
+	minerInfoCache *minerInfoCache
+
+	providerPolicy *providerPolicy
+
+	// Held while scanning the chain to index storage provider peer IDs
+	storageProviderIndexLk        sync.Mutex
+	storageProviderIndexRefreshed time.Time
+
+	// Link systems for streamed graphsync retrievals, picked up when their
+	// channels are opened
+	retrievalLinkSystems   map[retrievalmarket.DealID]linking.LinkSystem
+	retrievalLinkSystemsLk sync.Mutex
+
 	// TODO(@elijaharita): this shouldn't be in the main Client struct
 	retrievalTransfers   map[datatransfer.ChannelID]*RetrievalTransfer
 	retrievalTransfersLk sync.Mutex
+	retrievalSubscribers retrievalSubscribers
 }
 
 func New(
@@ -62,25 +103,92 @@ func New(
 		opt(&cfg)
 	}
 
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	cfg = cfg.withDefaults()
+
+	if cfg.LogLevel != "" {
+		if err := logging.SetLogLevel("filclient", cfg.LogLevel); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.Wallet != nil && addr != address.Undef {
+		has, err := cfg.Wallet.WalletHas(ctx, addr)
+		if err != nil {
+			return nil, err
+		}
+		if !has {
+			return nil, fmt.Errorf("%w: wallet does not have the key of %s", ErrInvalidConfig, addr)
+		}
+	}
+
+	if cfg.DatastoreNamespace != "" {
+		ds = namespace.Wrap(ds, datastore.NewKey(cfg.DatastoreNamespace))
+	}
+
+	dtDS := ds
+	if cfg.DataTransferDatastoreNamespace != "" {
+		dtDS = namespace.Wrap(ds, datastore.NewKey(cfg.DataTransferDatastoreNamespace))
+	}
+
 	// ctx, cancel := context.WithCancel(ctx)
 
 	// rpc := rpcstmgr.NewRPCStateManager(api)
 
 	// paychDS := paychmgr.NewStore(namespace.Wrap(ds, datastore.NewKey("paych")))
 
-	dt, err := initDataTransfer(ctx, h, bs, ds)
+	providerPolicy, err := newProviderPolicy(ctx, cfg.ProviderPolicy, ds)
+	if err != nil {
+		return nil, err
+	}
+
+	dt, dtReady, err := initDataTransfer(ctx, h, bs, dtDS, cfg)
 	if err != nil {
 		return nil, err
 	}
 
+	bitswapNetwork, bitswapRouter := initBitswap(h)
+
+	retrievalScheduler := newRetrievalScheduler(
+		cfg.MaxConcurrentRetrievals,
+		cfg.MaxConcurrentRetrievalsPerProvider,
+	)
+
 	client := &Client{
 		host: h,
 		api:  api,
 		dt:   dt,
 		// dtUnsubscribe: assigned below
-		bs:                 bs,
-		ds:                 ds,
+		bs:             bs,
+		ds:             ds,
+		bitswapNetwork: bitswapNetwork,
+		bitswapRouter:  bitswapRouter,
+		addr:           addr,
+		wallet:         cfg.Wallet,
+		indexerURL:     cfg.IndexerURL,
+
+		connectTimeout:              cfg.ConnectTimeout,
+		rpcTimeout:                  cfg.RPCTimeout,
+		retrievalStallTimeout:       cfg.RetrievalStallTimeout,
+		retrievalHistoryLimit:       cfg.RetrievalHistoryLimit,
+		storageProviderIndexWorkers: cfg.StorageProviderIndexWorkers,
+
+		peerRouting:        cfg.PeerRouting,
+		retrievalScheduler: retrievalScheduler,
+		minerInfoCache:     newMinerInfoCache(cfg.MinerInfoTTL, cfg.PersistMinerInfo),
+		providerPolicy:     providerPolicy,
 		retrievalTransfers: make(map[datatransfer.ChannelID]*RetrievalTransfer),
+
+		retrievalLinkSystems: make(map[retrievalmarket.DealID]linking.LinkSystem),
+	}
+
+	if err := dt.RegisterTransportConfigurer(
+		&retrievalmarket.DealProposal{},
+		client.configureRetrievalTransport,
+	); err != nil {
+		return nil, err
 	}
 
 	client.dtUnsubscribe = dt.SubscribeToEvents(func(
@@ -90,6 +198,29 @@ func New(
 		client.handleDataTransferRetrievalEvent(ctx, event, channelState)
 	})
 
+	// Address rules need their peer IDs before anything is checked against
+	// them, including the transfers being resumed
+	client.resolveProviderPolicyPeerIDs(ctx)
+
+	// Resuming lists and restarts data transfer channels, which fails until the
+	// channel state migrations are done
+	select {
+	case err := <-dtReady:
+		if err != nil {
+			client.Close()
+			return nil, err
+		}
+	case <-ctx.Done():
+		client.Close()
+		return nil, ctx.Err()
+	}
+
+	// Pick up where any retrievals left off before the last shutdown
+	if err := client.resumeRetrievalTransfers(ctx); err != nil {
+		client.Close()
+		return nil, err
+	}
+
 	return client, nil
 }
 
@@ -97,6 +228,10 @@ func (client *Client) Close() {
 	if client.dtUnsubscribe != nil {
 		client.dtUnsubscribe()
 	}
+
+	if client.bitswapNetwork != nil {
+		client.bitswapNetwork.Stop()
+	}
 }
 
 func initDataTransfer(
@@ -104,47 +239,85 @@ func initDataTransfer(
 	h host.Host,
 	bs blockstore.Blockstore,
 	ds datastore.Batching,
-) (datatransfer.Manager, error) {
+	cfg Config,
+) (datatransfer.Manager, <-chan error, error) {
+	var gsOpts []gsimpl.Option
+	if cfg.GraphsyncMaxInProgressOutgoingRequests != 0 {
+		gsOpts = append(gsOpts, gsimpl.MaxInProgressOutgoingRequests(cfg.GraphsyncMaxInProgressOutgoingRequests))
+	}
+	if cfg.GraphsyncMaxLinksPerOutgoingRequest != 0 {
+		gsOpts = append(gsOpts, gsimpl.MaxLinksPerOutgoingRequests(cfg.GraphsyncMaxLinksPerOutgoingRequest))
+	}
+	if cfg.GraphsyncMessageSendRetries != 0 {
+		gsOpts = append(gsOpts, gsimpl.MessageSendRetries(cfg.GraphsyncMessageSendRetries))
+	}
+	if cfg.GraphsyncSendMessageTimeout != 0 {
+		gsOpts = append(gsOpts, gsimpl.SendMessageTimeout(cfg.GraphsyncSendMessageTimeout))
+	}
+
+	var dtOpts []dtimpl.DataTransferOption
+	if cfg.DataTransferRestartConfig != nil {
+		dtOpts = append(dtOpts, dtimpl.ChannelRestartConfig(*cfg.DataTransferRestartConfig))
+	}
+
 	dtNetwork := network.NewFromLibp2pHost(h)
 	gsNetwork := gsnet.NewFromLibp2pHost(h)
-	gsExchange := gsimpl.New(ctx, gsNetwork, storeutil.LinkSystemForBlockstore(bs))
+	gsExchange := gsimpl.New(ctx, gsNetwork, storeutil.LinkSystemForBlockstore(bs), gsOpts...)
 	gsTransport := graphsync.NewTransport(h.ID(), gsExchange)
 
-	dt, err := dtimpl.NewDataTransfer(ds, dtNetwork, gsTransport)
+	dt, err := dtimpl.NewDataTransfer(ds, dtNetwork, gsTransport, dtOpts...)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	if err := dt.RegisterVoucherType(
 		&requestvalidation.StorageDataTransferVoucher{},
 		nil,
 	); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	if err := dt.RegisterVoucherType(
 		&retrievalmarket.DealProposal{},
 		nil,
 	); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	if err := dt.RegisterVoucherType(
 		&retrievalmarket.DealPayment{},
 		nil,
 	); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	if err := dt.RegisterVoucherResultType(
 		&retrievalmarket.DealResponse{},
 	); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
+	// Channel state migrations run in the background once started, and only
+	// report when they're done to subscribers from before the start
+	ready := make(chan error, 1)
+	dt.OnReady(func(err error) {
+		ready <- err
+	})
+
 	if err := dt.Start(ctx); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	return dt, nil
+	return dt, ready, nil
+}
+
+// Sets up the client-only bitswap network - blocks are only requested from the
+// provider of each retrieval, so no content routing is needed, and nothing is
+// served from the blockstore
+func initBitswap(h host.Host) (bsnet.BitSwapNetwork, *bitswapRouter) {
+	bitswapNetwork := bsnet.NewFromIpfsHost(h, routinghelpers.Null{})
+	bitswapRouter := newBitswapRouter()
+	bitswapNetwork.Start(bitswapRouter)
+
+	return bitswapNetwork, bitswapRouter
 }
@@ -0,0 +1,231 @@
+package filclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime/codec/dagcbor"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multihash"
+	"github.com/polydawn/refmt/cbor"
+)
+
+// indexer.go - discovery of providers for content through an IPNI indexer
+
+const DefaultIndexerURL = "https://cid.contact"
+
+var (
+	ErrIndexerRequestFailed = errors.New("indexer request failed")
+)
+
+// Multicodec codes of the transports in indexer metadata
+const (
+	indexerMetadataBitswap             = 0x0900
+	indexerMetadataGraphsyncFilecoinV1 = 0x0910
+	indexerMetadataHTTP                = 0x0920
+)
+
+// A transport the indexer says a provider serves the content over
+type IndexerTransport struct {
+	Transport RetrievalTransport
+
+	// Only set for graphsync
+	PieceCID      cid.Cid
+	VerifiedDeal  bool
+	FastRetrieval bool
+}
+
+// A provider the indexer knows to have the content
+type IndexerProvider struct {
+	// Handle for retrieving from the provider, which connects using the
+	// multiaddrs from the indexer
+	Handle *StorageProviderHandle
+
+	AddrInfo   peer.AddrInfo
+	Transports []IndexerTransport
+}
+
+// Wire format of the indexer's find response
+type indexerFindResponse struct {
+	MultihashResults []struct {
+		Multihash       multihash.Multihash
+		ProviderResults []struct {
+			ContextID []byte
+			Metadata  []byte
+			Provider  peer.AddrInfo
+		}
+	}
+}
+
+// Asks the indexer which providers have the CID
+func (client *Client) FindProviders(ctx context.Context, c cid.Cid) ([]IndexerProvider, error) {
+	return client.findProviders(ctx, "cid", c.String())
+}
+
+// Asks the indexer which providers have the multihash
+func (client *Client) FindProvidersByMultihash(ctx context.Context, mh multihash.Multihash) ([]IndexerProvider, error) {
+	return client.findProviders(ctx, "multihash", mh.B58String())
+}
+
+func (client *Client) findProviders(ctx context.Context, endpoint string, key string) ([]IndexerProvider, error) {
+	reqURL, err := url.Parse(client.indexerURL)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrIndexerRequestFailed, err)
+	}
+	reqURL.Path = path.Join(reqURL.Path, endpoint, key)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqURL.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrIndexerRequestFailed, err)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrIndexerRequestFailed, err)
+	}
+	defer resp.Body.Close()
+
+	// The indexer responds with not found if there are no providers
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: %s", ErrIndexerRequestFailed, resp.Status)
+	}
+
+	var findResp indexerFindResponse
+	if err := json.NewDecoder(resp.Body).Decode(&findResp); err != nil {
+		return nil, fmt.Errorf("%w: could not decode response: %v", ErrIndexerRequestFailed, err)
+	}
+
+	// Providers can have several records for the same content (e.g. in more
+	// than one deal), so merge them
+	var providers []IndexerProvider
+	indices := make(map[peer.ID]int)
+	for _, mhResult := range findResp.MultihashResults {
+		for _, result := range mhResult.ProviderResults {
+			transports, err := decodeIndexerMetadata(result.Metadata)
+			if err != nil {
+				log.Debugf("Ignoring provider %s record with invalid metadata: %v", result.Provider.ID, err)
+				continue
+			}
+
+			i, ok := indices[result.Provider.ID]
+			if !ok {
+				i = len(providers)
+				indices[result.Provider.ID] = i
+				providers = append(providers, IndexerProvider{
+					Handle:   client.StorageProviderByAddrInfo(result.Provider),
+					AddrInfo: result.Provider,
+				})
+			}
+
+			providers[i].Transports = append(providers[i].Transports, transports...)
+		}
+	}
+
+	return providers, nil
+}
+
+// Decodes the transports listed in a provider record's metadata - each entry
+// is a varint transport code, followed by a DAG-CBOR payload for graphsync
+func decodeIndexerMetadata(data []byte) ([]IndexerTransport, error) {
+	reader := bytes.NewReader(data)
+
+	var transports []IndexerTransport
+	for reader.Len() > 0 {
+		code, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return nil, err
+		}
+
+		switch code {
+		case indexerMetadataBitswap:
+			transports = append(transports, IndexerTransport{Transport: RetrievalTransportBitswap})
+		case indexerMetadataHTTP:
+			transports = append(transports, IndexerTransport{Transport: RetrievalTransportHTTP})
+		case indexerMetadataGraphsyncFilecoinV1:
+			transport, err := decodeIndexerGraphsyncMetadata(reader)
+			if err != nil {
+				return nil, fmt.Errorf("invalid graphsync metadata: %v", err)
+			}
+			transports = append(transports, transport)
+		default:
+			// The length of an unknown entry can't be known, so nothing after
+			// it can be read either
+			log.Debugf("Ignoring unknown indexer metadata transport 0x%x", code)
+			return transports, nil
+		}
+	}
+
+	return transports, nil
+}
+
+// Reads exactly one DAG-CBOR object, leaving the reader at the next metadata
+// entry
+func decodeIndexerGraphsyncMetadata(reader io.Reader) (IndexerTransport, error) {
+	builder := basicnode.Prototype.Map.NewBuilder()
+	if err := dagcbor.Unmarshal(
+		builder,
+		cbor.NewDecoder(cbor.DecodeOptions{}, reader),
+		dagcbor.DecodeOptions{AllowLinks: true},
+	); err != nil {
+		return IndexerTransport{}, err
+	}
+	node := builder.Build()
+
+	transport := IndexerTransport{Transport: RetrievalTransportGraphsync}
+
+	pieceCidNode, err := node.LookupByString("PieceCID")
+	if err != nil {
+		return IndexerTransport{}, err
+	}
+	pieceCidLink, err := pieceCidNode.AsLink()
+	if err != nil {
+		return IndexerTransport{}, err
+	}
+	link, ok := pieceCidLink.(cidlink.Link)
+	if !ok {
+		return IndexerTransport{}, fmt.Errorf("unsupported piece CID link type %T", pieceCidLink)
+	}
+	transport.PieceCID = link.Cid
+
+	// The flags are optional
+	if verifiedDeal, err := node.LookupByString("VerifiedDeal"); err == nil {
+		transport.VerifiedDeal, _ = verifiedDeal.AsBool()
+	}
+	if fastRetrieval, err := node.LookupByString("FastRetrieval"); err == nil {
+		transport.FastRetrieval, _ = fastRetrieval.AsBool()
+	}
+
+	return transport, nil
+}
+
+// The first HTTP endpoint among the provider's multiaddrs, for use with
+// StartHTTPRetrievalTransfer
+func (provider *IndexerProvider) HTTPEndpoint() (string, error) {
+	return httpEndpointFromMultiaddrs(provider.AddrInfo.Addrs)
+}
+
+// Whether the indexer listed the transport for the provider
+func (provider *IndexerProvider) SupportsTransport(transport RetrievalTransport) bool {
+	for _, other := range provider.Transports {
+		if other.Transport == transport {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,124 @@
+package filclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-merkledag"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/codec/dagcbor"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/fluent/qp"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/test"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFindProviders(t *testing.T) {
+	ctx := context.Background()
+
+	payloadCid := merkledag.NewRawNode([]byte("payload")).Cid()
+	pieceCid := merkledag.NewRawNode([]byte("piece")).Cid()
+
+	boost := peer.AddrInfo{
+		ID:    test.RandPeerIDFatal(t),
+		Addrs: []multiaddr.Multiaddr{multiaddr.StringCast("/ip4/1.2.3.4/tcp/1234")},
+	}
+	boostHTTP := peer.AddrInfo{
+		ID:    test.RandPeerIDFatal(t),
+		Addrs: []multiaddr.Multiaddr{multiaddr.StringCast("/dns/boost.example/tcp/443/https")},
+	}
+
+	graphsyncMetadata := testIndexerMetadata(indexerMetadataBitswap)
+	graphsyncMetadata = append(graphsyncMetadata, testIndexerGraphsyncMetadata(t, pieceCid)...)
+
+	type providerResult struct {
+		ContextID []byte
+		Metadata  []byte
+		Provider  peer.AddrInfo
+	}
+	resp := map[string]interface{}{
+		"MultihashResults": []map[string]interface{}{{
+			"Multihash": []byte(payloadCid.Hash()),
+			"ProviderResults": []providerResult{
+				{ContextID: []byte("a"), Metadata: graphsyncMetadata, Provider: boost},
+				{ContextID: []byte("b"), Metadata: testIndexerMetadata(indexerMetadataHTTP), Provider: boostHTTP},
+				// A second record from the same provider gets merged
+				{ContextID: []byte("c"), Metadata: testIndexerMetadata(indexerMetadataHTTP), Provider: boost},
+				// Invalid metadata gets skipped
+				{ContextID: []byte("d"), Metadata: testIndexerMetadata(indexerMetadataGraphsyncFilecoinV1), Provider: boost},
+			},
+		}},
+	}
+
+	mux := http.NewServeMux()
+	// A failed write shows up as FindProviders failing below
+	serve := func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(resp)
+	}
+	mux.HandleFunc("/cid/"+payloadCid.String(), serve)
+	mux.HandleFunc("/multihash/"+payloadCid.Hash().B58String(), serve)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	fc := initStandaloneClient(t, ctx, initDatastore(t), WithIndexerURL(server.URL))
+
+	providers, err := fc.FindProviders(ctx, payloadCid)
+	require.NoError(t, err)
+	require.Len(t, providers, 2)
+
+	require.Equal(t, boost.ID, providers[0].AddrInfo.ID)
+	require.Equal(t, []IndexerTransport{
+		{Transport: RetrievalTransportBitswap},
+		{Transport: RetrievalTransportGraphsync, PieceCID: pieceCid, VerifiedDeal: true},
+		{Transport: RetrievalTransportHTTP},
+	}, providers[0].Transports)
+
+	peerID, err := providers[0].Handle.PeerID(ctx)
+	require.NoError(t, err)
+	require.Equal(t, boost.ID, peerID)
+
+	require.Equal(t, boostHTTP.ID, providers[1].AddrInfo.ID)
+	require.True(t, providers[1].SupportsTransport(RetrievalTransportHTTP))
+	endpoint, err := providers[1].HTTPEndpoint()
+	require.NoError(t, err)
+	require.Equal(t, "https://boost.example:443", endpoint)
+
+	providers, err = fc.FindProvidersByMultihash(ctx, payloadCid.Hash())
+	require.NoError(t, err)
+	require.Len(t, providers, 2)
+
+	// Unknown content is reported as not found
+	providers, err = fc.FindProviders(ctx, pieceCid)
+	require.NoError(t, err)
+	require.Empty(t, providers)
+}
+
+func testIndexerMetadata(code uint64) []byte {
+	buf := make([]byte, binary.MaxVarintLen64)
+	return buf[:binary.PutUvarint(buf, code)]
+}
+
+func testIndexerGraphsyncMetadata(t *testing.T, pieceCid cid.Cid) []byte {
+	node, err := qp.BuildMap(basicnode.Prototype.Any, 3, func(ma datamodel.MapAssembler) {
+		qp.MapEntry(ma, "PieceCID", qp.Link(cidlink.Link{Cid: pieceCid}))
+		qp.MapEntry(ma, "VerifiedDeal", qp.Bool(true))
+		qp.MapEntry(ma, "FastRetrieval", qp.Bool(false))
+	})
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	buf.Write(testIndexerMetadata(indexerMetadataGraphsyncFilecoinV1))
+	require.NoError(t, ipld.EncodeStreaming(&buf, node, dagcbor.Encode))
+
+	return buf.Bytes()
+}
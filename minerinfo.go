@@ -0,0 +1,174 @@
+package filclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/ipfs/go-datastore"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// minerinfo.go - caching of on-chain miner info, shared by all storage
+// provider handles
+
+// How long miner info is used for before it's looked up again, if not
+// configured
+const DefaultMinerInfoTTL = time.Hour
+
+var minerInfoKey = datastore.NewKey("/StorageProviders/MinerInfo")
+
+// The parts of a miner's on-chain info that filclient uses
+type MinerInfo struct {
+	// Nil if the miner has no peer ID set on chain
+	PeerID *peer.ID
+
+	// Raw multiaddr bytes as they are on chain - some may not parse
+	Multiaddrs []abi.Multiaddrs
+
+	Owner      address.Address
+	Worker     address.Address
+	SectorSize abi.SectorSize
+
+	// When the info was looked up on chain
+	FetchedAt time.Time
+}
+
+// In-memory miner info, backed by the datastore if persistence is enabled
+type minerInfoCache struct {
+	lk    sync.Mutex
+	infos map[address.Address]MinerInfo
+
+	// Negative disables caching
+	ttl     time.Duration
+	persist bool
+}
+
+func newMinerInfoCache(ttl time.Duration, persist bool) *minerInfoCache {
+	if ttl == 0 {
+		ttl = DefaultMinerInfoTTL
+	}
+
+	return &minerInfoCache{
+		infos:   make(map[address.Address]MinerInfo),
+		ttl:     ttl,
+		persist: persist,
+	}
+}
+
+func minerInfoCacheKey(addr address.Address) datastore.Key {
+	return minerInfoKey.ChildString(addr.String())
+}
+
+// Returns the miner's info, looking it up on chain if it isn't cached or the
+// cached info is older than the TTL (see Config.MinerInfoTTL)
+func (client *Client) MinerInfo(ctx context.Context, addr address.Address) (MinerInfo, error) {
+	cache := client.minerInfoCache
+
+	if info, ok := client.cachedMinerInfo(ctx, addr); ok {
+		return info, nil
+	}
+
+	if client.api == nil {
+		return MinerInfo{}, fmt.Errorf("%w: no chain connection to look up miner info with", ErrLotusError)
+	}
+
+	chainInfo, err := client.api.StateMinerInfo(ctx, addr, types.EmptyTSK)
+	if err != nil {
+		return MinerInfo{}, fmt.Errorf("%w: %v", ErrLotusError, err)
+	}
+
+	info := MinerInfo{
+		PeerID:     chainInfo.PeerId,
+		Multiaddrs: chainInfo.Multiaddrs,
+		Owner:      chainInfo.Owner,
+		Worker:     chainInfo.Worker,
+		SectorSize: chainInfo.SectorSize,
+		FetchedAt:  time.Now(),
+	}
+
+	if cache.ttl < 0 {
+		return info, nil
+	}
+
+	cache.lk.Lock()
+	cache.infos[addr] = info
+	cache.lk.Unlock()
+
+	if cache.persist {
+		data, err := json.Marshal(info)
+		if err != nil {
+			return MinerInfo{}, err
+		}
+
+		if err := client.ds.Put(ctx, minerInfoCacheKey(addr), data); err != nil {
+			log.Errorf("Failed to persist miner info of %s: %v", addr, err)
+		}
+	}
+
+	return info, nil
+}
+
+// Drops any cached info of the miner, so that the next use looks it up on
+// chain again
+func (client *Client) InvalidateMinerInfo(ctx context.Context, addr address.Address) error {
+	cache := client.minerInfoCache
+
+	cache.lk.Lock()
+	delete(cache.infos, addr)
+	cache.lk.Unlock()
+
+	if cache.persist {
+		return client.ds.Delete(ctx, minerInfoCacheKey(addr))
+	}
+
+	return nil
+}
+
+// Checks memory first, then the datastore if persistence is enabled
+func (client *Client) cachedMinerInfo(ctx context.Context, addr address.Address) (MinerInfo, bool) {
+	cache := client.minerInfoCache
+
+	if cache.ttl < 0 {
+		return MinerInfo{}, false
+	}
+
+	cache.lk.Lock()
+	info, ok := cache.infos[addr]
+	cache.lk.Unlock()
+
+	if !ok {
+		if !cache.persist {
+			return MinerInfo{}, false
+		}
+
+		data, err := client.ds.Get(ctx, minerInfoCacheKey(addr))
+		if err != nil {
+			if !errors.Is(err, datastore.ErrNotFound) {
+				log.Errorf("Failed to read persisted miner info of %s: %v", addr, err)
+			}
+			return MinerInfo{}, false
+		}
+
+		if err := json.Unmarshal(data, &info); err != nil {
+			log.Errorf("Skipping unreadable persisted miner info of %s: %v", addr, err)
+			return MinerInfo{}, false
+		}
+
+		cache.lk.Lock()
+		cache.infos[addr] = info
+		cache.lk.Unlock()
+	}
+
+	if time.Since(info.FetchedAt) > cache.ttl {
+		return MinerInfo{}, false
+	}
+
+	return info, true
+}
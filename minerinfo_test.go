@@ -0,0 +1,100 @@
+package filclient
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMinerInfoCache(t *testing.T) {
+	ctx := context.Background()
+
+	peerID := test.RandPeerIDFatal(t)
+	addr, err := address.NewIDAddress(1000)
+	require.NoError(t, err)
+
+	gateway := &testMinerGateway{miners: map[address.Address]peer.ID{addr: peerID}}
+
+	t.Run("shared across handles", func(t *testing.T) {
+		gateway.infoLookups = 0
+
+		fc := initStandaloneClient(t, ctx, initDatastore(t))
+		fc.api = gateway
+
+		for i := 0; i < 3; i++ {
+			found, err := fc.StorageProviderByAddress(addr).PeerID(ctx)
+			require.NoError(t, err)
+			require.Equal(t, peerID, found)
+		}
+		require.Equal(t, 1, gateway.infoLookups)
+
+		require.NoError(t, fc.InvalidateMinerInfo(ctx, addr))
+		_, err := fc.StorageProviderByAddress(addr).PeerID(ctx)
+		require.NoError(t, err)
+		require.Equal(t, 2, gateway.infoLookups)
+	})
+
+	t.Run("expires", func(t *testing.T) {
+		gateway.infoLookups = 0
+
+		fc := initStandaloneClient(t, ctx, initDatastore(t), WithMinerInfoTTL(50*time.Millisecond))
+		fc.api = gateway
+
+		_, err := fc.MinerInfo(ctx, addr)
+		require.NoError(t, err)
+		_, err = fc.MinerInfo(ctx, addr)
+		require.NoError(t, err)
+		require.Equal(t, 1, gateway.infoLookups)
+
+		time.Sleep(100 * time.Millisecond)
+		_, err = fc.MinerInfo(ctx, addr)
+		require.NoError(t, err)
+		require.Equal(t, 2, gateway.infoLookups)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		gateway.infoLookups = 0
+
+		fc := initStandaloneClient(t, ctx, initDatastore(t), WithMinerInfoTTL(-1))
+		fc.api = gateway
+
+		_, err := fc.MinerInfo(ctx, addr)
+		require.NoError(t, err)
+		_, err = fc.MinerInfo(ctx, addr)
+		require.NoError(t, err)
+		require.Equal(t, 2, gateway.infoLookups)
+	})
+
+	t.Run("persisted", func(t *testing.T) {
+		gateway.infoLookups = 0
+
+		ds := initDatastore(t)
+
+		fc := initStandaloneClient(t, ctx, ds, WithPersistentMinerInfo())
+		fc.api = gateway
+		_, err := fc.MinerInfo(ctx, addr)
+		require.NoError(t, err)
+		fc.Close()
+
+		// A new client on the same datastore picks up where the last left off
+		fc = initStandaloneClient(t, ctx, ds, WithPersistentMinerInfo())
+		fc.api = gateway
+		info, err := fc.MinerInfo(ctx, addr)
+		require.NoError(t, err)
+		require.Equal(t, peerID, *info.PeerID)
+		require.Equal(t, 1, gateway.infoLookups)
+
+		require.NoError(t, fc.InvalidateMinerInfo(ctx, addr))
+
+		fc = initStandaloneClient(t, ctx, ds, WithPersistentMinerInfo())
+		fc.api = gateway
+		_, err = fc.MinerInfo(ctx, addr)
+		require.NoError(t, err)
+		require.Equal(t, 2, gateway.infoLookups)
+	})
+}
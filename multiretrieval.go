@@ -0,0 +1,296 @@
+package filclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/ipfs/go-cid"
+)
+
+// multiretrieval.go - retrieval of a payload from whichever of a set of
+// candidate storage providers can serve it best
+
+var (
+	ErrNoRetrievalCandidates        = errors.New("no retrieval candidates")
+	ErrAllRetrievalCandidatesFailed = errors.New("all retrieval candidates failed")
+)
+
+type RetrievalCandidateOutcome uint
+
+const (
+	// The candidate was never attempted because an earlier candidate served
+	// the data
+	RetrievalCandidateNotAttempted RetrievalCandidateOutcome = iota
+
+	// The retrieval query to the candidate failed
+	RetrievalCandidateQueryFailed
+
+	// The candidate responded to the query but does not have the data
+	RetrievalCandidateUnavailable
+
+	// The candidate rejected the transfer or the transfer failed partway
+	RetrievalCandidateFailed
+
+	// The candidate stopped sending data for longer than the stall timeout
+	RetrievalCandidateStalled
+
+	// The candidate served the data
+	RetrievalCandidateServed
+
+	// The client's provider policy doesn't allow the candidate
+	RetrievalCandidateBlocked
+)
+
+func (outcome RetrievalCandidateOutcome) String() string {
+	switch outcome {
+	case RetrievalCandidateNotAttempted:
+		return "not attempted"
+	case RetrievalCandidateQueryFailed:
+		return "query failed"
+	case RetrievalCandidateUnavailable:
+		return "unavailable"
+	case RetrievalCandidateFailed:
+		return "failed"
+	case RetrievalCandidateStalled:
+		return "stalled"
+	case RetrievalCandidateServed:
+		return "served"
+	case RetrievalCandidateBlocked:
+		return "blocked"
+	default:
+		return "unknown"
+	}
+}
+
+// What happened with an individual candidate during a multi-provider retrieval
+type RetrievalCandidateResult struct {
+	Provider *StorageProviderHandle
+
+	// The retrieval ask, valid unless the query failed
+	Ask retrievalmarket.QueryResponse
+
+	// How long the retrieval query took to respond
+	QueryLatency time.Duration
+
+	Outcome RetrievalCandidateOutcome
+
+	// The reason the candidate was skipped, nil if it served the data or was
+	// never attempted
+	Err error
+}
+
+type RetrievalResult struct {
+	// The transfer that served the data, nil if no candidate succeeded
+	Transfer *RetrievalTransfer
+
+	// The provider that served the data, nil if no candidate succeeded
+	Provider *StorageProviderHandle
+
+	// Every candidate in ranked order, available candidates first
+	Candidates []RetrievalCandidateResult
+}
+
+// Queries all candidates in parallel, then retrieves the payload from the best
+// available one (cheapest, then lowest query latency), falling back to the next
+// candidate on rejection, error or stall
+//
+// Blocks until the retrieval finishes - the result is returned even on error,
+// describing why each candidate was skipped
+func (client *Client) Retrieve(
+	ctx context.Context,
+	payloadCid cid.Cid,
+	candidates []*StorageProviderHandle,
+	options ...RetrievalOption,
+) (*RetrievalResult, error) {
+	if len(candidates) == 0 {
+		return nil, ErrNoRetrievalCandidates
+	}
+
+	var cfg RetrievalConfig
+	for _, option := range options {
+		option(&cfg)
+	}
+	cfg.Clean()
+
+	options = append(options, client.retrieveTimeoutOptions(cfg)...)
+
+	// Every attempt writes to the same CAR, so it gets a single header and
+	// each block once, however many candidates are tried - the blocks a
+	// failed candidate stored are only reused if they're persisted, since
+	// with RetrievalWithoutPersisting each attempt fetches everything again
+	if cfg.carWriter != nil {
+		output := newRetrievalCAROutput(cfg.carWriter, payloadCid)
+		options = append(options, func(cfg *RetrievalConfig) {
+			cfg.carOutput = output
+		})
+	}
+
+	// Query all candidates at once
+
+	results := make([]RetrievalCandidateResult, len(candidates))
+	var wg sync.WaitGroup
+	for i, candidate := range candidates {
+		wg.Add(1)
+		go func(i int, candidate *StorageProviderHandle) {
+			defer wg.Done()
+
+			start := time.Now()
+			ask, err := candidate.QueryRetrievalAsk(ctx, payloadCid, options...)
+			results[i] = RetrievalCandidateResult{
+				Provider:     candidate,
+				Ask:          ask,
+				QueryLatency: time.Since(start),
+			}
+
+			switch {
+			case errors.Is(err, ErrProviderBlocked):
+				results[i].Outcome = RetrievalCandidateBlocked
+				results[i].Err = err
+			case err != nil:
+				results[i].Outcome = RetrievalCandidateQueryFailed
+				results[i].Err = err
+			case ask.Status != retrievalmarket.QueryResponseAvailable:
+				results[i].Outcome = RetrievalCandidateUnavailable
+				results[i].Err = fmt.Errorf("query response status %d: %s", ask.Status, ask.Message)
+			case cfg.pieceCid != nil && ask.PieceCIDFound != retrievalmarket.QueryItemAvailable:
+				results[i].Outcome = RetrievalCandidateUnavailable
+				results[i].Err = fmt.Errorf("piece %s not found", *cfg.pieceCid)
+			}
+		}(i, candidate)
+	}
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		return &RetrievalResult{Candidates: results}, ctx.Err()
+	}
+
+	rankRetrievalCandidates(results)
+
+	// Try the available candidates in order until one succeeds
+
+	for i := range results {
+		candidate := &results[i]
+		if candidate.Outcome != RetrievalCandidateNotAttempted {
+			continue
+		}
+
+		log.Infof(
+			"Attempting retrieval of %s from candidate %d (price %s, latency %s)",
+			payloadCid,
+			i,
+			candidate.Ask.PieceRetrievalPrice(),
+			candidate.QueryLatency,
+		)
+
+		transfer, outcome, err := client.attemptRetrievalCandidate(
+			ctx,
+			candidate.Provider,
+			payloadCid,
+			candidate.Ask,
+			options,
+		)
+		candidate.Outcome = outcome
+		candidate.Err = err
+
+		if outcome == RetrievalCandidateServed {
+			return &RetrievalResult{
+				Transfer:   transfer,
+				Provider:   candidate.Provider,
+				Candidates: results,
+			}, nil
+		}
+
+		log.Warnf("Retrieval candidate %d %s: %v", i, outcome, err)
+
+		if ctx.Err() != nil {
+			return &RetrievalResult{Candidates: results}, ctx.Err()
+		}
+	}
+
+	return &RetrievalResult{Candidates: results}, ErrAllRetrievalCandidatesFailed
+}
+
+// Runs a retrieval transfer against a single candidate and waits for it to
+// finish
+func (client *Client) attemptRetrievalCandidate(
+	ctx context.Context,
+	handle *StorageProviderHandle,
+	payloadCid cid.Cid,
+	ask retrievalmarket.QueryResponse,
+	options []RetrievalOption,
+) (*RetrievalTransfer, RetrievalCandidateOutcome, error) {
+	options = append(append([]RetrievalOption{}, options...), RetrievalWithAsk(ask))
+
+	transfer, err := handle.StartRetrievalTransfer(ctx, payloadCid, options...)
+	if err != nil {
+		return nil, RetrievalCandidateFailed, err
+	}
+
+	select {
+	case <-transfer.Done():
+	case <-ctx.Done():
+		if err := transfer.Cancel(context.Background()); err != nil {
+			log.Errorf("Failed to cancel retrieval transfer: %v", err)
+		}
+		return transfer, RetrievalCandidateFailed, ctx.Err()
+	}
+
+	if err := transfer.Err(); err != nil {
+		if errors.Is(err, ErrRetrievalStalled) {
+			return transfer, RetrievalCandidateStalled, err
+		}
+		return transfer, RetrievalCandidateFailed, err
+	}
+
+	return transfer, RetrievalCandidateServed, nil
+}
+
+// Stalled candidates must be detected so the next one can be tried, unless
+// stall detection is disabled (see Config.RetrievalStallTimeout) - that
+// includes candidates that never send anything, so the stall timeout also
+// limits how long the first byte may take unless the retrieval sets its own
+func (client *Client) retrieveTimeoutOptions(cfg RetrievalConfig) []RetrievalOption {
+	if client.retrievalStallTimeout <= 0 {
+		return nil
+	}
+
+	var options []RetrievalOption
+	if cfg.timeouts.stall == 0 {
+		options = append(options, RetrievalWithStallTimeout(client.retrievalStallTimeout))
+	}
+	if cfg.timeouts.firstByte == 0 {
+		options = append(options, RetrievalWithFirstByteTimeout(client.retrievalStallTimeout))
+	}
+
+	return options
+}
+
+// Sorts candidates so that the ones that can be attempted come first, cheapest
+// first, then lowest query latency first
+func rankRetrievalCandidates(results []RetrievalCandidateResult) {
+	sort.SliceStable(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+
+		aAvailable := a.Outcome == RetrievalCandidateNotAttempted
+		bAvailable := b.Outcome == RetrievalCandidateNotAttempted
+		if aAvailable != bAvailable {
+			return aAvailable
+		}
+
+		if !aAvailable {
+			return false
+		}
+
+		if cmp := big.Cmp(a.Ask.PieceRetrievalPrice(), b.Ask.PieceRetrievalPrice()); cmp != 0 {
+			return cmp < 0
+		}
+
+		return a.QueryLatency < b.QueryLatency
+	})
+}
@@ -0,0 +1,75 @@
+package filclient
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetrieveMultipleCandidates(t *testing.T) {
+	ctx := context.TODO()
+	client, miner, _, fc, closer := initEnsemble(t, ctx)
+	defer closer()
+
+	importRes := genDummyDeal(ctx, t, client, miner)
+
+	// A provider that doesn't exist on chain should fail its query and be
+	// skipped in favor of the real one
+	bogusAddr, err := address.NewIDAddress(999999)
+	require.NoError(t, err)
+
+	res, err := fc.Retrieve(ctx, importRes.Root, []*StorageProviderHandle{
+		fc.StorageProviderByAddress(bogusAddr),
+		fc.StorageProviderByAddress(miner.ActorAddr),
+	})
+	require.NoError(t, err)
+
+	providerAddr, err := res.Provider.Address(ctx)
+	require.NoError(t, err)
+	require.Equal(t, miner.ActorAddr, providerAddr)
+	require.Equal(t, RetrievalTransferStatusCompleted, res.Transfer.State())
+
+	for _, candidate := range res.Candidates {
+		fmt.Printf("Candidate %s: %v\n", candidate.Outcome, candidate.Err)
+	}
+	require.Equal(t, RetrievalCandidateServed, res.Candidates[0].Outcome)
+	require.Equal(t, RetrievalCandidateQueryFailed, res.Candidates[1].Outcome)
+}
+
+func TestRankRetrievalCandidates(t *testing.T) {
+	available := func(price int64, latency time.Duration) RetrievalCandidateResult {
+		return RetrievalCandidateResult{
+			Ask: retrievalmarket.QueryResponse{
+				Status:          retrievalmarket.QueryResponseAvailable,
+				Size:            1,
+				MinPricePerByte: abi.NewTokenAmount(price),
+				UnsealPrice:     abi.NewTokenAmount(0),
+			},
+			QueryLatency: latency,
+		}
+	}
+
+	unavailable := RetrievalCandidateResult{Outcome: RetrievalCandidateUnavailable}
+
+	results := []RetrievalCandidateResult{
+		unavailable,
+		available(10, time.Millisecond),
+		available(5, time.Second),
+		available(5, time.Millisecond),
+	}
+
+	rankRetrievalCandidates(results)
+
+	require.Equal(t, int64(5), results[0].Ask.MinPricePerByte.Int64())
+	require.Equal(t, time.Millisecond, results[0].QueryLatency)
+	require.Equal(t, int64(5), results[1].Ask.MinPricePerByte.Int64())
+	require.Equal(t, time.Second, results[1].QueryLatency)
+	require.Equal(t, int64(10), results[2].Ask.MinPricePerByte.Int64())
+	require.Equal(t, RetrievalCandidateUnavailable, results[3].Outcome)
+}
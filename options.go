@@ -1,5 +1,13 @@
 package filclient
 
+import (
+	"time"
+
+	"github.com/filecoin-project/go-data-transfer/channelmonitor"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/libp2p/go-libp2p/core/routing"
+)
+
 type Option func(*Config)
 
 // Replaces the entire config - if used, should always be the first option
@@ -8,3 +16,159 @@ func WithConfig(cfg Config) Option {
 		*oldCfg = cfg
 	}
 }
+
+// Sets the IPNI indexer used to find providers for content
+func WithIndexerURL(url string) Option {
+	return func(cfg *Config) {
+		cfg.IndexerURL = url
+	}
+}
+
+// Limits how long connecting to a storage provider may take - negative means
+// no limit beyond the context's
+func WithConnectTimeout(timeout time.Duration) Option {
+	return func(cfg *Config) {
+		cfg.ConnectTimeout = timeout
+	}
+}
+
+// Limits how long a single request/response exchange with a storage provider
+// may take - negative means no limit beyond the context's
+func WithRPCTimeout(timeout time.Duration) Option {
+	return func(cfg *Config) {
+		cfg.RPCTimeout = timeout
+	}
+}
+
+// Sets how long a candidate in Client.Retrieve may go without sending data
+// before the next one is tried - negative disables stall detection
+func WithRetrievalStallTimeout(timeout time.Duration) Option {
+	return func(cfg *Config) {
+		cfg.RetrievalStallTimeout = timeout
+	}
+}
+
+// Sets how many of each provider's most recent retrieval attempts are kept in
+// the history - negative keeps every attempt
+func WithRetrievalHistoryLimit(limit int) Option {
+	return func(cfg *Config) {
+		cfg.RetrievalHistoryLimit = limit
+	}
+}
+
+// Limits how many retrievals may run at once - the rest are queued
+func WithMaxConcurrentRetrievals(max int) Option {
+	return func(cfg *Config) {
+		cfg.MaxConcurrentRetrievals = max
+	}
+}
+
+// Limits how many retrievals may run at once from any one provider - the rest
+// are queued
+func WithMaxConcurrentRetrievalsPerProvider(max int) Option {
+	return func(cfg *Config) {
+		cfg.MaxConcurrentRetrievalsPerProvider = max
+	}
+}
+
+// Sets the peer routing used to find providers' multiaddrs when the ones on
+// chain are missing or don't work
+func WithPeerRouting(peerRouting routing.PeerRouting) Option {
+	return func(cfg *Config) {
+		cfg.PeerRouting = peerRouting
+	}
+}
+
+// Sets how long on-chain miner info is cached for - negative disables caching
+func WithMinerInfoTTL(ttl time.Duration) Option {
+	return func(cfg *Config) {
+		cfg.MinerInfoTTL = ttl
+	}
+}
+
+// Keeps cached miner info in the datastore, so that it survives restarts
+func WithPersistentMinerInfo() Option {
+	return func(cfg *Config) {
+		cfg.PersistMinerInfo = true
+	}
+}
+
+// Sets the providers to always allow or deny
+func WithProviderPolicy(policy ProviderPolicyConfig) Option {
+	return func(cfg *Config) {
+		cfg.ProviderPolicy = policy
+	}
+}
+
+// Sets how many miners are looked up at once while indexing peer IDs
+func WithStorageProviderIndexWorkers(workers int) Option {
+	return func(cfg *Config) {
+		cfg.StorageProviderIndexWorkers = workers
+	}
+}
+
+// Limits how many graphsync requests may be in progress at once
+func WithGraphsyncMaxInProgressOutgoingRequests(max uint64) Option {
+	return func(cfg *Config) {
+		cfg.GraphsyncMaxInProgressOutgoingRequests = max
+	}
+}
+
+// Limits how many blocks a single graphsync request may receive
+func WithGraphsyncMaxLinksPerOutgoingRequest(max uint64) Option {
+	return func(cfg *Config) {
+		cfg.GraphsyncMaxLinksPerOutgoingRequest = max
+	}
+}
+
+// Sets how many times graphsync retries sending a message
+func WithGraphsyncMessageSendRetries(retries int) Option {
+	return func(cfg *Config) {
+		cfg.GraphsyncMessageSendRetries = retries
+	}
+}
+
+// Sets how long graphsync waits for a message to send
+func WithGraphsyncSendMessageTimeout(timeout time.Duration) Option {
+	return func(cfg *Config) {
+		cfg.GraphsyncSendMessageTimeout = timeout
+	}
+}
+
+// Restarts stalled or disconnected data transfer channels according to the
+// config
+func WithDataTransferRestartConfig(restartConfig channelmonitor.Config) Option {
+	return func(cfg *Config) {
+		cfg.DataTransferRestartConfig = &restartConfig
+	}
+}
+
+// Sets the wallet holding the key of the client's address
+func WithWallet(wallet api.Wallet) Option {
+	return func(cfg *Config) {
+		cfg.Wallet = wallet
+	}
+}
+
+// Sets the level of the client's logger
+func WithLogLevel(level string) Option {
+	return func(cfg *Config) {
+		cfg.LogLevel = level
+	}
+}
+
+// Keeps everything the client stores under the key prefix, so that the
+// datastore can be shared
+func WithDatastoreNamespace(namespace string) Option {
+	return func(cfg *Config) {
+		cfg.DatastoreNamespace = namespace
+	}
+}
+
+// Keeps data transfer channel state under the key prefix, within the client's
+// datastore namespace
+func WithDataTransferDatastoreNamespace(namespace string) Option {
+	return func(cfg *Config) {
+		cfg.DataTransferDatastoreNamespace = namespace
+	}
+}
@@ -0,0 +1,215 @@
+package filclient
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-fil-markets/storagemarket"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/protocol/identify"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// providerinfo.go - collecting everything that can be found out about a
+// storage provider in one go
+
+// The parts of a ProviderInfo that are collected separately, and can fail
+// separately
+type ProviderInfoPart string
+
+const (
+	ProviderInfoPartAddress             ProviderInfoPart = "address"
+	ProviderInfoPartMinerInfo           ProviderInfoPart = "miner info"
+	ProviderInfoPartPower               ProviderInfoPart = "power"
+	ProviderInfoPartConnect             ProviderInfoPart = "connect"
+	ProviderInfoPartAgentVersion        ProviderInfoPart = "agent version"
+	ProviderInfoPartProtocols           ProviderInfoPart = "protocols"
+	ProviderInfoPartStorageAsk          ProviderInfoPart = "storage ask"
+	ProviderInfoPartRetrievalTransports ProviderInfoPart = "retrieval transports"
+)
+
+// What's known about a storage provider - each part is left empty if it
+// couldn't be collected, with the reason in Errors
+type ProviderInfo struct {
+	Address address.Address
+	PeerID  peer.ID
+
+	// On-chain miner info - nil if it couldn't be looked up
+	MinerInfo *MinerInfo
+
+	// The miner info's multiaddrs that parse
+	Multiaddrs []multiaddr.Multiaddr
+
+	// Nil if it couldn't be looked up
+	Power *ProviderPower
+
+	AgentVersion string
+	Protocols    []string
+
+	// Nil if it couldn't be queried
+	StorageAsk *storagemarket.StorageAsk
+
+	RetrievalTransports []RetrievalTransportInfo
+
+	// Why each part that's missing couldn't be collected
+	Errors map[ProviderInfoPart]error
+}
+
+type ProviderPower struct {
+	RawBytePower    abi.StoragePower
+	QualityAdjPower abi.StoragePower
+
+	// Whether the provider has enough power to be eligible for block rewards
+	HasMinPower bool
+}
+
+// Collects as much information about the provider as possible - parts that
+// don't depend on each other are collected concurrently, and failing parts
+// don't stop the others
+//
+// The peer ID and address are resolved first if not already known, and the
+// provider is only queried over the network if it can be connected to
+func (handle *StorageProviderHandle) Info(ctx context.Context) ProviderInfo {
+	info := ProviderInfo{Errors: make(map[ProviderInfoPart]error)}
+
+	var lk sync.Mutex
+	fail := func(part ProviderInfoPart, err error) {
+		lk.Lock()
+		defer lk.Unlock()
+		info.Errors[part] = err
+	}
+
+	// The handle isn't safe to resolve concurrently, so this is done up front
+	addr, err := handle.Address(ctx)
+	if err != nil {
+		fail(ProviderInfoPartAddress, err)
+	}
+	info.Address = addr
+
+	if addr != address.Undef {
+		minerInfo, err := handle.client.MinerInfo(ctx, addr)
+		if err != nil {
+			fail(ProviderInfoPartMinerInfo, err)
+		} else {
+			info.MinerInfo = &minerInfo
+			for _, addrBytes := range minerInfo.Multiaddrs {
+				maddr, err := multiaddr.NewMultiaddrBytes(addrBytes)
+				if err != nil {
+					continue
+				}
+				info.Multiaddrs = append(info.Multiaddrs, maddr)
+			}
+		}
+	}
+
+	var wg sync.WaitGroup
+	run := func(f func()) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f()
+		}()
+	}
+
+	if addr != address.Undef {
+		run(func() {
+			power, err := handle.client.api.StateMinerPower(ctx, addr, types.EmptyTSK)
+			if err != nil {
+				fail(ProviderInfoPartPower, fmt.Errorf("%w: %v", ErrLotusError, err))
+				return
+			}
+
+			lk.Lock()
+			defer lk.Unlock()
+			info.Power = &ProviderPower{
+				RawBytePower:    power.MinerPower.RawBytePower,
+				QualityAdjPower: power.MinerPower.QualityAdjPower,
+				HasMinPower:     power.HasMinPower,
+			}
+		})
+	}
+
+	peerID, err := handle.Connect(ctx)
+	if err != nil {
+		fail(ProviderInfoPartConnect, err)
+		info.PeerID = handle.peerID
+		wg.Wait()
+		return info
+	}
+	info.PeerID = peerID
+
+	run(func() {
+		// Agent version and protocols come from identify, which may still be
+		// running on a new connection
+		handle.client.waitIdentify(ctx, peerID)
+
+		version, err := handle.client.host.Peerstore().Get(peerID, "AgentVersion")
+		if err != nil {
+			fail(ProviderInfoPartAgentVersion, err)
+		} else {
+			lk.Lock()
+			info.AgentVersion, _ = version.(string)
+			lk.Unlock()
+		}
+
+		protocols, err := handle.client.host.Peerstore().GetProtocols(peerID)
+		if err != nil {
+			fail(ProviderInfoPartProtocols, err)
+		} else {
+			lk.Lock()
+			info.Protocols = protocols
+			lk.Unlock()
+		}
+	})
+
+	if addr != address.Undef {
+		run(func() {
+			ask, _, err := handle.QueryStorageAskUnchecked(ctx)
+			if err != nil {
+				fail(ProviderInfoPartStorageAsk, err)
+				return
+			}
+
+			lk.Lock()
+			defer lk.Unlock()
+			info.StorageAsk = &ask
+		})
+	}
+
+	run(func() {
+		transports, err := handle.QueryRetrievalTransports(ctx)
+		if err != nil {
+			fail(ProviderInfoPartRetrievalTransports, err)
+			return
+		}
+
+		lk.Lock()
+		defer lk.Unlock()
+		info.RetrievalTransports = transports
+	})
+
+	wg.Wait()
+
+	return info
+}
+
+// Waits for identify to finish on the connections to the peer, if the host
+// supports it
+func (client *Client) waitIdentify(ctx context.Context, peerID peer.ID) {
+	idHost, ok := client.host.(interface{ IDService() identify.IDService })
+	if !ok {
+		return
+	}
+
+	for _, conn := range client.host.Network().ConnsToPeer(peerID) {
+		select {
+		case <-idHost.IDService().IdentifyWait(conn):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package filclient
+
+import (
+	"context"
+	"testing"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStorageProviderInfo(t *testing.T) {
+	ctx := context.Background()
+
+	fc, provider := initTransportsTestClient(t, ctx, retrievalTransportsResponse{
+		Protocols: []retrievalTransportsProtocol{
+			{Name: "libp2p", Addresses: [][]byte{multiaddr.StringCast("/ip4/1.2.3.4/tcp/1234").Bytes()}},
+		},
+	})
+
+	addr, err := address.NewIDAddress(1000)
+	require.NoError(t, err)
+	fc.api = &testMinerGateway{miners: map[address.Address]peer.ID{addr: provider.ID()}}
+
+	info := fc.StorageProviderByAddress(addr).Info(ctx)
+
+	require.Equal(t, addr, info.Address)
+	require.Equal(t, provider.ID(), info.PeerID)
+	require.NotNil(t, info.MinerInfo)
+	require.Equal(t, provider.ID(), *info.MinerInfo.PeerID)
+	require.NotNil(t, info.Power)
+	require.True(t, info.Power.HasMinPower)
+	require.Contains(t, info.Protocols, retrievalTransportsProtocolID)
+	require.Len(t, info.RetrievalTransports, 1)
+	require.Equal(t, RetrievalTransportGraphsync, info.RetrievalTransports[0].Transport)
+
+	// The provider doesn't serve storage asks, but everything else still gets
+	// collected
+	require.Nil(t, info.StorageAsk)
+	require.Len(t, info.Errors, 1)
+	require.Error(t, info.Errors[ProviderInfoPartStorageAsk])
+
+	// Nothing but the chain parts can be collected without a connection
+	unknown, err := address.NewIDAddress(1001)
+	require.NoError(t, err)
+	info = fc.StorageProviderByAddress(unknown).Info(ctx)
+	require.Nil(t, info.Power)
+	require.Contains(t, info.Errors, ProviderInfoPartPower)
+	require.Contains(t, info.Errors, ProviderInfoPartConnect)
+	require.NotContains(t, info.Errors, ProviderInfoPartRetrievalTransports)
+}
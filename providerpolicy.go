@@ -0,0 +1,472 @@
+package filclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// providerpolicy.go - allowing and denying storage providers, by address or
+// peer ID
+
+var (
+	ErrProviderBlocked = errors.New("storage provider blocked by policy")
+
+	// Returned when removing a rule that was set in Config, which only a
+	// config change can remove
+	ErrProviderPolicyRuleFromConfig = errors.New("provider policy rule is set in config")
+	ErrProviderPolicyRuleNotFound   = errors.New("provider policy rule not found")
+)
+
+var providerPolicyKey = datastore.NewKey("/ProviderPolicy")
+
+type ProviderPolicyAction string
+
+const (
+	ProviderPolicyAllow ProviderPolicyAction = "allow"
+	ProviderPolicyDeny  ProviderPolicyAction = "deny"
+)
+
+// A storage provider in a policy rule, by either its address or its peer ID
+type ProviderPolicyTarget struct {
+	Address address.Address
+	PeerID  peer.ID
+}
+
+// Parses a storage provider address or peer ID
+func ParseProviderPolicyTarget(str string) (ProviderPolicyTarget, error) {
+	addr, err := address.NewFromString(str)
+	if err == nil {
+		return ProviderPolicyTarget{Address: addr}, nil
+	}
+
+	peerID, err2 := peer.Decode(str)
+	if err2 != nil {
+		return ProviderPolicyTarget{}, fmt.Errorf("could not parse provider as address (%v) or peer ID (%v)", err, err2)
+	}
+
+	return ProviderPolicyTarget{PeerID: peerID}, nil
+}
+
+func (target ProviderPolicyTarget) String() string {
+	if target.Address != address.Undef {
+		return target.Address.String()
+	}
+	return target.PeerID.String()
+}
+
+func (target ProviderPolicyTarget) MarshalText() ([]byte, error) {
+	return []byte(target.String()), nil
+}
+
+func (target *ProviderPolicyTarget) UnmarshalText(text []byte) error {
+	parsed, err := ParseProviderPolicyTarget(string(text))
+	if err != nil {
+		return err
+	}
+
+	*target = parsed
+
+	return nil
+}
+
+type ProviderPolicyRule struct {
+	Action   ProviderPolicyAction
+	Provider ProviderPolicyTarget
+	Reason   string
+
+	CreatedAt time.Time
+
+	// Zero if the rule never expires
+	ExpiresAt time.Time
+
+	// Set for rules from Config, which aren't persisted and can't be removed
+	FromConfig bool `json:"-"`
+}
+
+func (rule ProviderPolicyRule) expired(now time.Time) bool {
+	return !rule.ExpiresAt.IsZero() && !now.Before(rule.ExpiresAt)
+}
+
+// Returned when a storage provider is used that the policy doesn't allow -
+// matches ErrProviderBlocked with errors.Is
+type ProviderBlockedError struct {
+	Provider ProviderPolicyTarget
+
+	// The deny rule the provider matched, or nil if it was blocked for not
+	// matching any allow rule
+	Rule *ProviderPolicyRule
+}
+
+func (err *ProviderBlockedError) Error() string {
+	if err.Rule == nil {
+		return fmt.Sprintf("%v: %s is not on the allow list", ErrProviderBlocked, err.Provider)
+	}
+
+	msg := fmt.Sprintf("%v: %s is denied", ErrProviderBlocked, err.Rule.Provider)
+	if err.Rule.Reason != "" {
+		msg += fmt.Sprintf(" (%s)", err.Rule.Reason)
+	}
+	if !err.Rule.ExpiresAt.IsZero() {
+		msg += fmt.Sprintf(" until %s", err.Rule.ExpiresAt.Format(time.RFC3339))
+	}
+
+	return msg
+}
+
+func (err *ProviderBlockedError) Unwrap() error {
+	return ErrProviderBlocked
+}
+
+// Providers that are always allowed or denied, on top of the rules added at
+// runtime (see Client.BlockProvider)
+type ProviderPolicyConfig struct {
+	// If this or the runtime allow list isn't empty, only providers on them
+	// may be used
+	Allow []ProviderPolicyTarget
+
+	// Denied providers are blocked even if they're also allowed
+	Deny []ProviderPolicyTarget
+}
+
+// The config rules along with the runtime rules, which are mirrored from the
+// datastore
+type providerPolicy struct {
+	lk    sync.Mutex
+	rules map[ProviderPolicyAction]map[ProviderPolicyTarget]ProviderPolicyRule
+
+	// The peer IDs the addresses of rules had on chain when the rules were
+	// added or loaded, so that the rules also match providers only known by
+	// peer ID
+	peerIDs map[address.Address]peer.ID
+}
+
+func providerPolicyRuleKey(action ProviderPolicyAction, target ProviderPolicyTarget) datastore.Key {
+	return providerPolicyKey.ChildString(string(action)).ChildString(target.String())
+}
+
+func newProviderPolicy(ctx context.Context, cfg ProviderPolicyConfig, ds datastore.Datastore) (*providerPolicy, error) {
+	policy := &providerPolicy{
+		rules: map[ProviderPolicyAction]map[ProviderPolicyTarget]ProviderPolicyRule{
+			ProviderPolicyAllow: make(map[ProviderPolicyTarget]ProviderPolicyRule),
+			ProviderPolicyDeny:  make(map[ProviderPolicyTarget]ProviderPolicyRule),
+		},
+		peerIDs: make(map[address.Address]peer.ID),
+	}
+
+	results, err := ds.Query(ctx, query.Query{Prefix: providerPolicyKey.String()})
+	if err != nil {
+		return nil, err
+	}
+	defer results.Close()
+
+	now := time.Now()
+	for result := range results.Next() {
+		if result.Error != nil {
+			return nil, result.Error
+		}
+
+		var rule ProviderPolicyRule
+		if err := json.Unmarshal(result.Value, &rule); err != nil {
+			log.Errorf("Skipping unreadable provider policy rule %s: %v", result.Key, err)
+			continue
+		}
+
+		if _, ok := policy.rules[rule.Action]; !ok {
+			log.Errorf("Skipping provider policy rule %s with unknown action %q", result.Key, rule.Action)
+			continue
+		}
+
+		if rule.expired(now) {
+			if err := ds.Delete(ctx, datastore.NewKey(result.Key)); err != nil {
+				log.Errorf("Failed to delete expired provider policy rule %s: %v", result.Key, err)
+			}
+			continue
+		}
+
+		policy.rules[rule.Action][rule.Provider] = rule
+	}
+
+	// Config rules take precedence over persisted rules for the same provider
+	for _, target := range cfg.Allow {
+		policy.rules[ProviderPolicyAllow][target] = ProviderPolicyRule{
+			Action:     ProviderPolicyAllow,
+			Provider:   target,
+			FromConfig: true,
+		}
+	}
+	for _, target := range cfg.Deny {
+		policy.rules[ProviderPolicyDeny][target] = ProviderPolicyRule{
+			Action:     ProviderPolicyDeny,
+			Provider:   target,
+			FromConfig: true,
+		}
+	}
+
+	return policy, nil
+}
+
+// Blocks the provider for the duration, or permanently if it's 0 - blocking a
+// provider again replaces the previous block
+func (client *Client) BlockProvider(
+	ctx context.Context,
+	provider ProviderPolicyTarget,
+	reason string,
+	duration time.Duration,
+) error {
+	rule := ProviderPolicyRule{
+		Action:    ProviderPolicyDeny,
+		Provider:  provider,
+		Reason:    reason,
+		CreatedAt: time.Now(),
+	}
+	if duration != 0 {
+		rule.ExpiresAt = rule.CreatedAt.Add(duration)
+	}
+
+	return client.addProviderPolicyRule(ctx, rule)
+}
+
+func (client *Client) UnblockProvider(ctx context.Context, provider ProviderPolicyTarget) error {
+	return client.removeProviderPolicyRule(ctx, ProviderPolicyDeny, provider)
+}
+
+// Adds the provider to the allow list - once the allow list isn't empty, only
+// providers on it may be used
+func (client *Client) AllowProvider(ctx context.Context, provider ProviderPolicyTarget, reason string) error {
+	return client.addProviderPolicyRule(ctx, ProviderPolicyRule{
+		Action:    ProviderPolicyAllow,
+		Provider:  provider,
+		Reason:    reason,
+		CreatedAt: time.Now(),
+	})
+}
+
+func (client *Client) RemoveAllowedProvider(ctx context.Context, provider ProviderPolicyTarget) error {
+	return client.removeProviderPolicyRule(ctx, ProviderPolicyAllow, provider)
+}
+
+// All rules in effect, from both the config and the datastore, sorted by
+// action then provider
+func (client *Client) ProviderPolicyRules() []ProviderPolicyRule {
+	policy := client.providerPolicy
+
+	policy.lk.Lock()
+	defer policy.lk.Unlock()
+
+	now := time.Now()
+	var rules []ProviderPolicyRule
+	for _, actionRules := range policy.rules {
+		for _, rule := range actionRules {
+			if !rule.expired(now) {
+				rules = append(rules, rule)
+			}
+		}
+	}
+
+	sort.Slice(rules, func(i, j int) bool {
+		if rules[i].Action != rules[j].Action {
+			return rules[i].Action < rules[j].Action
+		}
+		return rules[i].Provider.String() < rules[j].Provider.String()
+	})
+
+	return rules
+}
+
+// Looks up the peer IDs of the addresses in the rules, so that they also match
+// providers only known by peer ID - an address whose miner info can't be found
+// only matches by address
+func (client *Client) resolveProviderPolicyPeerIDs(ctx context.Context) {
+	var addrs []address.Address
+	for _, rule := range client.ProviderPolicyRules() {
+		if rule.Provider.Address != address.Undef {
+			addrs = append(addrs, rule.Provider.Address)
+		}
+	}
+
+	for _, addr := range addrs {
+		client.resolveProviderPolicyPeerID(ctx, addr)
+	}
+}
+
+func (client *Client) resolveProviderPolicyPeerID(ctx context.Context, addr address.Address) {
+	info, err := client.MinerInfo(ctx, addr)
+	if err != nil {
+		log.Warnf("Could not find peer ID of %s, so its policy rules only match by address: %v", addr, err)
+		return
+	}
+	if info.PeerID == nil {
+		return
+	}
+
+	policy := client.providerPolicy
+
+	policy.lk.Lock()
+	defer policy.lk.Unlock()
+
+	policy.peerIDs[addr] = *info.PeerID
+}
+
+func (client *Client) addProviderPolicyRule(ctx context.Context, rule ProviderPolicyRule) error {
+	if rule.Provider.Address != address.Undef {
+		client.resolveProviderPolicyPeerID(ctx, rule.Provider.Address)
+	}
+
+	policy := client.providerPolicy
+
+	policy.lk.Lock()
+	defer policy.lk.Unlock()
+
+	if existing, ok := policy.rules[rule.Action][rule.Provider]; ok && existing.FromConfig {
+		return fmt.Errorf("%w: %s %s", ErrProviderPolicyRuleFromConfig, rule.Action, rule.Provider)
+	}
+
+	data, err := json.Marshal(rule)
+	if err != nil {
+		return err
+	}
+
+	if err := client.ds.Put(ctx, providerPolicyRuleKey(rule.Action, rule.Provider), data); err != nil {
+		return err
+	}
+
+	policy.rules[rule.Action][rule.Provider] = rule
+
+	return nil
+}
+
+func (client *Client) removeProviderPolicyRule(
+	ctx context.Context,
+	action ProviderPolicyAction,
+	provider ProviderPolicyTarget,
+) error {
+	policy := client.providerPolicy
+
+	policy.lk.Lock()
+	defer policy.lk.Unlock()
+
+	existing, ok := policy.rules[action][provider]
+	if !ok || existing.expired(time.Now()) {
+		return fmt.Errorf("%w: %s %s", ErrProviderPolicyRuleNotFound, action, provider)
+	}
+	if existing.FromConfig {
+		return fmt.Errorf("%w: %s %s", ErrProviderPolicyRuleFromConfig, action, provider)
+	}
+
+	if err := client.ds.Delete(ctx, providerPolicyRuleKey(action, provider)); err != nil {
+		return err
+	}
+
+	delete(policy.rules[action], provider)
+
+	return nil
+}
+
+// Whether any rules match the provider by address, and by peer ID
+func (policy *providerPolicy) hasRulesBy() (byAddress bool, byPeerID bool) {
+	policy.lk.Lock()
+	defer policy.lk.Unlock()
+
+	for _, actionRules := range policy.rules {
+		for target := range actionRules {
+			if target.Address != address.Undef {
+				byAddress = true
+			} else {
+				byPeerID = true
+			}
+		}
+	}
+
+	return byAddress, byPeerID
+}
+
+// Checks the provider against the rules, with whichever of its address and
+// peer ID are known
+func (policy *providerPolicy) check(addr address.Address, peerID peer.ID) error {
+	policy.lk.Lock()
+	defer policy.lk.Unlock()
+
+	now := time.Now()
+
+	var targets []ProviderPolicyTarget
+	if addr != address.Undef {
+		targets = append(targets, ProviderPolicyTarget{Address: addr})
+	}
+	if peerID != "" {
+		targets = append(targets, ProviderPolicyTarget{PeerID: peerID})
+
+		// Rules by address match the peer ID the address had when the rule
+		// was added, even if the provider's address isn't known
+		for ruleAddr, rulePeerID := range policy.peerIDs {
+			if rulePeerID == peerID && ruleAddr != addr {
+				targets = append(targets, ProviderPolicyTarget{Address: ruleAddr})
+			}
+		}
+	}
+
+	for _, target := range targets {
+		if rule, ok := policy.rules[ProviderPolicyDeny][target]; ok && !rule.expired(now) {
+			return &ProviderBlockedError{Provider: target, Rule: &rule}
+		}
+	}
+
+	hasAllowRules := false
+	for _, rule := range policy.rules[ProviderPolicyAllow] {
+		if !rule.expired(now) {
+			hasAllowRules = true
+			break
+		}
+	}
+	if !hasAllowRules {
+		return nil
+	}
+
+	for _, target := range targets {
+		if rule, ok := policy.rules[ProviderPolicyAllow][target]; ok && !rule.expired(now) {
+			return nil
+		}
+	}
+
+	var provider ProviderPolicyTarget
+	if len(targets) != 0 {
+		provider = targets[0]
+	}
+
+	return &ProviderBlockedError{Provider: provider}
+}
+
+// Checks the provider against the client's allow and deny lists, returning a
+// ProviderBlockedError if it may not be used
+//
+// If there are rules by the part of the provider's identity that isn't known
+// yet, it's looked up from the miner info cache or the peer ID index, without
+// scanning the chain - rules by address also match the peer ID the address had
+// on chain when the rule was added or the client started, so a provider whose
+// identity can't be completed is still checked against them
+func (handle *StorageProviderHandle) CheckPolicy(ctx context.Context) error {
+	byAddress, byPeerID := handle.client.providerPolicy.hasRulesBy()
+
+	if byPeerID && handle.peerID == "" && handle.addr != address.Undef {
+		if _, err := handle.PeerID(ctx); err != nil {
+			log.Debugf("Could not find peer ID of %s to check policy: %v", handle.addr, err)
+		}
+	}
+
+	if byAddress && handle.addr == address.Undef && handle.peerID != "" {
+		if addr, err := handle.client.indexedStorageProviderAddress(ctx, handle.peerID); err == nil {
+			handle.addr = addr
+		}
+	}
+
+	return handle.client.providerPolicy.check(handle.addr, handle.peerID)
+}
@@ -0,0 +1,141 @@
+package filclient
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/ipfs/go-merkledag"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/test"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProviderPolicyPersistence(t *testing.T) {
+	ctx := context.Background()
+	ds := initDatastore(t)
+
+	addr, err := address.NewIDAddress(1000)
+	require.NoError(t, err)
+	peerID := test.RandPeerIDFatal(t)
+	allowed := ProviderPolicyTarget{PeerID: test.RandPeerIDFatal(t)}
+
+	fc := initStandaloneClient(t, ctx, ds, WithProviderPolicy(ProviderPolicyConfig{
+		Allow: []ProviderPolicyTarget{allowed},
+	}))
+
+	require.NoError(t, fc.BlockProvider(ctx, ProviderPolicyTarget{Address: addr}, "bad deals", 0))
+	require.NoError(t, fc.BlockProvider(ctx, ProviderPolicyTarget{PeerID: peerID}, "", time.Hour))
+	require.NoError(t, fc.BlockProvider(ctx, ProviderPolicyTarget{Address: address.TestAddress}, "", time.Millisecond))
+
+	// Config rules can't be changed at runtime
+	require.ErrorIs(t, fc.RemoveAllowedProvider(ctx, allowed), ErrProviderPolicyRuleFromConfig)
+
+	time.Sleep(10 * time.Millisecond)
+
+	// The runtime rules survive a restart, apart from the one that expired,
+	// and config rules only apply while they're configured
+	fc = initStandaloneClient(t, ctx, ds)
+	rules := fc.ProviderPolicyRules()
+	require.Len(t, rules, 2)
+	rulesByProvider := make(map[ProviderPolicyTarget]ProviderPolicyRule)
+	for _, rule := range rules {
+		require.Equal(t, ProviderPolicyDeny, rule.Action)
+		rulesByProvider[rule.Provider] = rule
+	}
+	require.Equal(t, "bad deals", rulesByProvider[ProviderPolicyTarget{Address: addr}].Reason)
+	require.True(t, rulesByProvider[ProviderPolicyTarget{Address: addr}].ExpiresAt.IsZero())
+	require.False(t, rulesByProvider[ProviderPolicyTarget{PeerID: peerID}].ExpiresAt.IsZero())
+
+	require.NoError(t, fc.UnblockProvider(ctx, ProviderPolicyTarget{PeerID: peerID}))
+	require.ErrorIs(t, fc.UnblockProvider(ctx, ProviderPolicyTarget{PeerID: peerID}), ErrProviderPolicyRuleNotFound)
+	require.Len(t, fc.ProviderPolicyRules(), 1)
+}
+
+func TestProviderPolicyEnforcement(t *testing.T) {
+	ctx := context.Background()
+	payloadCid := merkledag.NewRawNode([]byte("payload")).Cid()
+
+	fc, provider := initTransportsTestClient(t, ctx, retrievalTransportsResponse{})
+	handle := fc.StorageProviderByPeerID(provider.ID())
+	target := ProviderPolicyTarget{PeerID: provider.ID()}
+
+	_, err := handle.Connect(ctx)
+	require.NoError(t, err)
+
+	require.NoError(t, fc.BlockProvider(ctx, target, "misbehaving", 0))
+
+	// Blocked even though it's still connected
+	_, err = handle.Connect(ctx)
+	require.ErrorIs(t, err, ErrProviderBlocked)
+
+	var blockedErr *ProviderBlockedError
+	require.True(t, errors.As(err, &blockedErr))
+	require.NotNil(t, blockedErr.Rule)
+	require.Equal(t, "misbehaving", blockedErr.Rule.Reason)
+
+	_, err = handle.QueryRetrievalAsk(ctx, payloadCid)
+	require.ErrorIs(t, err, ErrProviderBlocked)
+	_, err = handle.StartRetrievalTransfer(ctx, payloadCid)
+	require.ErrorIs(t, err, ErrProviderBlocked)
+	_, _, err = handle.QueryStorageAskUnchecked(ctx)
+	require.ErrorIs(t, err, ErrProviderBlocked)
+
+	res, err := fc.Retrieve(ctx, payloadCid, []*StorageProviderHandle{handle})
+	require.ErrorIs(t, err, ErrAllRetrievalCandidatesFailed)
+	require.Equal(t, RetrievalCandidateBlocked, res.Candidates[0].Outcome)
+
+	require.NoError(t, fc.UnblockProvider(ctx, target))
+	require.NoError(t, handle.CheckPolicy(ctx))
+
+	// Once anything is allowed, everything else is blocked
+	require.NoError(t, fc.AllowProvider(ctx, ProviderPolicyTarget{PeerID: test.RandPeerIDFatal(t)}, ""))
+	err = handle.CheckPolicy(ctx)
+	require.True(t, errors.As(err, &blockedErr))
+	require.Nil(t, blockedErr.Rule)
+
+	require.NoError(t, fc.AllowProvider(ctx, target, ""))
+	require.NoError(t, handle.CheckPolicy(ctx))
+
+	// Temporary bans lift on their own
+	require.NoError(t, fc.BlockProvider(ctx, target, "", 10*time.Millisecond))
+	require.ErrorIs(t, handle.CheckPolicy(ctx), ErrProviderBlocked)
+	time.Sleep(20 * time.Millisecond)
+	require.NoError(t, handle.CheckPolicy(ctx))
+}
+
+func TestProviderPolicyAddressRulesMatchPeerID(t *testing.T) {
+	ctx := context.Background()
+
+	peerA := test.RandPeerIDFatal(t)
+	addrA, err := address.NewIDAddress(1000)
+	require.NoError(t, err)
+	gateway := &testMinerGateway{miners: map[address.Address]peer.ID{addrA: peerA}}
+
+	fc := initStandaloneClient(t, ctx, initDatastore(t))
+	fc.api = gateway
+
+	// The peer ID index hasn't been built, but the rule's peer ID was looked
+	// up when it was added
+	require.NoError(t, fc.BlockProvider(ctx, ProviderPolicyTarget{Address: addrA}, "", 0))
+	err = fc.StorageProviderByPeerID(peerA).CheckPolicy(ctx)
+	require.ErrorIs(t, err, ErrProviderBlocked)
+	var blockedErr *ProviderBlockedError
+	require.True(t, errors.As(err, &blockedErr))
+	require.Equal(t, addrA, blockedErr.Rule.Provider.Address)
+
+	require.NoError(t, fc.StorageProviderByPeerID(test.RandPeerIDFatal(t)).CheckPolicy(ctx))
+
+	// Rules loaded when the client starts are looked up then
+	h, err := mocknet.New().GenPeer()
+	require.NoError(t, err)
+	fc, err = New(ctx, h, gateway, address.Undef, initBlockstore(t), initDatastore(t), WithProviderPolicy(ProviderPolicyConfig{
+		Allow: []ProviderPolicyTarget{{Address: addrA}},
+	}))
+	require.NoError(t, err)
+	defer fc.Close()
+	require.NoError(t, fc.StorageProviderByPeerID(peerA).CheckPolicy(ctx))
+}
@@ -4,17 +4,16 @@ import (
 	"context"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"sync"
+	"time"
 
 	datatransfer "github.com/filecoin-project/go-data-transfer"
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
-	"github.com/ipfs/go-blockservice"
+	retrievalmigrations "github.com/filecoin-project/go-fil-markets/retrievalmarket/migrations"
 	"github.com/ipfs/go-cid"
 	"github.com/ipfs/go-datastore"
-	offline "github.com/ipfs/go-ipfs-exchange-offline"
-	format "github.com/ipfs/go-ipld-format"
-	"github.com/ipfs/go-merkledag"
-	selectorparse "github.com/ipld/go-ipld-prime/traversal/selector/parse"
+	"github.com/ipld/go-ipld-prime"
 	"github.com/libp2p/go-libp2p/core/peer"
 )
 
@@ -28,7 +27,7 @@ type RetrievalTransferStatus uint
 
 const (
 	// Unknown or invalid transfer state
-	RetrievalTransferStatusInvalid = iota
+	RetrievalTransferStatusInvalid RetrievalTransferStatus = iota
 
 	// Transfer was rejected up-front before it could start
 	RetrievalTransferStatusRejected
@@ -46,13 +45,64 @@ const (
 	RetrievalTransferStatusCompleted
 )
 
+func (status RetrievalTransferStatus) String() string {
+	switch status {
+	case RetrievalTransferStatusRejected:
+		return "rejected"
+	case RetrievalTransferStatusInProgress:
+		return "in progress"
+	case RetrievalTransferStatusErrored:
+		return "errored"
+	case RetrievalTransferStatusCancelled:
+		return "cancelled"
+	case RetrievalTransferStatusCompleted:
+		return "completed"
+	default:
+		return "invalid"
+	}
+}
+
 // Whether the retrieval status is in any of the "done states"
 func (status RetrievalTransferStatus) IsDone() bool {
 	return status == RetrievalTransferStatusCompleted ||
+		status == RetrievalTransferStatusRejected ||
 		status == RetrievalTransferStatusCancelled ||
 		status == RetrievalTransferStatusErrored
 }
 
+// The protocol a retrieval transfer fetches its data over
+type RetrievalTransport uint
+
+const (
+	// Paid retrieval deal over a graphsync data transfer channel
+	RetrievalTransportGraphsync RetrievalTransport = iota
+
+	// Free retrieval of individual blocks over bitswap
+	RetrievalTransportBitswap
+
+	// Free retrieval of a CAR or piece over HTTP
+	RetrievalTransportHTTP
+
+	// Nothing was fetched, since the DAG was already complete in the local
+	// blockstore
+	RetrievalTransportLocal
+)
+
+func (transport RetrievalTransport) String() string {
+	switch transport {
+	case RetrievalTransportGraphsync:
+		return "graphsync"
+	case RetrievalTransportBitswap:
+		return "bitswap"
+	case RetrievalTransportHTTP:
+		return "http"
+	case RetrievalTransportLocal:
+		return "local"
+	default:
+		return "unknown"
+	}
+}
+
 // Operational handle for controlling and getting information about a retrieval
 // transfer
 type RetrievalTransfer struct {
@@ -61,7 +111,21 @@ type RetrievalTransfer struct {
 	status   RetrievalTransferStatus
 	provider peer.ID
 	proposal retrievalmarket.DealProposal
-	chanID   datatransfer.ChannelID
+
+	transport RetrievalTransport
+
+	// Only set for graphsync transfers
+	chanID datatransfer.ChannelID
+
+	// Stops the transfer - only set for transports that don't run over a data
+	// transfer channel
+	cancel context.CancelFunc
+
+	// Where blocks go if the transfer is being streamed, nil otherwise
+	blockWriter *retrievalBlockWriter
+
+	// What the DAG is checked against before completing
+	selector ipld.Node
 
 	// Bytes that were already in the blockstore before the retrieval started
 	cachedProgress uint64
@@ -69,10 +133,39 @@ type RetrievalTransfer struct {
 	// Bytes received since the retrieval started
 	retrievalProgress uint64
 
+	// Blocks received since the retrieval started
+	blocksReceived uint64
+
+	throughput retrievalThroughput
+
 	// Total byte size of the data being retrieved
 	size uint64
 
+	// Why the transfer ended without completing (one of the ErrRetrieval*
+	// errors), nil otherwise
+	errKind error
+
+	// Explanation of the last status change from the provider or channel, if
+	// there is one
+	message string
+
+	// When the transfer was last written to the datastore
+	lastPersisted time.Time
+
+	timeouts      retrievalTimeouts
+	timedOutPhase RetrievalTimeoutPhase
+
+	// Set while the received DAG is verified, which the timeouts don't cover
+	verifying bool
+
+	startTime     time.Time
+	acceptTime    time.Time
+	firstByteTime time.Time
+	lastDataTime  time.Time
+
 	doneChans []chan<- struct{}
+
+	subscribers retrievalSubscribers
 }
 
 func (transfer *RetrievalTransfer) State() RetrievalTransferStatus {
@@ -94,36 +187,215 @@ func (transfer *RetrievalTransfer) Size() uint64 {
 	return transfer.size
 }
 
-func (handle *StorageProviderHandle) QueryRetrievalAsk(ctx context.Context, payloadCid cid.Cid) (retrievalmarket.QueryResponse, error) {
-	const protocol = "/fil/retrieval/qry/1.0.0"
+func (transfer *RetrievalTransfer) Transport() RetrievalTransport {
+	return transfer.transport
+}
+
+// The data transfer channel of a graphsync transfer - empty for other
+// transports
+func (transfer *RetrievalTransfer) ChannelID() datatransfer.ChannelID {
+	return transfer.chanID
+}
 
-	req := retrievalmarket.Query{PayloadCID: payloadCid}
-	var resp retrievalmarket.QueryResponse
-	if err := handle.runSingleRPC(ctx, &req, &resp, retrievalmarket.QueryProtocolID); err != nil {
+func (transfer *RetrievalTransfer) Provider() peer.ID {
+	return transfer.provider
+}
+
+func (transfer *RetrievalTransfer) PayloadCID() cid.Cid {
+	return transfer.proposal.PayloadCID
+}
+
+// Queries the provider's ask for retrieving the payload - the only option that
+// applies is RetrievalWithPieceCID, which scopes the query to one piece
+//
+// If a piece was specified, the response's PieceCIDFound says whether the
+// provider has it
+func (handle *StorageProviderHandle) QueryRetrievalAsk(
+	ctx context.Context,
+	payloadCid cid.Cid,
+	options ...RetrievalOption,
+) (retrievalmarket.QueryResponse, error) {
+	if err := handle.CheckPolicy(ctx); err != nil {
 		return retrievalmarket.QueryResponse{}, err
 	}
 
+	var cfg RetrievalConfig
+	for _, option := range options {
+		option(&cfg)
+	}
+
+	req := retrievalmarket.Query{
+		PayloadCID:  payloadCid,
+		QueryParams: retrievalmarket.QueryParams{PieceCID: cfg.pieceCid},
+	}
+	resp, version, err := runRPC(ctx, handle, retrievalQueryProtocol, req)
+	if err != nil {
+		return retrievalmarket.QueryResponse{}, err
+	}
+	log.Debugf("Queried retrieval ask of %s over %s", handle.peerID, version)
+
 	return resp, nil
 }
 
-// Start running a retrieval
-func (handle *StorageProviderHandle) StartRetrievalTransfer(
+// Retrieval queries, falling back on the old tuple-encoded version for
+// providers that don't support the current one
+var retrievalQueryProtocol = rpcProtocol[retrievalmarket.Query, retrievalmarket.QueryResponse]{
+	versions: []rpcVersion[retrievalmarket.Query, retrievalmarket.QueryResponse]{
+		cborRPCVersion[retrievalmarket.Query, retrievalmarket.QueryResponse](retrievalmarket.QueryProtocolID),
+		migratedRPCVersion(
+			retrievalmarket.OldQueryProtocolID,
+			func(query retrievalmarket.Query) retrievalmigrations.Query0 {
+				return retrievalmigrations.Query0{
+					PayloadCID:   query.PayloadCID,
+					QueryParams0: retrievalmigrations.QueryParams0{PieceCID: query.PieceCID},
+				}
+			},
+			func(resp retrievalmigrations.QueryResponse0) (retrievalmarket.QueryResponse, error) {
+				return retrievalmigrations.MigrateQueryResponse0To1(resp), nil
+			},
+		),
+	},
+}
+
+// The provider's answer to a retrieval query scoped to one piece
+type PieceRetrievalAsk struct {
+	PieceCID cid.Cid
+
+	// Whether the provider has the payload in this piece - only meaningful if
+	// Err is nil
+	Found bool
+
+	Ask retrievalmarket.QueryResponse
+
+	// Set if the query failed
+	Err error
+}
+
+// Queries the provider's ask for retrieving the payload from each of the
+// pieces, for when it's in more than one (e.g. in aggregated deals)
+func (handle *StorageProviderHandle) QueryRetrievalAskByPiece(
+	ctx context.Context,
+	payloadCid cid.Cid,
+	pieceCids []cid.Cid,
+) []PieceRetrievalAsk {
+	asks := make([]PieceRetrievalAsk, len(pieceCids))
+	for i, pieceCid := range pieceCids {
+		ask, err := handle.QueryRetrievalAsk(ctx, payloadCid, RetrievalWithPieceCID(pieceCid))
+		asks[i] = PieceRetrievalAsk{
+			PieceCID: pieceCid,
+			Found: err == nil &&
+				ask.Status == retrievalmarket.QueryResponseAvailable &&
+				ask.PieceCIDFound == retrievalmarket.QueryItemAvailable,
+			Ask: ask,
+			Err: err,
+		}
+	}
+
+	return asks
+}
+
+// If the DAG is already complete in the local blockstore, returns a transfer
+// that's already completed without touching the network, having streamed the
+// blocks to the CAR writer if there is one - otherwise returns nil, along with
+// the size of whatever part of the DAG is local
+func (client *Client) completeRetrievalLocally(
+	ctx context.Context,
+	payloadCid cid.Cid,
+	cfg RetrievalConfig,
+) (*RetrievalTransfer, uint64, error) {
+	size, complete, err := client.localDAGSize(ctx, payloadCid, cfg.selector)
+	if err != nil {
+		return nil, 0, fmt.Errorf("could not check local blocks: %w", err)
+	}
+	if !complete {
+		return nil, size, nil
+	}
+
+	blockWriter, err := newRetrievalBlockWriter(client.bs, payloadCid, cfg)
+	if err != nil {
+		return nil, 0, err
+	}
+	if blockWriter != nil {
+		if err := walkDAG(ctx, payloadCid, cfg.selector, func(ctx context.Context, c cid.Cid) ([]byte, error) {
+			block, err := client.bs.Get(ctx, c)
+			if err != nil {
+				return nil, err
+			}
+
+			if err := blockWriter.write(block); err != nil {
+				return nil, err
+			}
+
+			return block.RawData(), nil
+		}); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	log.Infof("DAG %s is already complete locally", payloadCid)
+
+	now := time.Now()
+	return &RetrievalTransfer{
+		client:         client,
+		status:         RetrievalTransferStatusCompleted,
+		proposal:       retrievalmarket.DealProposal{PayloadCID: payloadCid},
+		transport:      RetrievalTransportLocal,
+		blockWriter:    blockWriter,
+		selector:       cfg.selector,
+		cachedProgress: size,
+		size:           size,
+		startTime:      now,
+		acceptTime:     now,
+	}, size, nil
+}
+
+// Start running a retrieval deal over graphsync
+func (handle *StorageProviderHandle) StartGraphsyncRetrievalTransfer(
 	ctx context.Context,
 	payloadCid cid.Cid,
 	options ...RetrievalOption,
 ) (*RetrievalTransfer, error) {
+	if err := handle.CheckPolicy(ctx); err != nil {
+		return nil, err
+	}
+
 	var cfg RetrievalConfig
 	for _, option := range options {
 		option(&cfg)
 	}
 	cfg.Clean()
 
-	// TODO(@elijaharita): allow supplying a pre-run ask result
-	ask, err := handle.QueryRetrievalAsk(ctx, payloadCid)
+	var cachedProgress uint64
+	if cfg.localSize != nil {
+		cachedProgress = *cfg.localSize
+	} else {
+		localTransfer, localSize, err := handle.client.completeRetrievalLocally(ctx, payloadCid, cfg)
+		if err != nil {
+			return nil, err
+		}
+		if localTransfer != nil {
+			return localTransfer, nil
+		}
+		cachedProgress = localSize
+	}
+
+	blockWriter, err := newRetrievalBlockWriter(handle.client.bs, payloadCid, cfg)
 	if err != nil {
 		return nil, err
 	}
 
+	// Use the pre-run ask result if one was supplied, otherwise query it now
+	var ask retrievalmarket.QueryResponse
+	if cfg.ask != nil {
+		ask = *cfg.ask
+	} else {
+		var err error
+		ask, err = handle.QueryRetrievalAsk(ctx, payloadCid, options...)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	// Create proposal
 
 	params, err := retrievalmarket.NewParamsV1(
@@ -131,7 +403,7 @@ func (handle *StorageProviderHandle) StartRetrievalTransfer(
 		ask.MaxPaymentInterval,
 		ask.MaxPaymentIntervalIncrease,
 		cfg.selector,
-		nil,
+		cfg.pieceCid,
 		ask.UnsealPrice,
 	)
 	if err != nil {
@@ -156,30 +428,6 @@ func (handle *StorageProviderHandle) StartRetrievalTransfer(
 		return nil, err
 	}
 
-	// Compute the cached progress by walking the tree
-
-	var cachedProgress uint64
-	visited := cid.NewSet()
-	dag := merkledag.NewDAGService(blockservice.New(handle.client.bs, offline.Exchange(handle.client.bs)))
-
-	getLinks := func(ctx context.Context, cid cid.Cid) ([]*format.Link, error) {
-		node, err := dag.Get(ctx, cid)
-		if err != nil {
-			return nil, err
-		}
-
-		blockSize, err := handle.client.bs.GetSize(ctx, cid)
-		if err != nil {
-			return nil, err
-		}
-
-		cachedProgress += uint64(blockSize)
-
-		return node.Links(), nil
-	}
-
-	merkledag.Walk(ctx, getLinks, payloadCid, visited.Visit)
-
 	// Open the data channel
 
 	// NOTE: from this point to the end of the function, retrieval transfers
@@ -187,13 +435,27 @@ func (handle *StorageProviderHandle) StartRetrievalTransfer(
 	handle.client.retrievalTransfersLk.Lock()
 	defer handle.client.retrievalTransfersLk.Unlock()
 
+	// If streaming, the link system gets picked up by the transport configurer
+	// while the channel is being opened
+	if blockWriter != nil {
+		handle.client.retrievalLinkSystemsLk.Lock()
+		handle.client.retrievalLinkSystems[proposal.ID] = blockWriter.linkSystem()
+		handle.client.retrievalLinkSystemsLk.Unlock()
+
+		defer func() {
+			handle.client.retrievalLinkSystemsLk.Lock()
+			delete(handle.client.retrievalLinkSystems, proposal.ID)
+			handle.client.retrievalLinkSystemsLk.Unlock()
+		}()
+	}
+
 	log.Infof("Starting data channel...")
 	chanID, err := handle.client.dt.OpenPullDataChannel(
 		ctx,
 		peerID,
 		&proposal,
 		proposal.PayloadCID,
-		selectorparse.CommonSelector_ExploreAllRecursively,
+		cfg.selector,
 	)
 	if err != nil {
 		return nil, err
@@ -203,36 +465,34 @@ func (handle *StorageProviderHandle) StartRetrievalTransfer(
 		client:            handle.client,
 		status:            RetrievalTransferStatusInProgress,
 		proposal:          proposal,
+		transport:         RetrievalTransportGraphsync,
+		blockWriter:       blockWriter,
+		selector:          cfg.selector,
 		provider:          peerID,
 		chanID:            chanID,
 		cachedProgress:    cachedProgress,
 		retrievalProgress: 0,
 		size:              ask.Size,
+		timeouts:          cfg.timeouts,
+		startTime:         time.Now(),
 	}
 
 	// Register with running transfers
 	handle.client.retrievalTransfers[chanID] = transfer
 
+	if err := transfer.persist(ctx); err != nil {
+		log.Errorf("Failed to persist retrieval transfer %s: %v", chanID, err)
+	}
+
+	go transfer.watchTimeouts(context.Background())
+
 	log.Infof("Retrieval is running")
 
 	return transfer, nil
 }
 
 func (transfer *RetrievalTransfer) Cancel(ctx context.Context) error {
-	transfer.lk.Lock()
-	defer transfer.lk.Unlock()
-
-	return transfer.cancel(ctx)
-}
-
-func (transfer *RetrievalTransfer) cancel(ctx context.Context) error {
-	if err := transfer.close(ctx); err != nil {
-		return err
-	}
-
-	transfer.status = RetrievalTransferStatusCancelled
-
-	return nil
+	return transfer.finish(ctx, RetrievalTransferStatusCancelled, ErrRetrievalCancelled, "")
 }
 
 // Returns a channel that will close when the retrieval finishes (closes
@@ -258,28 +518,6 @@ func (transfer *RetrievalTransfer) done() <-chan struct{} {
 	return ch
 }
 
-func (transfer *RetrievalTransfer) close(ctx context.Context) error {
-	// Ensure the channel is closed
-	if err := transfer.client.dt.CloseDataTransferChannel(
-		ctx,
-		transfer.chanID,
-	); err != nil {
-		return err
-	}
-
-	// Send done signals
-	for _, ch := range transfer.doneChans {
-		close(ch)
-	}
-
-	// Remove from active transfers
-	transfer.client.retrievalTransfersLk.Lock()
-	delete(transfer.client.retrievalTransfers, transfer.chanID)
-	transfer.client.retrievalTransfersLk.Unlock()
-
-	return nil
-}
-
 // Reads the next retrieval deal ID from the datastore (or initializes it as 1
 // if a datastore entry doesn't exist yet), and increments the datastore entry
 // afterwards
@@ -322,17 +560,17 @@ func (client *Client) handleDataTransferRetrievalEvent(
 
 	client.retrievalTransfersLk.Lock()
 	transfer, ok := client.retrievalTransfers[channelState.ChannelID()]
+	client.retrievalTransfersLk.Unlock()
 	if !ok {
-		log.Errorf("Received transfer event for nonexistent channel: %s", channelState.ChannelID())
+		// Channels keep sending events for a little while after their transfer
+		// finishes, so this isn't necessarily a problem
+		log.Debugf("Received transfer event for nonexistent channel: %s", channelState.ChannelID())
+		return
 	}
-	client.retrievalTransfersLk.Unlock()
-
-	close := func() {
-		transfer.lk.Lock()
-		defer transfer.lk.Unlock()
 
-		if err := transfer.close(ctx); err != nil {
-			log.Errorf("Failed to close transfer with deal ID: %d", transfer.proposal.ID)
+	finish := func(status RetrievalTransferStatus, errKind error, message string) {
+		if err := transfer.finish(ctx, status, errKind, message); err != nil {
+			log.Errorf("Failed to finish transfer with deal ID %d: %v", transfer.proposal.ID, err)
 		}
 	}
 
@@ -341,64 +579,99 @@ func (client *Client) handleDataTransferRetrievalEvent(
 		log.Debugf("Voucher result: %s", channelState.LastVoucherResult().Type())
 		switch result := channelState.LastVoucherResult().(type) {
 		case *retrievalmarket.DealResponse:
-			client.handleRetrievalDealResponse(ctx, event, channelState, result)
+			client.handleRetrievalDealResponse(ctx, transfer, channelState, result)
+		}
+	case datatransfer.NewVoucher:
+		switch voucher := channelState.LastVoucher().(type) {
+		case *retrievalmarket.DealPayment:
+			event := RetrievalEvent{Code: RetrievalEventPaymentSent}
+			if voucher.PaymentVoucher != nil {
+				event.Payment = voucher.PaymentVoucher.Amount
+			}
+			transfer.publish(event)
 		}
 	case datatransfer.DataReceived:
 		transfer.lk.Lock()
-		transfer.retrievalProgress = channelState.Received()
+		transfer.dataReceivedLocked(channelState.Received(), uint64(channelState.ReceivedCidsTotal()))
+		if time.Since(transfer.lastPersisted) > retrievalRecordProgressInterval {
+			if err := transfer.persist(ctx); err != nil {
+				log.Errorf("Failed to persist retrieval transfer progress: %v", err)
+			}
+		}
 		transfer.lk.Unlock()
+		transfer.publish(RetrievalEvent{Code: RetrievalEventProgress})
+	case datatransfer.Error:
+		log.Errorf("Retrieval transfer error: %s", event.Message)
+		finish(RetrievalTransferStatusErrored, ErrRetrievalFailed, event.Message)
+	case datatransfer.Disconnected:
+		log.Errorf("Retrieval provider disconnected: %s", event.Message)
+		finish(RetrievalTransferStatusErrored, ErrRetrievalDisconnected, event.Message)
+	case datatransfer.Cancel:
+		// Cancellations from our side finish the transfer before the event
+		// arrives, so if it's still running the provider must have cancelled
+		log.Errorf("Retrieval transfer cancelled by provider: %s", event.Message)
+		finish(RetrievalTransferStatusErrored, ErrRetrievalCancelledByProvider, event.Message)
 	case datatransfer.CleanupComplete:
 		if event.Message != "" {
 			log.Infof("Retrieval transfer completed: %s", event.Message)
 		} else {
 			log.Infof("Retrieval transfer completed")
 		}
-		transfer.lk.Lock()
-		transfer.status = RetrievalTransferStatusCompleted
-		transfer.lk.Unlock()
-		close()
+
+		// Verification walks the whole DAG, which would hold up events for
+		// every other channel if it ran here
+		go func() {
+			if err := transfer.complete(ctx, event.Message); err != nil {
+				log.Errorf("Failed to finish transfer with deal ID %d: %v", transfer.proposal.ID, err)
+			}
+		}()
 	}
 }
 
 func (client *Client) handleRetrievalDealResponse(
 	ctx context.Context,
-	event datatransfer.Event,
+	transfer *RetrievalTransfer,
 	channelState datatransfer.ChannelState,
 	response *retrievalmarket.DealResponse,
 ) {
 	log := log.With("channelID", channelState.ChannelID())
 
-	close := func() {
-		client.retrievalTransfersLk.Lock()
-		defer client.retrievalTransfersLk.Unlock()
-
-		transfer, ok := client.retrievalTransfers[channelState.ChannelID()]
-		if !ok {
-			log.Errorf("Cannot close nonexistent channel: %s", channelState.ChannelID())
-		}
-
-		transfer.lk.Lock()
-		defer transfer.lk.Unlock()
-
-		if err := transfer.close(ctx); err != nil {
-			log.Errorf("Failed to close transfer with deal ID: %d", transfer.proposal.ID)
+	finish := func(status RetrievalTransferStatus, errKind error, message string) {
+		if err := transfer.finish(ctx, status, errKind, message); err != nil {
+			log.Errorf("Failed to finish transfer with deal ID %d: %v", transfer.proposal.ID, err)
 		}
 	}
 
 	switch response.Status {
 	case retrievalmarket.DealStatusAccepted:
-		log.Info("Retrieval transfer accepted: %s", event.Message)
+		log.Infof("Retrieval transfer accepted: %s", response.Message)
+		transfer.lk.Lock()
+		transfer.acceptTime = time.Now()
+		transfer.lk.Unlock()
+		transfer.publish(RetrievalEvent{Code: RetrievalEventAccepted, Message: response.Message})
 	case retrievalmarket.DealStatusRejected:
-		log.Error("Retrieval transfer rejected: %s", event.Message)
-		close()
+		log.Errorf("Retrieval transfer rejected: %s", response.Message)
+		finish(RetrievalTransferStatusRejected, ErrRetrievalRejected, response.Message)
+	case retrievalmarket.DealStatusDealNotFound:
+		log.Errorf("Retrieval deal not found: %s", response.Message)
+		finish(RetrievalTransferStatusRejected, ErrRetrievalRejected, response.Message)
+	case retrievalmarket.DealStatusErrored:
+		log.Errorf("Provider reported retrieval error: %s", response.Message)
+		finish(RetrievalTransferStatusErrored, ErrRetrievalProviderErrored, response.Message)
+	case retrievalmarket.DealStatusUnsealing:
+		log.Infof("Provider is unsealing data")
+		transfer.publish(RetrievalEvent{Code: RetrievalEventUnsealing, Message: response.Message})
 	case retrievalmarket.DealStatusFundsNeededUnseal:
-		log.Error("UNIMPLEMENTED - Funds needed for unseal: %d", response.PaymentOwed)
-		close()
+		log.Errorf("UNIMPLEMENTED - Funds needed for unseal: %d", response.PaymentOwed)
+		transfer.publish(RetrievalEvent{Code: RetrievalEventPaymentRequested, Payment: response.PaymentOwed})
+		finish(RetrievalTransferStatusErrored, ErrRetrievalPaymentNotSupported, response.Message)
 	case retrievalmarket.DealStatusFundsNeeded:
-		log.Error("UNIMPLEMENTED - Funds needed: %d", response.PaymentOwed)
-		close()
+		log.Errorf("UNIMPLEMENTED - Funds needed: %d", response.PaymentOwed)
+		transfer.publish(RetrievalEvent{Code: RetrievalEventPaymentRequested, Payment: response.PaymentOwed})
+		finish(RetrievalTransferStatusErrored, ErrRetrievalPaymentNotSupported, response.Message)
 	case retrievalmarket.DealStatusFundsNeededLastPayment:
-		log.Error("UNIMPLEMENTED - Funds needed for last payment: %d", response.PaymentOwed)
-		close()
+		log.Errorf("UNIMPLEMENTED - Funds needed for last payment: %d", response.PaymentOwed)
+		transfer.publish(RetrievalEvent{Code: RetrievalEventPaymentRequested, Payment: response.PaymentOwed})
+		finish(RetrievalTransferStatusErrored, ErrRetrievalPaymentNotSupported, response.Message)
 	}
 }
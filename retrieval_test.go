@@ -7,6 +7,8 @@ import (
 	"path/filepath"
 	"testing"
 
+	"github.com/filecoin-project/go-address"
+	cborutil "github.com/filecoin-project/go-cbor-util"
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
 	"github.com/filecoin-project/go-fil-markets/storagemarket"
 	"github.com/filecoin-project/go-state-types/abi"
@@ -17,6 +19,7 @@ import (
 	offline "github.com/ipfs/go-ipfs-exchange-offline"
 	format "github.com/ipfs/go-ipld-format"
 	"github.com/ipfs/go-merkledag"
+	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/stretchr/testify/require"
 )
 
@@ -36,6 +39,66 @@ func TestQueryRetrievalAsk(t *testing.T) {
 
 }
 
+func TestQueryRetrievalAskByPiece(t *testing.T) {
+	ctx := context.Background()
+
+	payloadCid := merkledag.NewRawNode([]byte("payload")).Cid()
+	pieceA := merkledag.NewRawNode([]byte("piece a")).Cid()
+	pieceB := merkledag.NewRawNode([]byte("piece b")).Cid()
+
+	// The provider only has the payload in piece A
+	fc, provider := initTransportsTestClient(t, ctx, retrievalTransportsResponse{})
+	queries := make(chan retrievalmarket.Query, 4)
+	provider.SetStreamHandler(retrievalmarket.QueryProtocolID, func(stream network.Stream) {
+		defer stream.Close()
+
+		// Failures surface as query errors on the client's side
+		var query retrievalmarket.Query
+		if err := cborutil.ReadCborRPC(stream, &query); err != nil {
+			stream.Reset()
+			return
+		}
+		queries <- query
+
+		resp := retrievalmarket.QueryResponse{
+			Status:        retrievalmarket.QueryResponseAvailable,
+			PieceCIDFound: retrievalmarket.QueryItemAvailable,
+			Size:          1234,
+		}
+		resp.PaymentAddress, _ = address.NewIDAddress(1000)
+		if query.PieceCID != nil && !query.PieceCID.Equals(pieceA) {
+			resp.Status = retrievalmarket.QueryResponseUnavailable
+			resp.PieceCIDFound = retrievalmarket.QueryItemUnavailable
+		}
+		cborutil.WriteCborRPC(stream, &resp)
+	})
+
+	handle := fc.StorageProviderByPeerID(provider.ID())
+
+	ask, err := handle.QueryRetrievalAsk(ctx, payloadCid)
+	require.NoError(t, err)
+	require.Equal(t, retrievalmarket.QueryResponseAvailable, ask.Status)
+
+	ask, err = handle.QueryRetrievalAsk(ctx, payloadCid, RetrievalWithPieceCID(pieceB))
+	require.NoError(t, err)
+	require.Equal(t, retrievalmarket.QueryItemUnavailable, ask.PieceCIDFound)
+
+	asks := handle.QueryRetrievalAskByPiece(ctx, payloadCid, []cid.Cid{pieceA, pieceB})
+	require.Len(t, asks, 2)
+	require.NoError(t, asks[0].Err)
+	require.Equal(t, pieceA, asks[0].PieceCID)
+	require.True(t, asks[0].Found)
+	require.Equal(t, uint64(1234), asks[0].Ask.Size)
+	require.NoError(t, asks[1].Err)
+	require.Equal(t, pieceB, asks[1].PieceCID)
+	require.False(t, asks[1].Found)
+
+	// Every query was for the payload
+	for i := 0; i < 4; i++ {
+		require.Equal(t, payloadCid, (<-queries).PayloadCID)
+	}
+}
+
 func TestRetrievalTransfer(t *testing.T) {
 	ctx := context.TODO()
 	client, miner, _, fc, closer := initEnsemble(t, ctx)
@@ -0,0 +1,237 @@
+package filclient
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	bsclient "github.com/ipfs/go-bitswap/client"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	exchange "github.com/ipfs/go-ipfs-exchange-interface"
+	dagpb "github.com/ipld/go-codec-dagpb"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/linking"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/ipld/go-ipld-prime/traversal"
+	"github.com/ipld/go-ipld-prime/traversal/selector"
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	_ "github.com/ipld/go-ipld-prime/codec/raw"
+)
+
+// retrievalbitswap.go - retrieval of DAGs from storage providers over bitswap
+
+// Start retrieving a DAG from the provider over bitswap
+//
+// The transfer reports progress and status the same way as a graphsync
+// transfer, but there is no deal for the provider to accept and nothing to pay,
+// and it isn't persisted, so it can't be resumed after a restart
+//
+// Blocks are only requested from the provider, and from the peers it lists as
+// serving bitswap if StartRetrievalTransfer picked the transport
+func (handle *StorageProviderHandle) StartBitswapRetrievalTransfer(
+	ctx context.Context,
+	payloadCid cid.Cid,
+	options ...RetrievalOption,
+) (*RetrievalTransfer, error) {
+	if err := handle.CheckPolicy(ctx); err != nil {
+		return nil, err
+	}
+
+	var cfg RetrievalConfig
+	for _, option := range options {
+		option(&cfg)
+	}
+	cfg.Clean()
+
+	// Blocks are requested by CID alone, so there's no way to say which piece
+	// they should come from
+	if cfg.pieceCid != nil {
+		return nil, fmt.Errorf("%w: %s", ErrRetrievalPieceNotSupported, RetrievalTransportBitswap)
+	}
+
+	sel, err := selector.CompileSelector(cfg.selector)
+	if err != nil {
+		return nil, err
+	}
+
+	blockWriter, err := newRetrievalBlockWriter(handle.client.bs, payloadCid, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	peerID, err := handle.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Bitswap has no way to tell the size up front, so it's only known if an
+	// ask was supplied
+	var size uint64
+	if cfg.ask != nil {
+		size = cfg.ask.Size
+	}
+
+	transferCtx, cancel := context.WithCancel(context.Background())
+
+	startTime := time.Now()
+	transfer := &RetrievalTransfer{
+		client:      handle.client,
+		status:      RetrievalTransferStatusInProgress,
+		proposal:    retrievalmarket.DealProposal{PayloadCID: payloadCid},
+		transport:   RetrievalTransportBitswap,
+		cancel:      cancel,
+		blockWriter: blockWriter,
+		selector:    cfg.selector,
+		provider:    peerID,
+		size:        size,
+		timeouts:    cfg.timeouts,
+		startTime:   startTime,
+
+		// There is no proposal to accept, so the accept phase is skipped
+		acceptTime: startTime,
+	}
+
+	go transfer.watchTimeouts(context.Background())
+	go transfer.runBitswapRetrieval(transferCtx, sel, append([]peer.ID{peerID}, cfg.bitswapPeers...))
+
+	log.Infof("Bitswap retrieval is running")
+
+	return transfer, nil
+}
+
+func (transfer *RetrievalTransfer) runBitswapRetrieval(ctx context.Context, sel selector.Selector, peers []peer.ID) {
+	err := transfer.walkBitswap(ctx, sel, peers)
+
+	// If the context was cancelled, the transfer was already finished some
+	// other way (e.g. cancelled or timed out)
+	if ctx.Err() != nil {
+		return
+	}
+
+	if err != nil {
+		log.Errorf("Bitswap retrieval failed: %v", err)
+		err = transfer.finish(ctx, RetrievalTransferStatusErrored, ErrRetrievalFailed, err.Error())
+	} else {
+		log.Infof("Bitswap retrieval completed")
+		err = transfer.complete(ctx, "")
+	}
+
+	if err != nil {
+		log.Debugf("Could not finish bitswap retrieval: %v", err)
+	}
+}
+
+// Walks the DAG using the selector, loading each block from the blockstore if
+// it's already there, or otherwise fetching it over bitswap from the peers
+func (transfer *RetrievalTransfer) walkBitswap(ctx context.Context, sel selector.Selector, peers []peer.ID) error {
+	network := transfer.client.newProviderBitswapNetwork(peers)
+	bitswap := bsclient.New(ctx, network, transfer.client.bs)
+	network.Start(bitswap)
+	defer func() {
+		bitswap.Close()
+		network.Stop()
+	}()
+
+	session := bitswap.NewSession(ctx)
+
+	// Blocks may be loaded more than once depending on the selector, but should
+	// only be counted once
+	counted := cid.NewSet()
+
+	lsys := cidlink.DefaultLinkSystem()
+	lsys.StorageReadOpener = func(lctx linking.LinkContext, link datamodel.Link) (io.Reader, error) {
+		cidLink, ok := link.(cidlink.Link)
+		if !ok {
+			return nil, fmt.Errorf("unsupported link type %T", link)
+		}
+
+		block, err := transfer.loadBitswapBlock(lctx.Ctx, session, cidLink.Cid, counted)
+		if err != nil {
+			return nil, err
+		}
+
+		return bytes.NewReader(block.RawData()), nil
+	}
+
+	chooser := dagpb.AddSupportToChooser(basicnode.Chooser)
+
+	rootLink := cidlink.Link{Cid: transfer.proposal.PayloadCID}
+	rootPrototype, err := chooser(rootLink, linking.LinkContext{Ctx: ctx})
+	if err != nil {
+		return err
+	}
+
+	root, err := lsys.Load(linking.LinkContext{Ctx: ctx}, rootLink, rootPrototype)
+	if err != nil {
+		return err
+	}
+
+	progress := traversal.Progress{
+		Cfg: &traversal.Config{
+			Ctx:                            ctx,
+			LinkSystem:                     lsys,
+			LinkTargetNodePrototypeChooser: chooser,
+		},
+	}
+
+	return progress.WalkAdv(root, sel, func(traversal.Progress, datamodel.Node, traversal.VisitReason) error {
+		return nil
+	})
+}
+
+func (transfer *RetrievalTransfer) loadBitswapBlock(
+	ctx context.Context,
+	session exchange.Fetcher,
+	c cid.Cid,
+	counted *cid.Set,
+) (blocks.Block, error) {
+	block, err := transfer.localBlock(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+
+	if block != nil {
+		// Already stored, but still needs to go into the CAR if streaming
+		if transfer.blockWriter != nil {
+			if err := transfer.blockWriter.write(block); err != nil {
+				return nil, err
+			}
+		}
+
+		if counted.Visit(c) {
+			transfer.lk.Lock()
+			transfer.cachedProgress += uint64(len(block.RawData()))
+			transfer.lk.Unlock()
+		}
+
+		return block, nil
+	}
+
+	block, err = session.GetBlock(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := transfer.putBlock(ctx, block); err != nil {
+		return nil, err
+	}
+
+	if counted.Visit(c) {
+		transfer.lk.Lock()
+		transfer.dataReceivedLocked(
+			transfer.retrievalProgress+uint64(len(block.RawData())),
+			transfer.blocksReceived+1,
+		)
+		transfer.lk.Unlock()
+
+		transfer.publish(RetrievalEvent{Code: RetrievalEventProgress})
+	}
+
+	return block, nil
+}
@@ -0,0 +1,112 @@
+package filclient
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/ipfs/go-bitswap"
+	bsnet "github.com/ipfs/go-bitswap/network"
+	"github.com/ipfs/go-merkledag"
+	routinghelpers "github.com/libp2p/go-libp2p-routing-helpers"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBitswapRetrievalTransfer(t *testing.T) {
+	ctx := context.Background()
+
+	mn := mocknet.New()
+	clientHost, err := mn.GenPeer()
+	require.NoError(t, err)
+	providerHost, err := mn.GenPeer()
+	require.NoError(t, err)
+	require.NoError(t, mn.LinkAll())
+
+	// Put a small DAG in the provider's blockstore and serve it over bitswap
+	providerBs := initBlockstore(t)
+	root := merkledag.NodeWithData([]byte("root"))
+	var size uint64
+	for _, data := range []string{"foo", "bar", "baz"} {
+		leaf := merkledag.NewRawNode([]byte(data))
+		require.NoError(t, root.AddNodeLink(data, leaf))
+		require.NoError(t, providerBs.Put(ctx, leaf))
+		size += uint64(len(leaf.RawData()))
+	}
+	require.NoError(t, providerBs.Put(ctx, root))
+	size += uint64(len(root.RawData()))
+
+	provider := bitswap.New(ctx, bsnet.NewFromIpfsHost(providerHost, routinghelpers.Null{}), providerBs)
+	defer provider.Close()
+
+	fc, err := New(ctx, clientHost, nil, address.Undef, initBlockstore(t), initDatastore(t))
+	require.NoError(t, err)
+	defer fc.Close()
+
+	_, err = mn.ConnectPeers(clientHost.ID(), providerHost.ID())
+	require.NoError(t, err)
+
+	transfer, err := fc.StorageProviderByPeerID(providerHost.ID()).StartBitswapRetrievalTransfer(ctx, root.Cid())
+	require.NoError(t, err)
+	require.Equal(t, RetrievalTransportBitswap, transfer.Transport())
+
+	select {
+	case <-transfer.Done():
+	case <-time.After(10 * time.Second):
+		t.Fatal("Bitswap retrieval did not finish")
+	}
+
+	require.NoError(t, transfer.Err())
+	require.Equal(t, RetrievalTransferStatusCompleted, transfer.State())
+	require.Equal(t, size, transfer.Progress())
+
+	has, err := fc.bs.Has(ctx, root.Cid())
+	require.NoError(t, err)
+	require.True(t, has)
+
+	// Everything is in the blockstore now, so a second retrieval should count
+	// it all as cached
+	transfer, err = fc.StorageProviderByPeerID(providerHost.ID()).StartBitswapRetrievalTransfer(ctx, root.Cid())
+	require.NoError(t, err)
+	<-transfer.Done()
+
+	require.Equal(t, RetrievalTransferStatusCompleted, transfer.State())
+	require.Equal(t, size, transfer.cachedProgress)
+	require.Zero(t, transfer.retrievalProgress)
+
+	// Blocks only another connected peer has aren't fetched from it
+	otherHost, err := mn.GenPeer()
+	require.NoError(t, err)
+	require.NoError(t, mn.LinkAll())
+	otherBs := initBlockstore(t)
+	elsewhere := merkledag.NodeWithData([]byte("elsewhere"))
+	otherLeaf := merkledag.NewRawNode([]byte("only elsewhere"))
+	require.NoError(t, elsewhere.AddNodeLink("leaf", otherLeaf))
+	require.NoError(t, otherBs.Put(ctx, otherLeaf))
+	require.NoError(t, otherBs.Put(ctx, elsewhere))
+	require.NoError(t, providerBs.Put(ctx, elsewhere))
+
+	other := bitswap.New(ctx, bsnet.NewFromIpfsHost(otherHost, routinghelpers.Null{}), otherBs)
+	defer other.Close()
+	_, err = mn.ConnectPeers(clientHost.ID(), otherHost.ID())
+	require.NoError(t, err)
+
+	transfer, err = fc.StorageProviderByPeerID(providerHost.ID()).StartBitswapRetrievalTransfer(
+		ctx,
+		elsewhere.Cid(),
+		RetrievalWithTotalTimeout(time.Second),
+	)
+	require.NoError(t, err)
+
+	select {
+	case <-transfer.Done():
+	case <-time.After(10 * time.Second):
+		t.Fatal("Bitswap retrieval did not time out")
+	}
+
+	require.Equal(t, RetrievalTransferStatusErrored, transfer.State())
+	has, err = fc.bs.Has(ctx, otherLeaf.Cid())
+	require.NoError(t, err)
+	require.False(t, has)
+}
@@ -0,0 +1,183 @@
+package filclient
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	bsmsg "github.com/ipfs/go-bitswap/message"
+	bsnet "github.com/ipfs/go-bitswap/network"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// retrievalbitswapnetwork.go - bitswap networks limited to the peers of one
+// storage provider, so that a bitswap retrieval only gets blocks from the
+// provider it was started with
+
+// Hands the messages and connection events of the client's bitswap network to
+// the bitswap clients of the retrievals whose provider they came from
+type bitswapRouter struct {
+	lk     sync.Mutex
+	routes map[*bitswapRoute]struct{}
+}
+
+type bitswapRoute struct {
+	receiver bsnet.Receiver
+	peers    map[peer.ID]struct{}
+}
+
+func newBitswapRouter() *bitswapRouter {
+	return &bitswapRouter{
+		routes: make(map[*bitswapRoute]struct{}),
+	}
+}
+
+// Registers a receiver for events from the peers, until the returned function
+// is called
+func (router *bitswapRouter) register(receiver bsnet.Receiver, peers map[peer.ID]struct{}) func() {
+	route := &bitswapRoute{receiver: receiver, peers: peers}
+
+	router.lk.Lock()
+	router.routes[route] = struct{}{}
+	router.lk.Unlock()
+
+	return func() {
+		router.lk.Lock()
+		delete(router.routes, route)
+		router.lk.Unlock()
+	}
+}
+
+// The receivers registered for the peer - they're called without the lock
+// held, so one that's slow to handle a message doesn't hold up the rest
+func (router *bitswapRouter) receivers(p peer.ID) []bsnet.Receiver {
+	router.lk.Lock()
+	defer router.lk.Unlock()
+
+	var receivers []bsnet.Receiver
+	for route := range router.routes {
+		if _, ok := route.peers[p]; ok {
+			receivers = append(receivers, route.receiver)
+		}
+	}
+
+	return receivers
+}
+
+func (router *bitswapRouter) ReceiveMessage(ctx context.Context, sender peer.ID, incoming bsmsg.BitSwapMessage) {
+	for _, receiver := range router.receivers(sender) {
+		receiver.ReceiveMessage(ctx, sender, incoming)
+	}
+}
+
+func (router *bitswapRouter) ReceiveError(err error) {
+	log.Debugf("Bitswap network error: %v", err)
+}
+
+func (router *bitswapRouter) PeerConnected(p peer.ID) {
+	for _, receiver := range router.receivers(p) {
+		receiver.PeerConnected(p)
+	}
+}
+
+func (router *bitswapRouter) PeerDisconnected(p peer.ID) {
+	for _, receiver := range router.receivers(p) {
+		receiver.PeerDisconnected(p)
+	}
+}
+
+// The client's bitswap network, as seen by a single retrieval - only the
+// provider's peers can be sent to or heard from
+type providerBitswapNetwork struct {
+	bsnet.BitSwapNetwork
+
+	host   host.Host
+	router *bitswapRouter
+	peers  map[peer.ID]struct{}
+
+	lk          sync.Mutex
+	unregisters []func()
+}
+
+func (client *Client) newProviderBitswapNetwork(peers []peer.ID) *providerBitswapNetwork {
+	allowed := make(map[peer.ID]struct{}, len(peers))
+	for _, p := range peers {
+		allowed[p] = struct{}{}
+	}
+
+	return &providerBitswapNetwork{
+		BitSwapNetwork: client.bitswapNetwork,
+		host:           client.host,
+		router:         client.bitswapRouter,
+		peers:          allowed,
+	}
+}
+
+func (net *providerBitswapNetwork) allowed(p peer.ID) error {
+	if _, ok := net.peers[p]; !ok {
+		return fmt.Errorf("peer %s is not serving this bitswap retrieval", p)
+	}
+
+	return nil
+}
+
+// Registers the receivers with the client's bitswap network - peers that are
+// already connected are announced to them straight away, since the network
+// only reports new connections
+func (net *providerBitswapNetwork) Start(receivers ...bsnet.Receiver) {
+	net.lk.Lock()
+	for _, receiver := range receivers {
+		net.unregisters = append(net.unregisters, net.router.register(receiver, net.peers))
+	}
+	net.lk.Unlock()
+
+	for p := range net.peers {
+		if net.host.Network().Connectedness(p) != network.Connected {
+			continue
+		}
+		for _, receiver := range receivers {
+			receiver.PeerConnected(p)
+		}
+	}
+}
+
+// Unregisters the receivers, leaving the client's bitswap network running
+func (net *providerBitswapNetwork) Stop() {
+	net.lk.Lock()
+	defer net.lk.Unlock()
+
+	for _, unregister := range net.unregisters {
+		unregister()
+	}
+	net.unregisters = nil
+}
+
+func (net *providerBitswapNetwork) SendMessage(ctx context.Context, p peer.ID, outgoing bsmsg.BitSwapMessage) error {
+	if err := net.allowed(p); err != nil {
+		return err
+	}
+
+	return net.BitSwapNetwork.SendMessage(ctx, p, outgoing)
+}
+
+func (net *providerBitswapNetwork) NewMessageSender(
+	ctx context.Context,
+	p peer.ID,
+	opts *bsnet.MessageSenderOpts,
+) (bsnet.MessageSender, error) {
+	if err := net.allowed(p); err != nil {
+		return nil, err
+	}
+
+	return net.BitSwapNetwork.NewMessageSender(ctx, p, opts)
+}
+
+func (net *providerBitswapNetwork) ConnectTo(ctx context.Context, p peer.ID) error {
+	if err := net.allowed(p); err != nil {
+		return err
+	}
+
+	return net.BitSwapNetwork.ConnectTo(ctx, p)
+}
@@ -1,12 +1,46 @@
 package filclient
 
 import (
+	"io"
+	"time"
+
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/ipfs/go-cid"
 	"github.com/ipld/go-ipld-prime"
 	selectorparse "github.com/ipld/go-ipld-prime/traversal/selector/parse"
+	"github.com/libp2p/go-libp2p/core/peer"
 )
 
 type RetrievalConfig struct {
 	selector ipld.Node
+	ask      *retrievalmarket.QueryResponse
+	timeouts retrievalTimeouts
+
+	// Only used if transportForced is set, otherwise graphsync is used, or the
+	// transport is picked automatically if transportAuto is set
+	transport       RetrievalTransport
+	transportForced bool
+	transportAuto   bool
+
+	carWriter io.Writer
+	noPersist bool
+
+	// Shared by every attempt of a Client.Retrieve, nil otherwise
+	carOutput *retrievalCAROutput
+
+	// Size of the part of the DAG that's already local, if StartRetrievalTransfer
+	// has already checked - nil if the transport needs to check itself
+	localSize *uint64
+
+	// Peers other than the provider itself that serve its blocks over
+	// bitswap, from the transports query
+	bitswapPeers []peer.ID
+
+	priority        RetrievalPriority
+	onQueuePosition func(int)
+
+	// nil unless the retrieval targets a specific piece
+	pieceCid *cid.Cid
 }
 
 func (cfg *RetrievalConfig) Clean() {
@@ -24,3 +58,108 @@ func RetrievalWithSelector(selector ipld.Node) RetrievalOption {
 		cfg.selector = selector
 	}
 }
+
+// Uses a pre-run retrieval ask result instead of querying the provider again
+// when starting the transfer
+func RetrievalWithAsk(ask retrievalmarket.QueryResponse) RetrievalOption {
+	return func(cfg *RetrievalConfig) {
+		cfg.ask = &ask
+	}
+}
+
+// Sets how long the provider may take to accept the proposal
+func RetrievalWithAcceptTimeout(timeout time.Duration) RetrievalOption {
+	return func(cfg *RetrievalConfig) {
+		cfg.timeouts.accept = timeout
+	}
+}
+
+// Sets how long the provider may take to send the first byte of data
+func RetrievalWithFirstByteTimeout(timeout time.Duration) RetrievalOption {
+	return func(cfg *RetrievalConfig) {
+		cfg.timeouts.firstByte = timeout
+	}
+}
+
+// Sets how long a transfer may go without receiving any data, once data has
+// started arriving, before it is considered stalled
+func RetrievalWithStallTimeout(timeout time.Duration) RetrievalOption {
+	return func(cfg *RetrievalConfig) {
+		cfg.timeouts.stall = timeout
+	}
+}
+
+// Sets how long the whole transfer may take
+func RetrievalWithTotalTimeout(timeout time.Duration) RetrievalOption {
+	return func(cfg *RetrievalConfig) {
+		cfg.timeouts.total = timeout
+	}
+}
+
+// Forces the transport used by StartRetrievalTransfer instead of graphsync
+func RetrievalWithTransport(transport RetrievalTransport) RetrievalOption {
+	return func(cfg *RetrievalConfig) {
+		cfg.transport = transport
+		cfg.transportForced = true
+	}
+}
+
+// Lets StartRetrievalTransfer pick the best transport the provider supports
+// instead of graphsync
+//
+// NOTE: only graphsync transfers are persisted, so a transfer over any other
+// transport can't be resumed after a restart
+func RetrievalWithAutoTransport() RetrievalOption {
+	return func(cfg *RetrievalConfig) {
+		cfg.transportAuto = true
+	}
+}
+
+// Streams the retrieved DAG as a CARv1 to the writer, in traversal order, as
+// the blocks arrive
+//
+// NOTE: a streamed transfer isn't persisted, so it can't be resumed after a
+// restart
+func RetrievalWithCARWriter(w io.Writer) RetrievalOption {
+	return func(cfg *RetrievalConfig) {
+		cfg.carWriter = w
+	}
+}
+
+// Keeps the retrieved blocks out of the client's blockstore, so this is only
+// useful along with RetrievalWithCARWriter
+//
+// NOTE: the traversal still needs to load blocks after they arrive, so they're
+// kept in a temporary blockstore in the system's temp directory until the
+// transfer finishes - there must be room for the whole DAG there
+func RetrievalWithoutPersisting() RetrievalOption {
+	return func(cfg *RetrievalConfig) {
+		cfg.noPersist = true
+	}
+}
+
+// Sets where the retrieval goes in the queue relative to others, if the
+// client's concurrency limits are reached
+func RetrievalWithPriority(priority RetrievalPriority) RetrievalOption {
+	return func(cfg *RetrievalConfig) {
+		cfg.priority = priority
+	}
+}
+
+// Calls the callback with the retrieval's position in the queue (0 for next in
+// line) each time it changes while waiting for a slot
+func RetrievalWithQueuePositionCallback(onQueuePosition func(position int)) RetrievalOption {
+	return func(cfg *RetrievalConfig) {
+		cfg.onQueuePosition = onQueuePosition
+	}
+}
+
+// Targets the piece the payload should be retrieved from, for when it's in
+// more than one (e.g. in aggregated deals) - applies to the retrieval query,
+// and restricts StartRetrievalTransfer to graphsync, since the other transports
+// can't be scoped to a piece and fail with ErrRetrievalPieceNotSupported
+func RetrievalWithPieceCID(pieceCid cid.Cid) RetrievalOption {
+	return func(cfg *RetrievalConfig) {
+		cfg.pieceCid = &pieceCid
+	}
+}
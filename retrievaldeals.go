@@ -0,0 +1,91 @@
+package filclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/builtin/v9/market"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/ipfs/go-cid"
+)
+
+// retrievaldeals.go - retrieval of content by on-chain storage deal ID
+
+var (
+	ErrNoPayloadCidInLabel = errors.New("could not find payload CID in deal label")
+)
+
+// What's needed to retrieve the content of an on-chain storage deal
+type RetrievalDeal struct {
+	DealID abi.DealID
+
+	// Handle for the provider that made the deal
+	Provider *StorageProviderHandle
+
+	PayloadCID cid.Cid
+	PieceCID   cid.Cid
+}
+
+// Looks up the storage deal on chain, and extracts the payload CID from its
+// label
+func (client *Client) LookupRetrievalDeal(ctx context.Context, dealID abi.DealID) (RetrievalDeal, error) {
+	deal, err := client.api.StateMarketStorageDeal(ctx, dealID, types.EmptyTSK)
+	if err != nil {
+		return RetrievalDeal{}, fmt.Errorf("%w: could not look up deal %d: %v", ErrLotusError, dealID, err)
+	}
+
+	payloadCid, err := FindPayloadCid(deal.Proposal)
+	if err != nil {
+		return RetrievalDeal{}, err
+	}
+
+	return RetrievalDeal{
+		DealID:     dealID,
+		Provider:   client.StorageProviderByAddress(deal.Proposal.Provider),
+		PayloadCID: payloadCid,
+		PieceCID:   deal.Proposal.PieceCID,
+	}, nil
+}
+
+// Start retrieving the content of an on-chain storage deal from the provider
+// that made it, scoped to the deal's piece
+func (client *Client) StartRetrievalByDealID(
+	ctx context.Context,
+	dealID abi.DealID,
+	options ...RetrievalOption,
+) (*RetrievalTransfer, error) {
+	deal, err := client.LookupRetrievalDeal(ctx, dealID)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Infof("Retrieving %s in piece %s for deal %d", deal.PayloadCID, deal.PieceCID, dealID)
+
+	options = append(append([]RetrievalOption{}, options...), RetrievalWithPieceCID(deal.PieceCID))
+
+	return deal.Provider.StartRetrievalTransfer(ctx, deal.PayloadCID, options...)
+}
+
+// Finds the payload CID in a storage deal proposal's label - by convention, the
+// label holds the payload CID, possibly among other whitespace-separated
+// tokens, and the first token that parses as a CID is used
+func FindPayloadCid(proposal market.DealProposal) (cid.Cid, error) {
+	labelStr, err := proposal.Label.ToString()
+	if err != nil {
+		return cid.Undef, fmt.Errorf("%w: %v", ErrNoPayloadCidInLabel, err)
+	}
+
+	for _, token := range strings.Fields(labelStr) {
+		payloadCid, err := cid.Parse(token)
+		if err != nil {
+			continue
+		}
+
+		return payloadCid, nil
+	}
+
+	return cid.Undef, fmt.Errorf("%w: '%s'", ErrNoPayloadCidInLabel, labelStr)
+}
@@ -0,0 +1,186 @@
+package filclient
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	cborutil "github.com/filecoin-project/go-cbor-util"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/builtin/v9/market"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/ipfs/go-merkledag"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/codec/dagcbor"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFindPayloadCid(t *testing.T) {
+	payloadCid := merkledag.NewRawNode([]byte("payload")).Cid()
+
+	proposalWithLabel := func(labelStr string) market.DealProposal {
+		label, err := market.NewLabelFromString(labelStr)
+		require.NoError(t, err)
+		return market.DealProposal{Label: label}
+	}
+
+	found, err := FindPayloadCid(proposalWithLabel(payloadCid.String()))
+	require.NoError(t, err)
+	require.Equal(t, payloadCid, found)
+
+	// The first token that parses as a CID is used
+	found, err = FindPayloadCid(proposalWithLabel("  some-tag\t" + payloadCid.String() + " other"))
+	require.NoError(t, err)
+	require.Equal(t, payloadCid, found)
+
+	_, err = FindPayloadCid(proposalWithLabel("no cid here"))
+	require.ErrorIs(t, err, ErrNoPayloadCidInLabel)
+
+	_, err = FindPayloadCid(proposalWithLabel(""))
+	require.ErrorIs(t, err, ErrNoPayloadCidInLabel)
+}
+
+// Answers deal lookups from a fixed set of deals, on top of the miner lookups
+// of testMinerGateway
+type testDealGateway struct {
+	*testMinerGateway
+
+	deals map[abi.DealID]*api.MarketDeal
+}
+
+func (gateway *testDealGateway) StateMarketStorageDeal(
+	ctx context.Context,
+	dealID abi.DealID,
+	tsk types.TipSetKey,
+) (*api.MarketDeal, error) {
+	deal, ok := gateway.deals[dealID]
+	if !ok {
+		return nil, fmt.Errorf("deal %d not found", dealID)
+	}
+	return deal, nil
+}
+
+func TestRetrievalByDealID(t *testing.T) {
+	ctx := context.Background()
+
+	payloadCid := merkledag.NewRawNode([]byte("payload")).Cid()
+	pieceCid := merkledag.NewRawNode([]byte("piece")).Cid()
+
+	mn := mocknet.New()
+	clientHost, err := mn.GenPeer()
+	require.NoError(t, err)
+	providerHost, err := mn.GenPeer()
+	require.NoError(t, err)
+	require.NoError(t, mn.LinkAll())
+
+	providerAddr, err := address.NewIDAddress(1000)
+	require.NoError(t, err)
+
+	dealWithLabel := func(labelStr string) *api.MarketDeal {
+		label, err := market.NewLabelFromString(labelStr)
+		require.NoError(t, err)
+		return &api.MarketDeal{Proposal: market.DealProposal{
+			PieceCID: pieceCid,
+			Provider: providerAddr,
+			Label:    label,
+		}}
+	}
+
+	gateway := &testDealGateway{
+		testMinerGateway: &testMinerGateway{miners: map[address.Address]peer.ID{
+			providerAddr: providerHost.ID(),
+		}},
+		deals: map[abi.DealID]*api.MarketDeal{
+			1: dealWithLabel("payload " + payloadCid.String()),
+			2: dealWithLabel("no cid here"),
+		},
+	}
+
+	fc, err := New(ctx, clientHost, gateway, address.Undef, initBlockstore(t), initDatastore(t))
+	require.NoError(t, err)
+	t.Cleanup(fc.Close)
+
+	_, err = mn.ConnectPeers(clientHost.ID(), providerHost.ID())
+	require.NoError(t, err)
+
+	// The provider offers every transport, but only graphsync can be scoped to
+	// the piece
+	transports := retrievalTransportsResponse{Protocols: []retrievalTransportsProtocol{
+		{Name: "http", Addresses: [][]byte{multiaddr.StringCast("/ip4/127.0.0.1/tcp/80/http").Bytes()}},
+		{Name: "bitswap"},
+		{Name: "libp2p"},
+	}}
+	// Failures in the handlers surface as errors on the client's side, and
+	// what the provider was sent is checked below
+	providerHost.SetStreamHandler(retrievalTransportsProtocolID, func(stream network.Stream) {
+		defer stream.Close()
+		ipld.MarshalStreaming(stream, dagcbor.Encode, &transports, retrievalTransportsResponseType)
+	})
+
+	queries := make(chan retrievalmarket.Query, 1)
+	providerHost.SetStreamHandler(retrievalmarket.QueryProtocolID, func(stream network.Stream) {
+		defer stream.Close()
+
+		var query retrievalmarket.Query
+		if err := cborutil.ReadCborRPC(stream, &query); err != nil {
+			stream.Reset()
+			return
+		}
+		queries <- query
+
+		resp := retrievalmarket.QueryResponse{
+			Status:        retrievalmarket.QueryResponseAvailable,
+			PieceCIDFound: retrievalmarket.QueryItemAvailable,
+			Size:          1024,
+		}
+		resp.PaymentAddress = providerAddr
+		cborutil.WriteCborRPC(stream, &resp)
+	})
+
+	deal, err := fc.LookupRetrievalDeal(ctx, 1)
+	require.NoError(t, err)
+	require.Equal(t, payloadCid, deal.PayloadCID)
+	require.Equal(t, pieceCid, deal.PieceCID)
+	dealProviderAddr, err := deal.Provider.Address(ctx)
+	require.NoError(t, err)
+	require.Equal(t, providerAddr, dealProviderAddr)
+
+	_, err = fc.LookupRetrievalDeal(ctx, 2)
+	require.ErrorIs(t, err, ErrNoPayloadCidInLabel)
+
+	_, err = fc.LookupRetrievalDeal(ctx, 3)
+	require.ErrorIs(t, err, ErrLotusError)
+
+	_, err = fc.StartRetrievalByDealID(ctx, 3)
+	require.ErrorIs(t, err, ErrLotusError)
+
+	// The piece goes into both the query and the proposal
+	transfer, err := fc.StartRetrievalByDealID(ctx, 1)
+	require.NoError(t, err)
+
+	// The provider never answers over graphsync, so closing the channel can
+	// only time out
+	defer func() {
+		ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+		defer cancel()
+		transfer.Cancel(ctx)
+	}()
+
+	query := <-queries
+	require.Equal(t, payloadCid, query.PayloadCID)
+	require.NotNil(t, query.PieceCID)
+	require.Equal(t, pieceCid, *query.PieceCID)
+
+	require.Equal(t, RetrievalTransportGraphsync, transfer.Transport())
+	require.Equal(t, payloadCid, transfer.proposal.PayloadCID)
+	require.NotNil(t, transfer.proposal.PieceCID)
+	require.Equal(t, pieceCid, *transfer.proposal.PieceCID)
+}
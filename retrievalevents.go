@@ -0,0 +1,156 @@
+package filclient
+
+import (
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/go-state-types/abi"
+)
+
+// retrievalevents.go - typed notifications about retrieval transfer activity
+
+type RetrievalEventCode uint
+
+const (
+	// The provider accepted the retrieval proposal
+	RetrievalEventAccepted RetrievalEventCode = iota
+
+	// The provider rejected the retrieval proposal - Message holds the reason
+	RetrievalEventRejected
+
+	// The provider requires a payment to continue - Payment holds the amount
+	RetrievalEventPaymentRequested
+
+	// A payment voucher was sent to the provider - Payment holds the amount
+	RetrievalEventPaymentSent
+
+	// More data was received - Progress holds the total bytes so far
+	RetrievalEventProgress
+
+	// The provider is unsealing the data
+	RetrievalEventUnsealing
+
+	// All data was received
+	RetrievalEventCompleted
+
+	// The transfer failed - Message holds the reason, and Err() on the transfer
+	// tells what kind of failure it was
+	RetrievalEventErrored
+
+	// The transfer was stopped by the client
+	RetrievalEventCancelled
+)
+
+func (code RetrievalEventCode) String() string {
+	switch code {
+	case RetrievalEventAccepted:
+		return "accepted"
+	case RetrievalEventRejected:
+		return "rejected"
+	case RetrievalEventPaymentRequested:
+		return "payment requested"
+	case RetrievalEventPaymentSent:
+		return "payment sent"
+	case RetrievalEventProgress:
+		return "progress"
+	case RetrievalEventUnsealing:
+		return "unsealing"
+	case RetrievalEventCompleted:
+		return "completed"
+	case RetrievalEventErrored:
+		return "errored"
+	case RetrievalEventCancelled:
+		return "cancelled"
+	default:
+		return "unknown"
+	}
+}
+
+type RetrievalEvent struct {
+	Code     RetrievalEventCode
+	Transfer *RetrievalTransfer
+	Time     time.Time
+
+	// Message from the provider or the data transfer channel, if any
+	Message string
+
+	// Total bytes retrieved so far, including bytes that were already cached
+	Progress uint64
+
+	// The amount requested or sent, set for payment events
+	Payment abi.TokenAmount
+}
+
+// Called for each retrieval event - subscribers are called synchronously from
+// the transfer event loop, so they should return quickly and must not cancel
+// the transfer directly
+type RetrievalSubscriber func(event RetrievalEvent)
+
+type RetrievalUnsubscribe func()
+
+// An ordered list of subscribers that may be added and removed concurrently
+type retrievalSubscribers struct {
+	lk      sync.Mutex
+	nextID  uint64
+	entries []retrievalSubscriberEntry
+}
+
+type retrievalSubscriberEntry struct {
+	id         uint64
+	subscriber RetrievalSubscriber
+}
+
+func (subscribers *retrievalSubscribers) add(subscriber RetrievalSubscriber) RetrievalUnsubscribe {
+	subscribers.lk.Lock()
+	defer subscribers.lk.Unlock()
+
+	id := subscribers.nextID
+	subscribers.nextID++
+	subscribers.entries = append(subscribers.entries, retrievalSubscriberEntry{
+		id:         id,
+		subscriber: subscriber,
+	})
+
+	return func() {
+		subscribers.lk.Lock()
+		defer subscribers.lk.Unlock()
+
+		for i, entry := range subscribers.entries {
+			if entry.id == id {
+				subscribers.entries = append(subscribers.entries[:i:i], subscribers.entries[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+func (subscribers *retrievalSubscribers) publish(event RetrievalEvent) {
+	subscribers.lk.Lock()
+	entries := subscribers.entries
+	subscribers.lk.Unlock()
+
+	for _, entry := range entries {
+		entry.subscriber(event)
+	}
+}
+
+// Subscribes to events from all retrieval transfers run by the client
+func (client *Client) SubscribeToRetrievalEvents(subscriber RetrievalSubscriber) RetrievalUnsubscribe {
+	return client.retrievalSubscribers.add(subscriber)
+}
+
+// Subscribes to events from this transfer only
+func (transfer *RetrievalTransfer) Subscribe(subscriber RetrievalSubscriber) RetrievalUnsubscribe {
+	return transfer.subscribers.add(subscriber)
+}
+
+// Sends an event to the transfer's subscribers and then the client's
+// subscribers - the transfer lock must not be held
+func (transfer *RetrievalTransfer) publish(event RetrievalEvent) {
+	event.Transfer = transfer
+	event.Time = time.Now()
+	event.Progress = transfer.Progress()
+
+	transfer.subscribers.publish(event)
+	transfer.client.retrievalSubscribers.publish(event)
+}
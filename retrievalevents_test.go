@@ -0,0 +1,56 @@
+package filclient
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetrievalTransferEvents(t *testing.T) {
+	ctx := context.TODO()
+	client, miner, _, fc, closer := initEnsemble(t, ctx)
+	defer closer()
+
+	importRes := genDummyDeal(ctx, t, client, miner)
+
+	var lk sync.Mutex
+	var codes []RetrievalEventCode
+	unsubscribe := fc.SubscribeToRetrievalEvents(func(event RetrievalEvent) {
+		lk.Lock()
+		defer lk.Unlock()
+		fmt.Printf("Retrieval event: %s (%d bytes)\n", event.Code, event.Progress)
+		codes = append(codes, event.Code)
+	})
+	defer unsubscribe()
+
+	transfer, err := fc.StorageProviderByAddress(miner.ActorAddr).StartRetrievalTransfer(ctx, importRes.Root)
+	require.NoError(t, err)
+	<-transfer.Done()
+
+	lk.Lock()
+	defer lk.Unlock()
+	require.Contains(t, codes, RetrievalEventAccepted)
+	require.Contains(t, codes, RetrievalEventProgress)
+	require.Equal(t, RetrievalEventCompleted, codes[len(codes)-1])
+}
+
+func TestRetrievalSubscribers(t *testing.T) {
+	var subscribers retrievalSubscribers
+
+	var received []string
+	unsubscribeA := subscribers.add(func(event RetrievalEvent) {
+		received = append(received, "a:"+event.Code.String())
+	})
+	subscribers.add(func(event RetrievalEvent) {
+		received = append(received, "b:"+event.Code.String())
+	})
+
+	subscribers.publish(RetrievalEvent{Code: RetrievalEventAccepted})
+	unsubscribeA()
+	subscribers.publish(RetrievalEvent{Code: RetrievalEventCompleted})
+
+	require.Equal(t, []string{"a:accepted", "b:accepted", "b:completed"}, received)
+}
@@ -0,0 +1,335 @@
+package filclient
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// retrievalhistory.go - a record of past retrieval attempts, and per-provider
+// statistics built from it
+
+var retrievalHistoryKey = datastore.NewKey("/Retrieval/History")
+
+// Tells apart attempts that finish in the same nanosecond
+var retrievalHistorySeq uint64
+
+// The outcome of one retrieval from a provider
+type RetrievalAttempt struct {
+	Provider   peer.ID
+	PayloadCID cid.Cid
+	Transport  RetrievalTransport
+	Status     RetrievalTransferStatus
+
+	// Bytes received from the provider, not counting what was already in the
+	// blockstore
+	Bytes uint64
+
+	StartedAt  time.Time
+	FinishedAt time.Time
+
+	// From the original start of the transfer, even if it was resumed after a
+	// restart - zero only for transfers persisted before start times were
+	// kept
+	Duration time.Duration
+
+	// Zero if no data was received
+	TimeToFirstByte time.Duration
+
+	// Which of the ErrRetrieval* errors the attempt ended with, empty if it
+	// completed
+	ErrorKind string
+
+	// The proposal's unseal price plus its price per byte for the bytes
+	// received
+	PricePaid abi.TokenAmount
+}
+
+// Bytes per second received while the attempt was running, or 0 if that's not
+// known
+func (attempt *RetrievalAttempt) Throughput() float64 {
+	if attempt.Duration <= 0 {
+		return 0
+	}
+	return float64(attempt.Bytes) / attempt.Duration.Seconds()
+}
+
+// Aggregate statistics over the recorded retrieval attempts from a provider -
+// only the most recent ones are kept (see Config.RetrievalHistoryLimit)
+type RetrievalProviderStats struct {
+	Provider peer.ID
+
+	Attempts  int
+	Successes int
+
+	// Number of failed attempts by ErrorKind
+	Failures map[string]int
+
+	// Fraction of attempts that completed, from 0 to 1
+	SuccessRate float64
+
+	// Median bytes per second over completed attempts, 0 if there are none
+	MedianThroughput float64
+
+	// Median over attempts that received any data, 0 if there are none
+	MedianTimeToFirstByte time.Duration
+
+	TotalBytes     uint64
+	TotalPricePaid abi.TokenAmount
+
+	LastAttempt time.Time
+	LastSuccess time.Time
+}
+
+func retrievalHistoryProviderKey(provider peer.ID) datastore.Key {
+	return retrievalHistoryKey.ChildString(provider.String())
+}
+
+// Attempts sort by when they finished within each provider's namespace
+func retrievalHistoryAttemptKey(attempt *RetrievalAttempt) datastore.Key {
+	seq := atomic.AddUint64(&retrievalHistorySeq, 1)
+	return retrievalHistoryProviderKey(attempt.Provider).
+		ChildString(fmt.Sprintf("%020d-%d", attempt.FinishedAt.UnixNano(), seq))
+}
+
+// Builds the history entry for a transfer that just finished - the transfer
+// lock must be held
+//
+// Returns nil for transfers that didn't involve a provider
+func (transfer *RetrievalTransfer) attemptLocked(finishedAt time.Time) *RetrievalAttempt {
+	if transfer.transport == RetrievalTransportLocal || transfer.provider == "" {
+		return nil
+	}
+
+	attempt := &RetrievalAttempt{
+		Provider:   transfer.provider,
+		PayloadCID: transfer.proposal.PayloadCID,
+		Transport:  transfer.transport,
+		Status:     transfer.status,
+		Bytes:      transfer.retrievalProgress,
+		StartedAt:  transfer.startTime,
+		FinishedAt: finishedAt,
+		PricePaid:  big.Zero(),
+	}
+
+	if !transfer.startTime.IsZero() {
+		attempt.Duration = finishedAt.Sub(transfer.startTime)
+		if !transfer.firstByteTime.IsZero() {
+			attempt.TimeToFirstByte = transfer.firstByteTime.Sub(transfer.startTime)
+		}
+	}
+
+	if transfer.errKind != nil {
+		attempt.ErrorKind = transfer.errKind.Error()
+	}
+
+	params := transfer.proposal.Params
+	if !params.UnsealPrice.Nil() {
+		attempt.PricePaid = big.Add(attempt.PricePaid, params.UnsealPrice)
+	}
+	if !params.PricePerByte.Nil() {
+		attempt.PricePaid = big.Add(
+			attempt.PricePaid,
+			big.Mul(params.PricePerByte, big.NewIntUnsigned(attempt.Bytes)),
+		)
+	}
+
+	return attempt
+}
+
+func (client *Client) recordRetrievalAttempt(ctx context.Context, attempt *RetrievalAttempt) error {
+	data, err := json.Marshal(attempt)
+	if err != nil {
+		return err
+	}
+
+	if err := client.ds.Put(ctx, retrievalHistoryAttemptKey(attempt), data); err != nil {
+		return err
+	}
+
+	return client.pruneRetrievalHistory(ctx, attempt.Provider)
+}
+
+// Drops the provider's oldest attempts beyond the history limit
+func (client *Client) pruneRetrievalHistory(ctx context.Context, provider peer.ID) error {
+	if client.retrievalHistoryLimit < 0 {
+		return nil
+	}
+
+	results, err := client.ds.Query(ctx, query.Query{
+		Prefix:   retrievalHistoryProviderKey(provider).String(),
+		KeysOnly: true,
+	})
+	if err != nil {
+		return err
+	}
+	entries, err := results.Rest()
+	if err != nil {
+		return err
+	}
+
+	if len(entries) <= client.retrievalHistoryLimit {
+		return nil
+	}
+
+	keys := make([]string, len(entries))
+	for i, entry := range entries {
+		keys[i] = entry.Key
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys[:len(keys)-client.retrievalHistoryLimit] {
+		if err := client.ds.Delete(ctx, datastore.NewKey(key)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Lists the recorded retrieval attempts from the provider, oldest first - if
+// provider is empty, attempts from all providers are listed. Only each
+// provider's most recent attempts are kept (see Config.RetrievalHistoryLimit)
+func (client *Client) RetrievalHistory(ctx context.Context, provider peer.ID) ([]RetrievalAttempt, error) {
+	prefix := retrievalHistoryKey
+	if provider != "" {
+		prefix = retrievalHistoryProviderKey(provider)
+	}
+
+	results, err := client.ds.Query(ctx, query.Query{Prefix: prefix.String()})
+	if err != nil {
+		return nil, err
+	}
+	defer results.Close()
+
+	var attempts []RetrievalAttempt
+	for result := range results.Next() {
+		if result.Error != nil {
+			return nil, result.Error
+		}
+
+		var attempt RetrievalAttempt
+		if err := json.Unmarshal(result.Value, &attempt); err != nil {
+			log.Errorf("Skipping unreadable retrieval attempt %s: %v", result.Key, err)
+			continue
+		}
+
+		attempts = append(attempts, attempt)
+	}
+
+	sort.SliceStable(attempts, func(i, j int) bool {
+		return attempts[i].FinishedAt.Before(attempts[j].FinishedAt)
+	})
+
+	return attempts, nil
+}
+
+// Aggregates the recorded retrieval attempts from the provider
+func (client *Client) RetrievalProviderStats(ctx context.Context, provider peer.ID) (RetrievalProviderStats, error) {
+	attempts, err := client.RetrievalHistory(ctx, provider)
+	if err != nil {
+		return RetrievalProviderStats{}, err
+	}
+
+	return aggregateRetrievalAttempts(provider, attempts), nil
+}
+
+// Aggregates the recorded retrieval attempts of every provider that has any,
+// ordered by provider
+func (client *Client) AllRetrievalProviderStats(ctx context.Context) ([]RetrievalProviderStats, error) {
+	attempts, err := client.RetrievalHistory(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	byProvider := make(map[peer.ID][]RetrievalAttempt)
+	for _, attempt := range attempts {
+		byProvider[attempt.Provider] = append(byProvider[attempt.Provider], attempt)
+	}
+
+	var stats []RetrievalProviderStats
+	for provider, attempts := range byProvider {
+		stats = append(stats, aggregateRetrievalAttempts(provider, attempts))
+	}
+
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Provider < stats[j].Provider
+	})
+
+	return stats, nil
+}
+
+func aggregateRetrievalAttempts(provider peer.ID, attempts []RetrievalAttempt) RetrievalProviderStats {
+	stats := RetrievalProviderStats{
+		Provider:       provider,
+		Failures:       make(map[string]int),
+		TotalPricePaid: big.Zero(),
+	}
+
+	var throughputs []float64
+	// In nanoseconds
+	var timesToFirstByte []float64
+	for _, attempt := range attempts {
+		stats.Attempts++
+		stats.TotalBytes += attempt.Bytes
+		if !attempt.PricePaid.Nil() {
+			stats.TotalPricePaid = big.Add(stats.TotalPricePaid, attempt.PricePaid)
+		}
+
+		if attempt.FinishedAt.After(stats.LastAttempt) {
+			stats.LastAttempt = attempt.FinishedAt
+		}
+
+		if attempt.TimeToFirstByte > 0 {
+			timesToFirstByte = append(timesToFirstByte, float64(attempt.TimeToFirstByte))
+		}
+
+		if attempt.Status != RetrievalTransferStatusCompleted {
+			stats.Failures[attempt.ErrorKind]++
+			continue
+		}
+
+		stats.Successes++
+		if attempt.FinishedAt.After(stats.LastSuccess) {
+			stats.LastSuccess = attempt.FinishedAt
+		}
+		if throughput := attempt.Throughput(); throughput > 0 {
+			throughputs = append(throughputs, throughput)
+		}
+	}
+
+	if stats.Attempts > 0 {
+		stats.SuccessRate = float64(stats.Successes) / float64(stats.Attempts)
+	}
+
+	if len(throughputs) > 0 {
+		sort.Float64s(throughputs)
+		stats.MedianThroughput = medianFloat64(throughputs)
+	}
+
+	if len(timesToFirstByte) > 0 {
+		sort.Float64s(timesToFirstByte)
+		stats.MedianTimeToFirstByte = time.Duration(medianFloat64(timesToFirstByte))
+	}
+
+	return stats
+}
+
+// Values must be sorted and not empty
+func medianFloat64(values []float64) float64 {
+	mid := len(values) / 2
+	if len(values)%2 == 0 {
+		return (values[mid-1] + values[mid]) / 2
+	}
+	return values[mid]
+}
@@ -0,0 +1,155 @@
+package filclient
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetrievalHistory(t *testing.T) {
+	ctx := context.Background()
+	fc := initStandaloneClient(t, ctx, initDatastore(t))
+
+	payloadCid, err := cid.Parse("bafkqaaa")
+	require.NoError(t, err)
+
+	providerA := test.RandPeerIDFatal(t)
+	providerB := test.RandPeerIDFatal(t)
+
+	// Runs a transfer that received the given bytes over the given time to
+	// its end
+	finish := func(
+		provider peer.ID,
+		bytes uint64,
+		duration time.Duration,
+		timeToFirstByte time.Duration,
+		status RetrievalTransferStatus,
+		errKind error,
+	) {
+		now := time.Now()
+		transfer := &RetrievalTransfer{
+			client:            fc,
+			status:            RetrievalTransferStatusInProgress,
+			provider:          provider,
+			proposal:          retrievalmarket.DealProposal{PayloadCID: payloadCid},
+			transport:         RetrievalTransportBitswap,
+			cancel:            func() {},
+			retrievalProgress: bytes,
+			startTime:         now.Add(-duration),
+		}
+		if timeToFirstByte != 0 {
+			transfer.firstByteTime = transfer.startTime.Add(timeToFirstByte)
+		}
+
+		require.NoError(t, transfer.finish(ctx, status, errKind, ""))
+	}
+
+	finish(providerA, 1000, time.Second, 100*time.Millisecond, RetrievalTransferStatusCompleted, nil)
+	finish(providerA, 3000, time.Second, 300*time.Millisecond, RetrievalTransferStatusCompleted, nil)
+	finish(providerA, 500, time.Second, 200*time.Millisecond, RetrievalTransferStatusErrored, ErrRetrievalStalled)
+	finish(providerA, 0, time.Second, 0, RetrievalTransferStatusErrored, ErrRetrievalTimedOut)
+	finish(providerB, 0, time.Second, 0, RetrievalTransferStatusRejected, ErrRetrievalRejected)
+
+	attempts, err := fc.RetrievalHistory(ctx, providerA)
+	require.NoError(t, err)
+	require.Len(t, attempts, 4)
+	require.Equal(t, payloadCid, attempts[0].PayloadCID)
+	require.Equal(t, RetrievalTransportBitswap, attempts[0].Transport)
+	require.Equal(t, uint64(1000), attempts[0].Bytes)
+	require.Equal(t, 100*time.Millisecond, attempts[0].TimeToFirstByte)
+	require.Equal(t, ErrRetrievalTimedOut.Error(), attempts[3].ErrorKind)
+
+	attempts, err = fc.RetrievalHistory(ctx, "")
+	require.NoError(t, err)
+	require.Len(t, attempts, 5)
+
+	stats, err := fc.RetrievalProviderStats(ctx, providerA)
+	require.NoError(t, err)
+	require.Equal(t, 4, stats.Attempts)
+	require.Equal(t, 2, stats.Successes)
+	require.Equal(t, 0.5, stats.SuccessRate)
+	require.Equal(t, map[string]int{
+		ErrRetrievalStalled.Error():  1,
+		ErrRetrievalTimedOut.Error(): 1,
+	}, stats.Failures)
+	require.Equal(t, uint64(4500), stats.TotalBytes)
+	require.True(t, stats.TotalPricePaid.IsZero())
+
+	// Only completed attempts count towards throughput, but any that got data
+	// count towards time to first byte
+	require.InDelta(t, 2000, stats.MedianThroughput, 10)
+	require.Equal(t, 200*time.Millisecond, stats.MedianTimeToFirstByte)
+
+	allStats, err := fc.AllRetrievalProviderStats(ctx)
+	require.NoError(t, err)
+	require.Len(t, allStats, 2)
+	for _, stats := range allStats {
+		if stats.Provider == providerB {
+			require.Equal(t, 1, stats.Attempts)
+			require.Zero(t, stats.SuccessRate)
+			require.Zero(t, stats.MedianTimeToFirstByte)
+		}
+	}
+
+	// Unseal price plus price per byte for what was received
+	transfer := &RetrievalTransfer{
+		status:            RetrievalTransferStatusCompleted,
+		provider:          providerA,
+		transport:         RetrievalTransportGraphsync,
+		retrievalProgress: 100,
+		proposal: retrievalmarket.DealProposal{
+			Params: retrievalmarket.Params{
+				UnsealPrice:  abi.NewTokenAmount(5),
+				PricePerByte: abi.NewTokenAmount(2),
+			},
+		},
+	}
+	require.Equal(t, big.NewInt(205), transfer.attemptLocked(time.Now()).PricePaid)
+
+	// Local transfers aren't retrievals from a provider
+	transfer.transport = RetrievalTransportLocal
+	require.Nil(t, transfer.attemptLocked(time.Now()))
+}
+
+func TestRetrievalHistoryLimit(t *testing.T) {
+	ctx := context.Background()
+	fc := initStandaloneClient(t, ctx, initDatastore(t), WithRetrievalHistoryLimit(2))
+
+	providerA := test.RandPeerIDFatal(t)
+	providerB := test.RandPeerIDFatal(t)
+
+	start := time.Now()
+	record := func(provider peer.ID, bytes uint64) {
+		require.NoError(t, fc.recordRetrievalAttempt(ctx, &RetrievalAttempt{
+			Provider:   provider,
+			Status:     RetrievalTransferStatusCompleted,
+			Bytes:      bytes,
+			FinishedAt: start.Add(time.Duration(bytes) * time.Second),
+		}))
+	}
+
+	record(providerB, 1)
+	for bytes := uint64(2); bytes <= 5; bytes++ {
+		record(providerA, bytes)
+	}
+
+	// Only the most recent attempts are kept
+	attempts, err := fc.RetrievalHistory(ctx, providerA)
+	require.NoError(t, err)
+	require.Len(t, attempts, 2)
+	require.Equal(t, uint64(4), attempts[0].Bytes)
+	require.Equal(t, uint64(5), attempts[1].Bytes)
+
+	// Per provider, so other providers' attempts stay
+	attempts, err = fc.RetrievalHistory(ctx, providerB)
+	require.NoError(t, err)
+	require.Len(t, attempts, 1)
+}
@@ -0,0 +1,266 @@
+package filclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"time"
+
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/ipfs/go-cid"
+	carv2 "github.com/ipld/go-car/v2"
+)
+
+// retrievalhttp.go - retrieval of CARs and pieces from storage providers over
+// HTTP, as served by Boost and trustless gateways
+
+var (
+	ErrRetrievalSelectorNotSupported = errors.New("retrieval transport does not support selectors")
+)
+
+// Start retrieving a DAG as a CAR from the provider's HTTP endpoint, which
+// must serve /ipfs/{cid}?format=car
+//
+// Every block is verified against its CID before it's written to the
+// blockstore, and the transfer errors with ErrRetrievalBadResponse if anything
+// doesn't match up. Selectors can't be sent over HTTP, so the whole DAG is
+// always retrieved, and neither can a piece CID - use
+// StartHTTPPieceRetrievalTransfer to retrieve from a specific piece
+func (handle *StorageProviderHandle) StartHTTPRetrievalTransfer(
+	ctx context.Context,
+	endpoint string,
+	payloadCid cid.Cid,
+	options ...RetrievalOption,
+) (*RetrievalTransfer, error) {
+	reqURL, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	reqURL.Path = path.Join(reqURL.Path, "ipfs", payloadCid.String())
+	reqURL.RawQuery = url.Values{"format": {"car"}}.Encode()
+
+	return handle.startHTTPRetrievalTransfer(
+		ctx,
+		reqURL.String(),
+		retrievalmarket.DealProposal{PayloadCID: payloadCid},
+		options,
+	)
+}
+
+// Start retrieving a whole piece from the provider's HTTP endpoint, which must
+// serve /piece/{pieceCid}
+//
+// The piece is read as a CAR, so the same verification applies as for
+// StartHTTPRetrievalTransfer, except that any root is accepted since the
+// payload CID isn't known up front
+func (handle *StorageProviderHandle) StartHTTPPieceRetrievalTransfer(
+	ctx context.Context,
+	endpoint string,
+	pieceCid cid.Cid,
+	options ...RetrievalOption,
+) (*RetrievalTransfer, error) {
+	reqURL, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	reqURL.Path = path.Join(reqURL.Path, "piece", pieceCid.String())
+
+	return handle.startHTTPRetrievalTransfer(
+		ctx,
+		reqURL.String(),
+		retrievalmarket.DealProposal{Params: retrievalmarket.Params{PieceCID: &pieceCid}},
+		options,
+	)
+}
+
+func (handle *StorageProviderHandle) startHTTPRetrievalTransfer(
+	ctx context.Context,
+	reqURL string,
+	proposal retrievalmarket.DealProposal,
+	options []RetrievalOption,
+) (*RetrievalTransfer, error) {
+	if err := handle.CheckPolicy(ctx); err != nil {
+		return nil, err
+	}
+
+	var cfg RetrievalConfig
+	for _, option := range options {
+		option(&cfg)
+	}
+
+	if cfg.selector != nil {
+		return nil, fmt.Errorf("%w: %s", ErrRetrievalSelectorNotSupported, RetrievalTransportHTTP)
+	}
+
+	// Only a piece retrieval is scoped to a piece, and only to its own
+	if cfg.pieceCid != nil && (proposal.PieceCID == nil || !proposal.PieceCID.Equals(*cfg.pieceCid)) {
+		return nil, fmt.Errorf("%w: %s", ErrRetrievalPieceNotSupported, RetrievalTransportHTTP)
+	}
+
+	cfg.Clean()
+
+	// Pieces have no payload CID, so the CAR roots get filled in from the
+	// response
+	blockWriter, err := newRetrievalBlockWriter(handle.client.bs, proposal.PayloadCID, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	peerID, err := handle.PeerID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var size uint64
+	if cfg.ask != nil {
+		size = cfg.ask.Size
+	}
+
+	transferCtx, cancel := context.WithCancel(context.Background())
+
+	transfer := &RetrievalTransfer{
+		client:      handle.client,
+		status:      RetrievalTransferStatusInProgress,
+		proposal:    proposal,
+		transport:   RetrievalTransportHTTP,
+		cancel:      cancel,
+		blockWriter: blockWriter,
+		selector:    cfg.selector,
+		provider:    peerID,
+		size:        size,
+		timeouts:    cfg.timeouts,
+		startTime:   time.Now(),
+	}
+
+	go transfer.watchTimeouts(context.Background())
+	go transfer.runHTTPRetrieval(transferCtx, reqURL)
+
+	log.Infof("HTTP retrieval is running: %s", reqURL)
+
+	return transfer, nil
+}
+
+func (transfer *RetrievalTransfer) runHTTPRetrieval(ctx context.Context, reqURL string) {
+	message, errKind := transfer.fetchHTTP(ctx, reqURL)
+
+	// If the context was cancelled, the transfer was already finished some
+	// other way (e.g. cancelled or timed out)
+	if ctx.Err() != nil {
+		return
+	}
+
+	var err error
+	switch errKind {
+	case nil:
+		log.Infof("HTTP retrieval completed")
+		err = transfer.complete(ctx, message)
+	case ErrRetrievalRejected:
+		log.Errorf("HTTP retrieval rejected: %s", message)
+		err = transfer.finish(ctx, RetrievalTransferStatusRejected, errKind, message)
+	default:
+		log.Errorf("HTTP retrieval failed: %v: %s", errKind, message)
+		err = transfer.finish(ctx, RetrievalTransferStatusErrored, errKind, message)
+	}
+
+	if err != nil {
+		log.Debugf("Could not finish HTTP retrieval: %v", err)
+	}
+}
+
+// Runs the request and writes the blocks in the response to the blockstore,
+// returning the message and error kind to finish the transfer with - the error
+// kind is nil if it completed
+func (transfer *RetrievalTransfer) fetchHTTP(ctx context.Context, reqURL string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqURL, nil)
+	if err != nil {
+		return err.Error(), ErrRetrievalFailed
+	}
+	req.Header.Set("Accept", "application/vnd.ipld.car")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err.Error(), ErrRetrievalFailed
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+	case resp.StatusCode >= http.StatusInternalServerError:
+		return resp.Status, ErrRetrievalProviderErrored
+	default:
+		return resp.Status, ErrRetrievalRejected
+	}
+
+	transfer.lk.Lock()
+	transfer.acceptTime = time.Now()
+	transfer.lk.Unlock()
+	transfer.publish(RetrievalEvent{Code: RetrievalEventAccepted, Message: resp.Status})
+
+	// Pieces are padded with zeroes after the CAR data
+	reader, err := carv2.NewBlockReader(resp.Body, carv2.ZeroLengthSectionAsEOF(true))
+	if err != nil {
+		return fmt.Sprintf("could not read CAR header: %v", err), ErrRetrievalBadResponse
+	}
+
+	payloadCid := transfer.proposal.PayloadCID
+	if payloadCid.Defined() && !cidsContain(reader.Roots, payloadCid) {
+		return fmt.Sprintf("CAR roots %v do not include %s", reader.Roots, payloadCid), ErrRetrievalBadResponse
+	}
+
+	if transfer.blockWriter != nil && !payloadCid.Defined() {
+		transfer.blockWriter.setRoots(reader.Roots)
+	}
+
+	// Blocks may be repeated in the CAR, but should only be counted once
+	counted := cid.NewSet()
+	sawRoot := false
+
+	for {
+		// The block reader checks each block against its CID
+		block, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Sprintf("could not read CAR block: %v", err), ErrRetrievalBadResponse
+		}
+
+		if err := transfer.putBlock(ctx, block); err != nil {
+			return err.Error(), ErrRetrievalFailed
+		}
+
+		if block.Cid().Equals(payloadCid) {
+			sawRoot = true
+		}
+
+		if counted.Visit(block.Cid()) {
+			transfer.lk.Lock()
+			transfer.dataReceivedLocked(
+				transfer.retrievalProgress+uint64(len(block.RawData())),
+				transfer.blocksReceived+1,
+			)
+			transfer.lk.Unlock()
+
+			transfer.publish(RetrievalEvent{Code: RetrievalEventProgress})
+		}
+	}
+
+	if payloadCid.Defined() && !sawRoot {
+		return fmt.Sprintf("CAR did not include root block %s", payloadCid), ErrRetrievalBadResponse
+	}
+
+	return "", nil
+}
+
+func cidsContain(cids []cid.Cid, c cid.Cid) bool {
+	for _, other := range cids {
+		if other.Equals(c) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,180 @@
+package filclient
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	offline "github.com/ipfs/go-ipfs-exchange-offline"
+	"github.com/ipfs/go-merkledag"
+	"github.com/ipld/go-car"
+	carutil "github.com/ipld/go-car/util"
+	selectorparse "github.com/ipld/go-ipld-prime/traversal/selector/parse"
+	"github.com/libp2p/go-libp2p/core/test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTTPRetrievalTransfer(t *testing.T) {
+	ctx := context.Background()
+
+	root, size, carData := testHTTPRetrievalCAR(t)
+	other, _, _ := testHTTPRetrievalCAR(t)
+
+	// Flip a byte in one of the leaves so it no longer matches its CID
+	tampered := bytes.Replace(carData, []byte("leaf foo"), []byte("leaf fox"), 1)
+	require.NotEqual(t, carData, tampered)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ipfs/", func(w http.ResponseWriter, r *http.Request) {
+		// Fails the transfer, so that it's caught by the checks below
+		if r.URL.Query().Get("format") != "car" {
+			http.Error(w, "only CAR responses are served", http.StatusBadRequest)
+			return
+		}
+
+		switch r.URL.Path {
+		case "/ipfs/" + root.String():
+			w.Write(carData)
+		case "/ipfs/" + other.String():
+			// Serve the wrong DAG
+			w.Write(carData)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	mux.HandleFunc("/tampered/ipfs/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(tampered)
+	})
+	// A DAG with one of its leaves left out of the CAR
+	incompleteRoot := merkledag.NodeWithData([]byte("incomplete"))
+	presentLeaf := merkledag.NewRawNode([]byte("incomplete leaf foo"))
+	require.NoError(t, incompleteRoot.AddNodeLink("foo", presentLeaf))
+	require.NoError(t, incompleteRoot.AddNodeLink("bar", merkledag.NewRawNode([]byte("incomplete leaf bar"))))
+	var incomplete bytes.Buffer
+	require.NoError(t, car.WriteHeader(&car.CarHeader{Roots: []cid.Cid{incompleteRoot.Cid()}, Version: 1}, &incomplete))
+	require.NoError(t, carutil.LdWrite(&incomplete, incompleteRoot.Cid().Bytes(), incompleteRoot.RawData()))
+	require.NoError(t, carutil.LdWrite(&incomplete, presentLeaf.Cid().Bytes(), presentLeaf.RawData()))
+	mux.HandleFunc("/incomplete/ipfs/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(incomplete.Bytes())
+	})
+	mux.HandleFunc("/piece/", func(w http.ResponseWriter, r *http.Request) {
+		// Pieces are zero-padded after the CAR data
+		w.Write(append(carData, make([]byte, 128)...))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	fc := initStandaloneClient(t, ctx, initDatastore(t))
+	handle := fc.StorageProviderByPeerID(test.RandPeerIDFatal(t))
+
+	missing := merkledag.NewRawNode([]byte("missing")).Cid()
+
+	wait := func(transfer *RetrievalTransfer) {
+		select {
+		case <-transfer.Done():
+		case <-time.After(10 * time.Second):
+			t.Fatal("HTTP retrieval did not finish")
+		}
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		transfer, err := handle.StartHTTPRetrievalTransfer(ctx, server.URL, root)
+		require.NoError(t, err)
+		require.Equal(t, RetrievalTransportHTTP, transfer.Transport())
+		wait(transfer)
+
+		require.NoError(t, transfer.Err())
+		require.Equal(t, RetrievalTransferStatusCompleted, transfer.State())
+		require.Equal(t, size, transfer.Progress())
+
+		has, err := fc.bs.Has(ctx, root)
+		require.NoError(t, err)
+		require.True(t, has)
+	})
+
+	t.Run("piece", func(t *testing.T) {
+		transfer, err := handle.StartHTTPPieceRetrievalTransfer(ctx, server.URL, missing)
+		require.NoError(t, err)
+		wait(transfer)
+
+		require.NoError(t, transfer.Err())
+		require.Equal(t, size, transfer.Progress())
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		transfer, err := handle.StartHTTPRetrievalTransfer(ctx, server.URL, missing)
+		require.NoError(t, err)
+		wait(transfer)
+
+		require.Equal(t, RetrievalTransferStatusRejected, transfer.State())
+		require.ErrorIs(t, transfer.Err(), ErrRetrievalRejected)
+	})
+
+	t.Run("wrong root", func(t *testing.T) {
+		transfer, err := handle.StartHTTPRetrievalTransfer(ctx, server.URL, other)
+		require.NoError(t, err)
+		wait(transfer)
+
+		require.Equal(t, RetrievalTransferStatusErrored, transfer.State())
+		require.ErrorIs(t, transfer.Err(), ErrRetrievalBadResponse)
+	})
+
+	t.Run("tampered block", func(t *testing.T) {
+		transfer, err := handle.StartHTTPRetrievalTransfer(ctx, server.URL+"/tampered", root)
+		require.NoError(t, err)
+		wait(transfer)
+
+		require.Equal(t, RetrievalTransferStatusErrored, transfer.State())
+		require.ErrorIs(t, transfer.Err(), ErrRetrievalBadResponse)
+	})
+
+	t.Run("incomplete", func(t *testing.T) {
+		transfer, err := handle.StartHTTPRetrievalTransfer(ctx, server.URL+"/incomplete", incompleteRoot.Cid())
+		require.NoError(t, err)
+		wait(transfer)
+
+		require.Equal(t, RetrievalTransferStatusErrored, transfer.State())
+		require.ErrorIs(t, transfer.Err(), ErrRetrievalIncomplete)
+	})
+
+	t.Run("selector", func(t *testing.T) {
+		_, err := handle.StartHTTPRetrievalTransfer(ctx, server.URL, root, RetrievalWithSelector(selectorparse.CommonSelector_ExploreAllRecursively))
+		require.ErrorIs(t, err, ErrRetrievalSelectorNotSupported)
+	})
+}
+
+// Builds a small random DAG and returns its root, the total size of its
+// blocks, and the DAG as a CAR
+func testHTTPRetrievalCAR(t *testing.T) (cid.Cid, uint64, []byte) {
+	ctx := context.Background()
+
+	bs := blockstore.NewBlockstore(dssync.MutexWrap(datastore.NewMapDatastore()))
+	dag := merkledag.NewDAGService(blockservice.New(bs, offline.Exchange(bs)))
+
+	root := merkledag.NodeWithData([]byte(test.RandPeerIDFatal(t)))
+	for _, name := range []string{"foo", "bar", "baz"} {
+		leaf := merkledag.NewRawNode([]byte("leaf " + name))
+		require.NoError(t, root.AddNodeLink(name, leaf))
+		require.NoError(t, dag.Add(ctx, leaf))
+	}
+	require.NoError(t, dag.Add(ctx, root))
+
+	var size uint64
+	for _, link := range root.Links() {
+		size += link.Size
+	}
+	size += uint64(len(root.RawData()))
+
+	var buf bytes.Buffer
+	require.NoError(t, car.WriteCar(ctx, dag, []cid.Cid{root.Cid()}, &buf))
+
+	return root.Cid(), size, buf.Bytes()
+}
@@ -0,0 +1,131 @@
+package filclient
+
+import (
+	"time"
+)
+
+// retrievalmetrics.go - rate and timing metrics for running retrieval transfers
+
+// How far back the moving average throughput looks
+const retrievalThroughputWindow = 10 * time.Second
+
+// A snapshot of how a retrieval transfer is going
+type RetrievalMetrics struct {
+	StartTime time.Time
+
+	// Zero until the first data arrives
+	TimeToFirstByte time.Duration
+
+	// Bytes per second received from the provider, averaged over the last
+	// several seconds - 0 if nothing was received in that time
+	Throughput float64
+
+	// Time until the transfer reaches its expected size at the current
+	// throughput - only set if ETAKnown is true, which it isn't if the size or
+	// throughput isn't known
+	ETA      time.Duration
+	ETAKnown bool
+
+	// Blocks received from the provider, which for graphsync includes any
+	// sent more than once
+	BlocksReceived uint64
+
+	// Bytes that were already in the blockstore, and bytes received from the
+	// provider
+	CachedBytes    uint64
+	RetrievedBytes uint64
+}
+
+// Progress samples over the throughput window - the first one is the last
+// sample from before the window, if there is one, so that the bytes received
+// since it cover the whole window
+type retrievalThroughput struct {
+	samples []retrievalThroughputSample
+}
+
+type retrievalThroughputSample struct {
+	time  time.Time
+	bytes uint64
+}
+
+func (throughput *retrievalThroughput) add(now time.Time, bytes uint64) {
+	throughput.samples = append(throughput.samples, retrievalThroughputSample{now, bytes})
+	throughput.samples = throughput.windowed(now)
+}
+
+// Bytes per second over the window ending now
+func (throughput *retrievalThroughput) rate(now time.Time) float64 {
+	samples := throughput.windowed(now)
+	if len(samples) < 2 {
+		return 0
+	}
+
+	first := samples[0]
+	last := samples[len(samples)-1]
+
+	elapsed := now.Sub(first.time).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+
+	return float64(last.bytes-first.bytes) / elapsed
+}
+
+func (throughput *retrievalThroughput) windowed(now time.Time) []retrievalThroughputSample {
+	samples := throughput.samples
+	windowStart := now.Add(-retrievalThroughputWindow)
+	for len(samples) >= 2 && !samples[1].time.After(windowStart) {
+		samples = samples[1:]
+	}
+	return samples
+}
+
+// Takes a snapshot of the transfer's metrics
+func (transfer *RetrievalTransfer) Metrics() RetrievalMetrics {
+	transfer.lk.Lock()
+	defer transfer.lk.Unlock()
+
+	now := time.Now()
+
+	metrics := RetrievalMetrics{
+		StartTime:      transfer.startTime,
+		BlocksReceived: transfer.blocksReceived,
+		CachedBytes:    transfer.cachedProgress,
+		RetrievedBytes: transfer.retrievalProgress,
+	}
+
+	if !transfer.firstByteTime.IsZero() && !transfer.startTime.IsZero() {
+		metrics.TimeToFirstByte = transfer.firstByteTime.Sub(transfer.startTime)
+	}
+
+	// Nothing more is coming once the transfer is done
+	if !transfer.status.IsDone() {
+		metrics.Throughput = transfer.throughput.rate(now)
+	}
+
+	progress := transfer.cachedProgress + transfer.retrievalProgress
+	if transfer.status == RetrievalTransferStatusCompleted || (transfer.size != 0 && progress >= transfer.size) {
+		metrics.ETAKnown = true
+	} else if transfer.size != 0 && metrics.Throughput > 0 {
+		remaining := float64(transfer.size - progress)
+		metrics.ETA = time.Duration(remaining / metrics.Throughput * float64(time.Second))
+		metrics.ETAKnown = true
+	}
+
+	return metrics
+}
+
+// Updates the transfer for data received from the provider, given the total
+// bytes and blocks received so far - the transfer lock must be held
+func (transfer *RetrievalTransfer) dataReceivedLocked(received uint64, blocks uint64) {
+	now := time.Now()
+
+	transfer.retrievalProgress = received
+	transfer.blocksReceived = blocks
+	transfer.throughput.add(now, received)
+
+	transfer.lastDataTime = now
+	if transfer.firstByteTime.IsZero() {
+		transfer.firstByteTime = now
+	}
+}
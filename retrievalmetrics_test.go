@@ -0,0 +1,69 @@
+package filclient
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetrievalThroughput(t *testing.T) {
+	start := time.Now()
+	at := func(seconds int) time.Time {
+		return start.Add(time.Duration(seconds) * time.Second)
+	}
+
+	var throughput retrievalThroughput
+	require.Zero(t, throughput.rate(at(0)))
+
+	// A single sample has nothing to compare against
+	throughput.add(at(0), 0)
+	require.Zero(t, throughput.rate(at(1)))
+
+	throughput.add(at(2), 2000)
+	require.InDelta(t, 1000, throughput.rate(at(2)), 0.001)
+
+	// Slowing down shows up once the fast part drops out of the window
+	throughput.add(at(12), 2100)
+	require.InDelta(t, 10, throughput.rate(at(12)), 0.001)
+
+	// A stall decays to zero once the window has passed
+	require.Less(t, throughput.rate(at(17)), throughput.rate(at(12)))
+	require.Zero(t, throughput.rate(at(23)))
+}
+
+func TestRetrievalMetrics(t *testing.T) {
+	now := time.Now()
+
+	transfer := &RetrievalTransfer{
+		status:         RetrievalTransferStatusInProgress,
+		cachedProgress: 1000,
+		size:           11000,
+		startTime:      now.Add(-5 * time.Second),
+	}
+
+	metrics := transfer.Metrics()
+	require.Zero(t, metrics.TimeToFirstByte)
+	require.False(t, metrics.ETAKnown)
+	require.Equal(t, uint64(1000), metrics.CachedBytes)
+
+	// Pretend the data so far arrived over the last couple of seconds
+	transfer.dataReceivedLocked(0, 0)
+	transfer.throughput.samples[0].time = now.Add(-2 * time.Second)
+	transfer.firstByteTime = now.Add(-2 * time.Second)
+	transfer.dataReceivedLocked(5000, 5)
+
+	metrics = transfer.Metrics()
+	require.Equal(t, 3*time.Second, metrics.TimeToFirstByte)
+	require.Equal(t, uint64(5), metrics.BlocksReceived)
+	require.Equal(t, uint64(5000), metrics.RetrievedBytes)
+	require.InDelta(t, 2500, metrics.Throughput, 100)
+	require.True(t, metrics.ETAKnown)
+	require.InDelta(t, 2*time.Second, metrics.ETA, float64(100*time.Millisecond))
+
+	transfer.status = RetrievalTransferStatusCompleted
+	metrics = transfer.Metrics()
+	require.Zero(t, metrics.Throughput)
+	require.True(t, metrics.ETAKnown)
+	require.Zero(t, metrics.ETA)
+}
@@ -0,0 +1,338 @@
+package filclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	datatransfer "github.com/filecoin-project/go-data-transfer"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/codec/dagcbor"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// retrievalrecords.go - persistence of retrieval transfers across restarts
+
+var (
+	ErrRetrievalTransferNotFound = errors.New("retrieval transfer not found")
+)
+
+// How often progress updates are written to the datastore while a transfer is
+// running - status changes are always written immediately
+const retrievalRecordProgressInterval = time.Second
+
+var retrievalTransfersKey = datastore.NewKey("/Retrieval/Transfers")
+
+// The persisted state of a retrieval transfer
+type RetrievalTransferRecord struct {
+	ChannelID datatransfer.ChannelID
+	Provider  peer.ID
+
+	// The proposal also carries the selector used for the retrieval
+	Proposal retrievalmarket.DealProposal `json:"-"`
+
+	Status            RetrievalTransferStatus
+	CachedProgress    uint64
+	RetrievalProgress uint64
+	Size              uint64
+
+	// Why the transfer ended without completing, empty otherwise
+	Error string
+
+	// The phase whose timeout ended the transfer, if one did
+	TimedOutPhase RetrievalTimeoutPhase
+
+	// The timeouts the transfer was started with, so that they still apply
+	// after it's resumed - zero means no limit
+	AcceptTimeout    time.Duration
+	FirstByteTimeout time.Duration
+	StallTimeout     time.Duration
+	TotalTimeout     time.Duration
+
+	// When each phase of the transfer was reached - zero if it wasn't
+	StartedAt   time.Time
+	AcceptedAt  time.Time
+	FirstByteAt time.Time
+
+	// Explanation of the last status change from the provider or channel, if
+	// there is one
+	Message string
+
+	UpdatedAt time.Time
+}
+
+// The selector the retrieval was run with, nil if none was specified
+func (record *RetrievalTransferRecord) Selector() (ipld.Node, error) {
+	if !record.Proposal.Params.SelectorSpecified() {
+		return nil, nil
+	}
+	return ipld.Decode(record.Proposal.Params.Selector.Raw, dagcbor.Decode)
+}
+
+// Encodes the record as JSON, with the proposal embedded in its CBOR form
+func (record *RetrievalTransferRecord) marshal() ([]byte, error) {
+	var proposalBuf bytes.Buffer
+	if err := record.Proposal.MarshalCBOR(&proposalBuf); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(struct {
+		*RetrievalTransferRecord
+		Proposal []byte
+	}{
+		RetrievalTransferRecord: record,
+		Proposal:                proposalBuf.Bytes(),
+	})
+}
+
+func (record *RetrievalTransferRecord) unmarshal(data []byte) error {
+	encoded := struct {
+		*RetrievalTransferRecord
+		Proposal []byte
+	}{
+		RetrievalTransferRecord: record,
+	}
+	if err := json.Unmarshal(data, &encoded); err != nil {
+		return err
+	}
+
+	return record.Proposal.UnmarshalCBOR(bytes.NewReader(encoded.Proposal))
+}
+
+func retrievalTransferRecordKey(chanID datatransfer.ChannelID) datastore.Key {
+	return retrievalTransfersKey.ChildString(chanID.String())
+}
+
+// Writes the current state of the transfer to the datastore - the transfer
+// lock must be held
+//
+// Only graphsync transfers are persisted, since other transports have no
+// channel to resume, and streamed transfers have nowhere to resume streaming to
+func (transfer *RetrievalTransfer) persist(ctx context.Context) error {
+	if transfer.transport != RetrievalTransportGraphsync || transfer.blockWriter != nil {
+		return nil
+	}
+
+	record := RetrievalTransferRecord{
+		ChannelID:         transfer.chanID,
+		Provider:          transfer.provider,
+		Proposal:          transfer.proposal,
+		Status:            transfer.status,
+		CachedProgress:    transfer.cachedProgress,
+		RetrievalProgress: transfer.retrievalProgress,
+		Size:              transfer.size,
+		Message:           transfer.message,
+		TimedOutPhase:     transfer.timedOutPhase,
+		AcceptTimeout:     transfer.timeouts.accept,
+		FirstByteTimeout:  transfer.timeouts.firstByte,
+		StallTimeout:      transfer.timeouts.stall,
+		TotalTimeout:      transfer.timeouts.total,
+		StartedAt:         transfer.startTime,
+		AcceptedAt:        transfer.acceptTime,
+		FirstByteAt:       transfer.firstByteTime,
+		UpdatedAt:         time.Now(),
+	}
+	if transfer.errKind != nil {
+		record.Error = transfer.errKind.Error()
+	}
+
+	data, err := record.marshal()
+	if err != nil {
+		return err
+	}
+
+	if err := transfer.client.ds.Put(ctx, retrievalTransferRecordKey(transfer.chanID), data); err != nil {
+		return err
+	}
+
+	transfer.lastPersisted = record.UpdatedAt
+
+	return nil
+}
+
+// Lists the records of all known retrieval transfers, including finished ones
+func (client *Client) RetrievalTransferRecords(ctx context.Context) ([]RetrievalTransferRecord, error) {
+	results, err := client.ds.Query(ctx, query.Query{Prefix: retrievalTransfersKey.String()})
+	if err != nil {
+		return nil, err
+	}
+	defer results.Close()
+
+	var records []RetrievalTransferRecord
+	for result := range results.Next() {
+		if result.Error != nil {
+			return nil, result.Error
+		}
+
+		var record RetrievalTransferRecord
+		if err := record.unmarshal(result.Value); err != nil {
+			log.Errorf("Skipping unreadable retrieval transfer record %s: %v", result.Key, err)
+			continue
+		}
+
+		records = append(records, record)
+	}
+
+	return records, nil
+}
+
+// Removes the record of a finished retrieval transfer
+func (client *Client) ForgetRetrievalTransfer(ctx context.Context, chanID datatransfer.ChannelID) error {
+	client.retrievalTransfersLk.Lock()
+	_, running := client.retrievalTransfers[chanID]
+	client.retrievalTransfersLk.Unlock()
+
+	if running {
+		return fmt.Errorf("%w: transfer %s is still running", ErrUnexpectedRetrievalTransferState, chanID)
+	}
+
+	return client.ds.Delete(ctx, retrievalTransferRecordKey(chanID))
+}
+
+// Returns a handle to a retrieval transfer by its channel ID - running
+// transfers (including those resumed after a restart) return the live handle,
+// and finished transfers return a read-only handle reflecting their final
+// persisted state
+func (client *Client) ReattachRetrievalTransfer(ctx context.Context, chanID datatransfer.ChannelID) (*RetrievalTransfer, error) {
+	client.retrievalTransfersLk.Lock()
+	transfer, ok := client.retrievalTransfers[chanID]
+	client.retrievalTransfersLk.Unlock()
+
+	if ok {
+		return transfer, nil
+	}
+
+	data, err := client.ds.Get(ctx, retrievalTransferRecordKey(chanID))
+	if err != nil {
+		if errors.Is(err, datastore.ErrNotFound) {
+			return nil, fmt.Errorf("%w: %s", ErrRetrievalTransferNotFound, chanID)
+		}
+		return nil, err
+	}
+
+	var record RetrievalTransferRecord
+	if err := record.unmarshal(data); err != nil {
+		return nil, err
+	}
+
+	return client.retrievalTransferFromRecord(record), nil
+}
+
+func (client *Client) retrievalTransferFromRecord(record RetrievalTransferRecord) *RetrievalTransfer {
+	// Falls back on the whole DAG if there's no selector, or it can't be read
+	selector, err := record.Selector()
+	if err != nil {
+		log.Errorf("Failed to decode selector of retrieval transfer %s: %v", record.ChannelID, err)
+	}
+
+	return &RetrievalTransfer{
+		client:            client,
+		status:            record.Status,
+		provider:          record.Provider,
+		proposal:          record.Proposal,
+		chanID:            record.ChannelID,
+		cachedProgress:    record.CachedProgress,
+		retrievalProgress: record.RetrievalProgress,
+		size:              record.Size,
+		errKind:           retrievalErrorKindFromString(record.Error),
+		message:           record.Message,
+		timedOutPhase:     record.TimedOutPhase,
+		lastPersisted:     record.UpdatedAt,
+		selector:          selector,
+		timeouts: retrievalTimeouts{
+			accept:    record.AcceptTimeout,
+			firstByte: record.FirstByteTimeout,
+			stall:     record.StallTimeout,
+			total:     record.TotalTimeout,
+		},
+		startTime:     record.StartedAt,
+		acceptTime:    record.AcceptedAt,
+		firstByteTime: record.FirstByteAt,
+
+		// Stall detection starts over from when the transfer is loaded, rather
+		// than counting the time the client was down
+		lastDataTime: time.Now(),
+	}
+}
+
+// Matches up the persisted retrieval transfers that were running when the
+// client last shut down with the data transfer manager's channels - transfers
+// whose channels are still in progress get restarted and re-registered, and
+// the rest are marked errored
+//
+// Resumed transfers take a scheduler slot and have their timeouts watched again,
+// the same as transfers started with StartRetrievalTransfer
+func (client *Client) resumeRetrievalTransfers(ctx context.Context) error {
+	records, err := client.RetrievalTransferRecords(ctx)
+	if err != nil {
+		return err
+	}
+
+	inProgress, err := client.dt.InProgressChannels(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, record := range records {
+		if record.Status != RetrievalTransferStatusInProgress {
+			continue
+		}
+
+		transfer := client.retrievalTransferFromRecord(record)
+
+		// The provider may have been blocked since the transfer started
+		if err := client.StorageProviderByPeerID(record.Provider).CheckPolicy(ctx); err != nil {
+			if err := transfer.finish(ctx, RetrievalTransferStatusErrored, ErrProviderBlocked, err.Error()); err != nil {
+				log.Errorf("Failed to mark retrieval transfer %s errored: %v", record.ChannelID, err)
+			}
+			continue
+		}
+
+		var message string
+		if _, ok := inProgress[record.ChannelID]; ok {
+			client.retrievalTransfersLk.Lock()
+			client.retrievalTransfers[record.ChannelID] = transfer
+			client.retrievalTransfersLk.Unlock()
+
+			// Already running, so it can't wait in the queue
+			release := client.retrievalScheduler.claim(record.Provider)
+
+			err := client.dt.RestartDataTransferChannel(ctx, record.ChannelID)
+			if err == nil {
+				log.Infof("Resumed retrieval transfer %s", record.ChannelID)
+
+				go func() {
+					<-transfer.Done()
+					release()
+				}()
+				go transfer.watchTimeouts(context.Background())
+
+				continue
+			}
+			release()
+
+			log.Errorf("Failed to restart retrieval transfer %s: %v", record.ChannelID, err)
+			message = fmt.Sprintf("failed to restart: %v", err)
+		} else {
+			message = "data transfer channel was no longer in progress"
+		}
+
+		// The transfer could not be resumed, mark it errored
+		if err := transfer.finish(
+			ctx,
+			RetrievalTransferStatusErrored,
+			ErrRetrievalInterrupted,
+			message,
+		); err != nil {
+			log.Errorf("Failed to mark retrieval transfer %s errored: %v", record.ChannelID, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,137 @@
+package filclient
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	datatransfer "github.com/filecoin-project/go-data-transfer"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/ipfs/go-cid"
+	selectorparse "github.com/ipld/go-ipld-prime/traversal/selector/parse"
+	"github.com/libp2p/go-libp2p/core/test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetrievalTransferRecordRoundTrip(t *testing.T) {
+	record := testRetrievalTransferRecord(t)
+	record.StallTimeout = time.Minute
+	record.StartedAt = time.Now()
+
+	data, err := record.marshal()
+	require.NoError(t, err)
+
+	var decoded RetrievalTransferRecord
+	require.NoError(t, decoded.unmarshal(data))
+
+	require.Equal(t, record.ChannelID, decoded.ChannelID)
+	require.Equal(t, record.Provider, decoded.Provider)
+	require.Equal(t, record.Proposal.PayloadCID, decoded.Proposal.PayloadCID)
+	require.Equal(t, record.Proposal.ID, decoded.Proposal.ID)
+	require.Equal(t, record.Status, decoded.Status)
+	require.Equal(t, record.RetrievalProgress, decoded.RetrievalProgress)
+	require.Equal(t, record.StallTimeout, decoded.StallTimeout)
+	require.True(t, record.StartedAt.Equal(decoded.StartedAt))
+
+	selector, err := decoded.Selector()
+	require.NoError(t, err)
+	require.NotNil(t, selector)
+}
+
+func TestResumeRetrievalTransfersMarksLostChannelsErrored(t *testing.T) {
+	ctx := context.Background()
+	ds := initDatastore(t)
+
+	// Persist a record for a transfer that was running when the client shut
+	// down, but whose channel the data transfer manager doesn't know about
+	initStandaloneClient(t, ctx, ds).Close()
+
+	record := testRetrievalTransferRecord(t)
+	record.StartedAt = time.Now().Add(-time.Minute)
+	record.AcceptedAt = record.StartedAt.Add(time.Second)
+	record.FirstByteAt = record.StartedAt.Add(10 * time.Second)
+	data, err := record.marshal()
+	require.NoError(t, err)
+	require.NoError(t, ds.Put(ctx, retrievalTransferRecordKey(record.ChannelID), data))
+
+	// Then start the client back up
+	fc := initStandaloneClient(t, ctx, ds)
+
+	records, err := fc.RetrievalTransferRecords(ctx)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	require.Equal(t, RetrievalTransferStatusErrored, records[0].Status)
+	require.NotEmpty(t, records[0].Message)
+
+	transfer, err := fc.ReattachRetrievalTransfer(ctx, record.ChannelID)
+	require.NoError(t, err)
+	require.Equal(t, RetrievalTransferStatusErrored, transfer.State())
+	require.ErrorIs(t, transfer.Err(), ErrRetrievalInterrupted)
+	require.Equal(t, record.RetrievalProgress, transfer.Progress())
+
+	// The attempt is timed from when the transfer originally started
+	history, err := fc.RetrievalHistory(ctx, record.Provider)
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+	require.True(t, record.StartedAt.Equal(history[0].StartedAt))
+	require.GreaterOrEqual(t, history[0].Duration, time.Minute)
+	require.Equal(t, 10*time.Second, history[0].TimeToFirstByte)
+
+	require.NoError(t, fc.ForgetRetrievalTransfer(ctx, record.ChannelID))
+	_, err = fc.ReattachRetrievalTransfer(ctx, record.ChannelID)
+	require.ErrorIs(t, err, ErrRetrievalTransferNotFound)
+}
+
+func testRetrievalTransferRecord(t *testing.T) RetrievalTransferRecord {
+	payloadCid, err := cid.Parse("bafkqaaa")
+	require.NoError(t, err)
+
+	params, err := retrievalmarket.NewParamsV1(
+		abi.NewTokenAmount(0),
+		0,
+		0,
+		selectorparse.CommonSelector_ExploreAllRecursively,
+		nil,
+		abi.NewTokenAmount(0),
+	)
+	require.NoError(t, err)
+
+	initiator := test.RandPeerIDFatal(t)
+	responder := test.RandPeerIDFatal(t)
+
+	return RetrievalTransferRecord{
+		ChannelID: datatransfer.ChannelID{Initiator: initiator, Responder: responder, ID: 1},
+		Provider:  responder,
+		Proposal: retrievalmarket.DealProposal{
+			PayloadCID: payloadCid,
+			ID:         1,
+			Params:     params,
+		},
+		Status:            RetrievalTransferStatusInProgress,
+		RetrievalProgress: 100,
+		Size:              1000,
+	}
+}
+
+func TestResumeRetrievalTransfersChecksPolicy(t *testing.T) {
+	ctx := context.Background()
+	ds := initDatastore(t)
+
+	record := testRetrievalTransferRecord(t)
+	fc := initStandaloneClient(t, ctx, ds)
+	require.NoError(t, fc.BlockProvider(ctx, ProviderPolicyTarget{PeerID: record.Provider}, "", 0))
+	fc.Close()
+
+	data, err := record.marshal()
+	require.NoError(t, err)
+	require.NoError(t, ds.Put(ctx, retrievalTransferRecordKey(record.ChannelID), data))
+
+	// The provider was blocked while the client was down
+	fc = initStandaloneClient(t, ctx, ds)
+
+	transfer, err := fc.ReattachRetrievalTransfer(ctx, record.ChannelID)
+	require.NoError(t, err)
+	require.Equal(t, RetrievalTransferStatusErrored, transfer.State())
+	require.ErrorIs(t, transfer.Err(), ErrProviderBlocked)
+}
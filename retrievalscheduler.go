@@ -0,0 +1,216 @@
+package filclient
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// retrievalscheduler.go - queueing of retrievals to keep the number running at
+// once within limits
+
+// How soon a queued retrieval gets to run relative to others - retrievals of
+// the same priority run in the order they were queued
+type RetrievalPriority int
+
+const (
+	RetrievalPriorityLow    RetrievalPriority = -1
+	RetrievalPriorityNormal RetrievalPriority = 0
+	RetrievalPriorityHigh   RetrievalPriority = 1
+)
+
+// Hands out slots for retrievals to run in, queueing them while the global or
+// per-provider limit is reached - a limit of 0 means no limit
+type retrievalScheduler struct {
+	lk sync.Mutex
+
+	maxActive            int
+	maxActivePerProvider int
+
+	active           int
+	activeByProvider map[peer.ID]int
+
+	// Sorted by priority, then by when they were queued
+	queue []*retrievalTicket
+
+	// Taken before lk is released, so that position updates are sent in the
+	// order they happened
+	notifyLk sync.Mutex
+}
+
+// A retrieval waiting in the queue
+type retrievalTicket struct {
+	provider peer.ID
+	priority RetrievalPriority
+
+	// Closed once the retrieval has a slot
+	ready chan struct{}
+
+	onPosition   func(int)
+	lastPosition int
+}
+
+// A position update to send once the lock is released
+type retrievalPositionUpdate struct {
+	onPosition func(int)
+	position   int
+}
+
+func newRetrievalScheduler(maxActive int, maxActivePerProvider int) *retrievalScheduler {
+	return &retrievalScheduler{
+		maxActive:            maxActive,
+		maxActivePerProvider: maxActivePerProvider,
+		activeByProvider:     make(map[peer.ID]int),
+	}
+}
+
+// Blocks until there's a slot for a retrieval from the provider, returning a
+// function that must be called to give the slot back once the retrieval is
+// done
+//
+// While queued, onPosition (if not nil) is called with the retrieval's position
+// in the queue each time it changes, starting from 0 for the next in line - it
+// must not block or use the scheduler
+func (scheduler *retrievalScheduler) acquire(
+	ctx context.Context,
+	provider peer.ID,
+	priority RetrievalPriority,
+	onPosition func(int),
+) (func(), error) {
+	scheduler.lk.Lock()
+
+	ticket := &retrievalTicket{
+		provider:     provider,
+		priority:     priority,
+		ready:        make(chan struct{}),
+		onPosition:   onPosition,
+		lastPosition: -1,
+	}
+	// Goes after everything of the same or higher priority
+	i := sort.Search(len(scheduler.queue), func(i int) bool {
+		other := scheduler.queue[i]
+		return other.priority < ticket.priority
+	})
+	scheduler.queue = append(scheduler.queue, nil)
+	copy(scheduler.queue[i+1:], scheduler.queue[i:])
+	scheduler.queue[i] = ticket
+
+	updates := scheduler.dispatchLocked()
+	scheduler.unlockAndNotify(updates)
+
+	release := func() {
+		scheduler.release(provider)
+	}
+
+	select {
+	case <-ticket.ready:
+		return release, nil
+	case <-ctx.Done():
+	}
+
+	scheduler.lk.Lock()
+
+	// It may have been given a slot in the meantime
+	select {
+	case <-ticket.ready:
+		scheduler.lk.Unlock()
+		release()
+		return nil, ctx.Err()
+	default:
+	}
+
+	for i, other := range scheduler.queue {
+		if other == ticket {
+			scheduler.queue = append(scheduler.queue[:i], scheduler.queue[i+1:]...)
+			break
+		}
+	}
+
+	updates = scheduler.dispatchLocked()
+	scheduler.unlockAndNotify(updates)
+
+	return nil, ctx.Err()
+}
+
+// Takes a slot straight away, even past the limits, for a retrieval that's
+// already running (e.g. one resumed after a restart) - retrievals queue behind
+// it as usual until it gives the slot back
+func (scheduler *retrievalScheduler) claim(provider peer.ID) func() {
+	scheduler.lk.Lock()
+	scheduler.active++
+	scheduler.activeByProvider[provider]++
+	scheduler.lk.Unlock()
+
+	return func() {
+		scheduler.release(provider)
+	}
+}
+
+func (scheduler *retrievalScheduler) release(provider peer.ID) {
+	scheduler.lk.Lock()
+
+	scheduler.active--
+	scheduler.activeByProvider[provider]--
+	if scheduler.activeByProvider[provider] <= 0 {
+		delete(scheduler.activeByProvider, provider)
+	}
+
+	updates := scheduler.dispatchLocked()
+	scheduler.unlockAndNotify(updates)
+}
+
+// Gives slots to as many queued retrievals as the limits allow, in queue order
+// - a retrieval whose provider is at its limit doesn't hold up retrievals from
+// other providers behind it
+//
+// Returns the position updates for the retrievals still queued, which must be
+// sent after unlocking
+func (scheduler *retrievalScheduler) dispatchLocked() []retrievalPositionUpdate {
+	var remaining []*retrievalTicket
+	for _, ticket := range scheduler.queue {
+		globalFull := scheduler.maxActive > 0 && scheduler.active >= scheduler.maxActive
+		providerFull := scheduler.maxActivePerProvider > 0 &&
+			scheduler.activeByProvider[ticket.provider] >= scheduler.maxActivePerProvider
+
+		if globalFull || providerFull {
+			remaining = append(remaining, ticket)
+			continue
+		}
+
+		scheduler.active++
+		scheduler.activeByProvider[ticket.provider]++
+		close(ticket.ready)
+	}
+	scheduler.queue = remaining
+
+	var updates []retrievalPositionUpdate
+	for position, ticket := range scheduler.queue {
+		if ticket.onPosition != nil && ticket.lastPosition != position {
+			updates = append(updates, retrievalPositionUpdate{ticket.onPosition, position})
+		}
+		ticket.lastPosition = position
+	}
+
+	return updates
+}
+
+func (scheduler *retrievalScheduler) unlockAndNotify(updates []retrievalPositionUpdate) {
+	scheduler.notifyLk.Lock()
+	defer scheduler.notifyLk.Unlock()
+
+	scheduler.lk.Unlock()
+
+	for _, update := range updates {
+		update.onPosition(update.position)
+	}
+}
+
+// The number of retrievals currently running and waiting in the queue
+func (client *Client) RetrievalQueueStats() (active int, queued int) {
+	client.retrievalScheduler.lk.Lock()
+	defer client.retrievalScheduler.lk.Unlock()
+
+	return client.retrievalScheduler.active, len(client.retrievalScheduler.queue)
+}
@@ -0,0 +1,165 @@
+package filclient
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetrievalScheduler(t *testing.T) {
+	ctx := context.Background()
+
+	providerA := test.RandPeerIDFatal(t)
+	providerB := test.RandPeerIDFatal(t)
+
+	// Starts acquiring in the background, sending the release func once it has
+	// a slot
+	acquire := func(
+		scheduler *retrievalScheduler,
+		provider peer.ID,
+		priority RetrievalPriority,
+		onPosition func(int),
+	) chan func() {
+		acquired := make(chan func(), 1)
+		go func() {
+			release, err := scheduler.acquire(ctx, provider, priority, onPosition)
+			if err == nil {
+				acquired <- release
+			}
+		}()
+		return acquired
+	}
+
+	// Waits until the scheduler has the given number of queued retrievals
+	waitQueued := func(scheduler *retrievalScheduler, queued int) {
+		require.Eventually(t, func() bool {
+			scheduler.lk.Lock()
+			defer scheduler.lk.Unlock()
+			return len(scheduler.queue) == queued
+		}, time.Second, time.Millisecond)
+	}
+
+	t.Run("global limit", func(t *testing.T) {
+		scheduler := newRetrievalScheduler(2, 0)
+
+		first := acquire(scheduler, providerA, RetrievalPriorityNormal, nil)
+		second := acquire(scheduler, providerB, RetrievalPriorityNormal, nil)
+		release := <-first
+		<-second
+
+		third := acquire(scheduler, providerA, RetrievalPriorityNormal, nil)
+		waitQueued(scheduler, 1)
+
+		release()
+		<-third
+		waitQueued(scheduler, 0)
+	})
+
+	t.Run("per provider limit", func(t *testing.T) {
+		scheduler := newRetrievalScheduler(0, 1)
+
+		release := <-acquire(scheduler, providerA, RetrievalPriorityNormal, nil)
+
+		// Another retrieval from the same provider waits, but it doesn't hold
+		// up the other provider
+		blocked := acquire(scheduler, providerA, RetrievalPriorityNormal, nil)
+		waitQueued(scheduler, 1)
+		<-acquire(scheduler, providerB, RetrievalPriorityNormal, nil)
+
+		release()
+		<-blocked
+	})
+
+	t.Run("priority and positions", func(t *testing.T) {
+		scheduler := newRetrievalScheduler(1, 0)
+
+		release := <-acquire(scheduler, providerA, RetrievalPriorityNormal, nil)
+
+		var lk sync.Mutex
+		var order []string
+		queued := 0
+		positions := make(map[string][]int)
+		start := func(name string, priority RetrievalPriority) chan func() {
+			acquired := acquire(scheduler, providerA, priority, func(position int) {
+				lk.Lock()
+				defer lk.Unlock()
+				positions[name] = append(positions[name], position)
+			})
+			queued++
+			waitQueued(scheduler, queued)
+
+			done := make(chan func(), 1)
+			go func() {
+				release := <-acquired
+				lk.Lock()
+				order = append(order, name)
+				lk.Unlock()
+				done <- release
+			}()
+			return done
+		}
+
+		low := start("low", RetrievalPriorityLow)
+		normal := start("normal", RetrievalPriorityNormal)
+		high := start("high", RetrievalPriorityHigh)
+		normal2 := start("normal2", RetrievalPriorityNormal)
+
+		release()
+		(<-high)()
+		(<-normal)()
+		(<-normal2)()
+		(<-low)()
+
+		require.Equal(t, []string{"high", "normal", "normal2", "low"}, order)
+
+		lk.Lock()
+		defer lk.Unlock()
+		require.Equal(t, []int{0, 1, 2, 3, 2, 1, 0}, positions["low"])
+		require.Equal(t, []int{0, 1, 0}, positions["normal"])
+		require.Equal(t, []int{0}, positions["high"])
+		require.Equal(t, []int{2, 1, 0}, positions["normal2"])
+	})
+
+	t.Run("cancelled while queued", func(t *testing.T) {
+		scheduler := newRetrievalScheduler(1, 0)
+
+		release := <-acquire(scheduler, providerA, RetrievalPriorityNormal, nil)
+
+		cancelCtx, cancel := context.WithCancel(ctx)
+		errs := make(chan error, 1)
+		go func() {
+			_, err := scheduler.acquire(cancelCtx, providerA, RetrievalPriorityNormal, nil)
+			errs <- err
+		}()
+		waitQueued(scheduler, 1)
+
+		cancel()
+		require.ErrorIs(t, <-errs, context.Canceled)
+		waitQueued(scheduler, 0)
+
+		// The slot is still only held by the first retrieval
+		release()
+		<-acquire(scheduler, providerA, RetrievalPriorityNormal, nil)
+	})
+
+	t.Run("claimed past the limit", func(t *testing.T) {
+		scheduler := newRetrievalScheduler(1, 0)
+
+		release := <-acquire(scheduler, providerA, RetrievalPriorityNormal, nil)
+
+		// Claiming never waits, and holds up new retrievals like any other slot
+		releaseClaimed := scheduler.claim(providerB)
+		queued := acquire(scheduler, providerA, RetrievalPriorityNormal, nil)
+		waitQueued(scheduler, 1)
+
+		release()
+		waitQueued(scheduler, 1)
+		releaseClaimed()
+		<-queued
+	})
+}
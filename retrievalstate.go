@@ -0,0 +1,211 @@
+package filclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// retrievalstate.go - the retrieval transfer state machine
+
+// The reasons a retrieval transfer can end without completing - Err() on a
+// transfer wraps one of these along with the provider's or channel's message
+var (
+	ErrRetrievalRejected            = errors.New("retrieval rejected by provider")
+	ErrRetrievalFailed              = errors.New("retrieval transfer failed")
+	ErrRetrievalDisconnected        = errors.New("retrieval provider disconnected")
+	ErrRetrievalCancelled           = errors.New("retrieval cancelled")
+	ErrRetrievalCancelledByProvider = errors.New("retrieval cancelled by provider")
+	ErrRetrievalProviderErrored     = errors.New("provider reported retrieval error")
+	ErrRetrievalPaymentNotSupported = errors.New("retrieval requires payment, which is not supported yet")
+	ErrRetrievalInterrupted         = errors.New("retrieval interrupted by shutdown")
+	ErrRetrievalStalled             = errors.New("retrieval stalled")
+	ErrRetrievalTimedOut            = errors.New("retrieval timed out")
+	ErrRetrievalBadResponse         = errors.New("provider sent an invalid retrieval response")
+	ErrRetrievalIncomplete          = errors.New("retrieved DAG failed verification")
+)
+
+// Used to restore the error kind of persisted transfers
+var retrievalErrorKinds = []error{
+	ErrRetrievalRejected,
+	ErrRetrievalFailed,
+	ErrRetrievalDisconnected,
+	ErrRetrievalCancelled,
+	ErrRetrievalCancelledByProvider,
+	ErrRetrievalProviderErrored,
+	ErrRetrievalPaymentNotSupported,
+	ErrRetrievalInterrupted,
+	ErrRetrievalStalled,
+	ErrRetrievalTimedOut,
+	ErrRetrievalBadResponse,
+	ErrRetrievalIncomplete,
+	ErrProviderBlocked,
+}
+
+func retrievalErrorKindFromString(str string) error {
+	for _, kind := range retrievalErrorKinds {
+		if kind.Error() == str {
+			return kind
+		}
+	}
+
+	if str == "" {
+		return nil
+	}
+
+	return errors.New(str)
+}
+
+// The statuses each status may move to - done statuses are final
+var retrievalTransferTransitions = map[RetrievalTransferStatus][]RetrievalTransferStatus{
+	RetrievalTransferStatusInvalid: {
+		RetrievalTransferStatusInProgress,
+		RetrievalTransferStatusRejected,
+		RetrievalTransferStatusErrored,
+	},
+	RetrievalTransferStatusInProgress: {
+		RetrievalTransferStatusRejected,
+		RetrievalTransferStatusErrored,
+		RetrievalTransferStatusCancelled,
+		RetrievalTransferStatusCompleted,
+	},
+}
+
+// The event sent to subscribers when a transfer enters each done status
+var retrievalTransferDoneEvents = map[RetrievalTransferStatus]RetrievalEventCode{
+	RetrievalTransferStatusRejected:  RetrievalEventRejected,
+	RetrievalTransferStatusErrored:   RetrievalEventErrored,
+	RetrievalTransferStatusCancelled: RetrievalEventCancelled,
+	RetrievalTransferStatusCompleted: RetrievalEventCompleted,
+}
+
+// Whether a transfer in this status may move to the next status
+func (status RetrievalTransferStatus) CanTransitionTo(next RetrievalTransferStatus) bool {
+	for _, allowed := range retrievalTransferTransitions[status] {
+		if allowed == next {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns nil unless the transfer ended without completing, in which case the
+// returned error wraps one of the ErrRetrieval* errors along with the message
+// from the provider or channel, if there was one
+func (transfer *RetrievalTransfer) Err() error {
+	transfer.lk.Lock()
+	defer transfer.lk.Unlock()
+
+	return transfer.errLocked()
+}
+
+func (transfer *RetrievalTransfer) errLocked() error {
+	if transfer.errKind == nil {
+		return nil
+	}
+
+	if transfer.message == "" || transfer.message == transfer.errKind.Error() {
+		return transfer.errKind
+	}
+
+	return fmt.Errorf("%w: %s", transfer.errKind, transfer.message)
+}
+
+// Finishes the transfer as completed if the retrieved DAG passes verification,
+// or as errored if it doesn't
+//
+// The transfer lock must not be held
+func (transfer *RetrievalTransfer) complete(ctx context.Context, message string) error {
+	// All the data has arrived, so a slow verification mustn't be mistaken for
+	// a stalled or overdue transfer
+	transfer.lk.Lock()
+	transfer.verifying = true
+	transfer.lk.Unlock()
+
+	if err := transfer.verify(ctx); err != nil {
+		log.Errorf("Retrieved DAG failed verification: %v", err)
+		return transfer.finish(ctx, RetrievalTransferStatusErrored, ErrRetrievalIncomplete, err.Error())
+	}
+
+	return transfer.finish(ctx, RetrievalTransferStatusCompleted, nil, message)
+}
+
+// Moves the transfer into a done status - errKind must be set for any status
+// other than completed
+//
+// The final state is persisted, the attempt is added to the retrieval history,
+// the data transfer channel is closed if it's still open (or for other
+// transports, the transfer's context is cancelled), any temporary blockstore is
+// deleted, subscribers are notified, and finally Done() is signalled, so that
+// anyone waiting on Done() sees the final status and all events
+//
+// The transfer lock must not be held
+func (transfer *RetrievalTransfer) finish(
+	ctx context.Context,
+	status RetrievalTransferStatus,
+	errKind error,
+	message string,
+) error {
+	transfer.lk.Lock()
+
+	if !transfer.status.CanTransitionTo(status) || !status.IsDone() {
+		current := transfer.status
+		transfer.lk.Unlock()
+		return fmt.Errorf("%w: cannot go from %s to %s", ErrUnexpectedRetrievalTransferState, current, status)
+	}
+
+	transfer.status = status
+	transfer.errKind = errKind
+	transfer.message = message
+
+	if err := transfer.persist(ctx); err != nil {
+		log.Errorf("Failed to persist retrieval transfer %s: %v", transfer.chanID, err)
+	}
+
+	attempt := transfer.attemptLocked(time.Now())
+
+	doneChans := transfer.doneChans
+	transfer.doneChans = nil
+
+	transfer.lk.Unlock()
+
+	if attempt != nil {
+		if err := transfer.client.recordRetrievalAttempt(ctx, attempt); err != nil {
+			log.Errorf("Failed to record retrieval attempt from %s: %v", attempt.Provider, err)
+		}
+	}
+
+	// Remove from active transfers
+	transfer.client.retrievalTransfersLk.Lock()
+	delete(transfer.client.retrievalTransfers, transfer.chanID)
+	transfer.client.retrievalTransfersLk.Unlock()
+
+	// A completed channel has already been cleaned up by the data transfer
+	// manager
+	if transfer.cancel != nil {
+		transfer.cancel()
+	} else if status != RetrievalTransferStatusCompleted {
+		if err := transfer.client.dt.CloseDataTransferChannel(ctx, transfer.chanID); err != nil {
+			log.Debugf("Could not close data transfer channel %s: %v", transfer.chanID, err)
+		}
+	}
+
+	if transfer.blockWriter != nil {
+		if err := transfer.blockWriter.close(); err != nil {
+			log.Errorf("Failed to delete temporary retrieval blockstore: %v", err)
+		}
+	}
+
+	transfer.publish(RetrievalEvent{
+		Code:    retrievalTransferDoneEvents[status],
+		Message: message,
+	})
+
+	// Send done signals
+	for _, ch := range doneChans {
+		close(ch)
+	}
+
+	return nil
+}
@@ -0,0 +1,61 @@
+package filclient
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetrievalTransferStatusTransitions(t *testing.T) {
+	require.True(t, RetrievalTransferStatusInvalid.CanTransitionTo(RetrievalTransferStatusInProgress))
+	require.True(t, RetrievalTransferStatusInProgress.CanTransitionTo(RetrievalTransferStatusRejected))
+	require.True(t, RetrievalTransferStatusInProgress.CanTransitionTo(RetrievalTransferStatusCompleted))
+
+	// Done statuses are final
+	for _, status := range []RetrievalTransferStatus{
+		RetrievalTransferStatusRejected,
+		RetrievalTransferStatusErrored,
+		RetrievalTransferStatusCancelled,
+		RetrievalTransferStatusCompleted,
+	} {
+		require.True(t, status.IsDone())
+		require.False(t, status.CanTransitionTo(RetrievalTransferStatusInProgress))
+		require.False(t, status.CanTransitionTo(RetrievalTransferStatusCompleted))
+	}
+}
+
+func TestRetrievalTransferFinish(t *testing.T) {
+	ctx := context.Background()
+	fc := initStandaloneClient(t, ctx, initDatastore(t))
+
+	record := testRetrievalTransferRecord(t)
+	transfer := fc.retrievalTransferFromRecord(record)
+	fc.retrievalTransfers[record.ChannelID] = transfer
+
+	var events []RetrievalEvent
+	transfer.Subscribe(func(event RetrievalEvent) {
+		// By the time subscribers hear about it, the status must be final
+		require.Equal(t, RetrievalTransferStatusRejected, event.Transfer.State())
+		events = append(events, event)
+	})
+
+	done := transfer.Done()
+	require.NoError(t, transfer.Err())
+
+	require.NoError(t, transfer.finish(ctx, RetrievalTransferStatusRejected, ErrRetrievalRejected, "no thanks"))
+
+	<-done
+	require.Equal(t, RetrievalTransferStatusRejected, transfer.State())
+	require.ErrorIs(t, transfer.Err(), ErrRetrievalRejected)
+	require.Contains(t, transfer.Err().Error(), "no thanks")
+	require.NotContains(t, fc.retrievalTransfers, record.ChannelID)
+
+	require.Len(t, events, 1)
+	require.Equal(t, RetrievalEventRejected, events[0].Code)
+	require.Equal(t, "no thanks", events[0].Message)
+
+	// Once done, the transfer can't be moved anywhere else
+	require.ErrorIs(t, transfer.Cancel(ctx), ErrUnexpectedRetrievalTransferState)
+	require.Equal(t, RetrievalTransferStatusRejected, transfer.State())
+}
@@ -0,0 +1,343 @@
+package filclient
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	datatransfer "github.com/filecoin-project/go-data-transfer"
+	"github.com/filecoin-project/go-data-transfer/transport/graphsync"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	leveldb "github.com/ipfs/go-ds-leveldb"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	format "github.com/ipfs/go-ipld-format"
+	"github.com/ipld/go-car"
+	carutil "github.com/ipld/go-car/util"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/linking"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+)
+
+// retrievalstream.go - streaming retrieved blocks out as a CAR, optionally
+// without storing them in the client's blockstore
+
+var (
+	ErrRetrievalNothingToStream = errors.New("retrieval without persisting needs a CAR writer")
+)
+
+// The CAR a streamed retrieval is written to - kept apart from the block
+// writer, so that Client.Retrieve can carry it over from one candidate to the
+// next without writing the header or any block twice
+type retrievalCAROutput struct {
+	lk sync.Mutex
+
+	w       io.Writer
+	written *cid.Set
+
+	// The header is written along with the first block, so that the roots can
+	// be filled in late when they aren't known up front
+	roots         []cid.Cid
+	headerWritten bool
+}
+
+// The root may be undefined if it isn't known yet, in which case it must be
+// set with setRoots before the first block is written
+func newRetrievalCAROutput(w io.Writer, root cid.Cid) *retrievalCAROutput {
+	var roots []cid.Cid
+	if root.Defined() {
+		roots = []cid.Cid{root}
+	}
+
+	return &retrievalCAROutput{
+		w:       w,
+		written: cid.NewSet(),
+		roots:   roots,
+	}
+}
+
+// Sets the roots for the CAR header, if it hasn't been written yet
+func (output *retrievalCAROutput) setRoots(roots []cid.Cid) {
+	output.lk.Lock()
+	defer output.lk.Unlock()
+
+	if !output.headerWritten {
+		output.roots = roots
+	}
+}
+
+// Writes the block unless it has been written already
+func (output *retrievalCAROutput) write(block blocks.Block) error {
+	output.lk.Lock()
+	defer output.lk.Unlock()
+
+	if output.written.Has(block.Cid()) {
+		return nil
+	}
+
+	if !output.headerWritten {
+		if err := car.WriteHeader(&car.CarHeader{
+			Roots:   output.roots,
+			Version: 1,
+		}, output.w); err != nil {
+			return fmt.Errorf("could not write CAR header: %w", err)
+		}
+		output.headerWritten = true
+	}
+
+	if err := carutil.LdWrite(output.w, block.Cid().Bytes(), block.RawData()); err != nil {
+		return fmt.Errorf("could not write CAR block: %w", err)
+	}
+
+	output.written.Add(block.Cid())
+
+	return nil
+}
+
+// Receives the blocks of a streamed retrieval as they arrive - each block is
+// written to the CAR once, and kept either in the client's blockstore or in a
+// temporary one on disk, so that the traversal can load it again
+type retrievalBlockWriter struct {
+	lk sync.Mutex
+
+	car *retrievalCAROutput
+
+	// Always read from, but only written to if persisting
+	bs      blockstore.Blockstore
+	persist bool
+
+	// Where blocks go if not persisting - created with the first block, and
+	// deleted by close
+	tmpDir string
+	tmpDS  *leveldb.Datastore
+	tmpBS  blockstore.Blockstore
+}
+
+// Creates a writer for the config, or returns nil if the config doesn't need
+// one - the root may be undefined if it isn't known yet, in which case it must
+// be set with setRoots before the first block arrives
+//
+// Blocks go to the config's CAR output if it has one (see Client.Retrieve),
+// otherwise to a new one around its CAR writer
+func newRetrievalBlockWriter(bs blockstore.Blockstore, root cid.Cid, cfg RetrievalConfig) (*retrievalBlockWriter, error) {
+	if cfg.carWriter == nil {
+		if cfg.noPersist {
+			return nil, ErrRetrievalNothingToStream
+		}
+		return nil, nil
+	}
+
+	output := cfg.carOutput
+	if output == nil {
+		output = newRetrievalCAROutput(cfg.carWriter, root)
+	}
+
+	return &retrievalBlockWriter{
+		car:     output,
+		bs:      bs,
+		persist: !cfg.noPersist,
+	}, nil
+}
+
+// Sets the roots for the CAR header, if it hasn't been written yet
+func (writer *retrievalBlockWriter) setRoots(roots []cid.Cid) {
+	writer.car.setRoots(roots)
+}
+
+// Writes the block to the CAR and stores it - the block is stored even if an
+// earlier attempt already wrote it to the CAR, since this attempt's traversal
+// still needs to load it
+func (writer *retrievalBlockWriter) put(ctx context.Context, block blocks.Block) error {
+	if err := writer.car.write(block); err != nil {
+		return err
+	}
+
+	if writer.persist {
+		return writer.bs.Put(ctx, block)
+	}
+
+	tmpBS, err := writer.tmpBlockstore()
+	if err != nil {
+		return err
+	}
+
+	return tmpBS.Put(ctx, block)
+}
+
+// Returns the temporary blockstore, creating it if this is the first block
+func (writer *retrievalBlockWriter) tmpBlockstore() (blockstore.Blockstore, error) {
+	writer.lk.Lock()
+	defer writer.lk.Unlock()
+
+	if writer.tmpBS != nil {
+		return writer.tmpBS, nil
+	}
+
+	dir, err := os.MkdirTemp("", "filclient-retrieval-")
+	if err != nil {
+		return nil, fmt.Errorf("could not create temporary blockstore: %w", err)
+	}
+
+	ds, err := leveldb.NewDatastore(dir, nil)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("could not create temporary blockstore: %w", err)
+	}
+
+	writer.tmpDir = dir
+	writer.tmpDS = ds
+	writer.tmpBS = blockstore.NewBlockstoreNoPrefix(ds)
+
+	return writer.tmpBS, nil
+}
+
+// Deletes the temporary blockstore, if there is one - blocks that arrive after
+// this fail to be stored
+func (writer *retrievalBlockWriter) close() error {
+	writer.lk.Lock()
+	defer writer.lk.Unlock()
+
+	if writer.tmpBS == nil {
+		return nil
+	}
+
+	closeErr := writer.tmpDS.Close()
+	removeErr := os.RemoveAll(writer.tmpDir)
+	writer.tmpBS = nil
+	writer.tmpDS = nil
+
+	if closeErr != nil {
+		return closeErr
+	}
+	return removeErr
+}
+
+// Writes the block to the CAR without storing it anywhere, for blocks that are
+// already in the blockstore
+func (writer *retrievalBlockWriter) write(block blocks.Block) error {
+	return writer.car.write(block)
+}
+
+func (writer *retrievalBlockWriter) get(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	writer.lk.Lock()
+	tmpBS := writer.tmpBS
+	writer.lk.Unlock()
+
+	if tmpBS != nil {
+		block, err := tmpBS.Get(ctx, c)
+		if !format.IsNotFound(err) {
+			return block, err
+		}
+	}
+
+	return writer.bs.Get(ctx, c)
+}
+
+func (writer *retrievalBlockWriter) has(ctx context.Context, c cid.Cid) (bool, error) {
+	writer.lk.Lock()
+	tmpBS := writer.tmpBS
+	writer.lk.Unlock()
+
+	if tmpBS != nil {
+		has, err := tmpBS.Has(ctx, c)
+		if err != nil || has {
+			return has, err
+		}
+	}
+
+	return writer.bs.Has(ctx, c)
+}
+
+// A link system that reads and writes through the block writer, for graphsync
+// to use in place of the client's blockstore
+func (writer *retrievalBlockWriter) linkSystem() linking.LinkSystem {
+	lsys := cidlink.DefaultLinkSystem()
+
+	lsys.StorageReadOpener = func(lctx linking.LinkContext, link datamodel.Link) (io.Reader, error) {
+		block, err := writer.get(lctx.Ctx, link.(cidlink.Link).Cid)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.NewReader(block.RawData()), nil
+	}
+
+	lsys.StorageWriteOpener = func(lctx linking.LinkContext) (io.Writer, linking.BlockWriteCommitter, error) {
+		var buf bytes.Buffer
+		return &buf, func(link datamodel.Link) error {
+			block, err := blocks.NewBlockWithCid(buf.Bytes(), link.(cidlink.Link).Cid)
+			if err != nil {
+				return err
+			}
+			return writer.put(lctx.Ctx, block)
+		}, nil
+	}
+
+	return lsys
+}
+
+// Stores a retrieved block, either in the client's blockstore or through the
+// block writer if the transfer is being streamed
+func (transfer *RetrievalTransfer) putBlock(ctx context.Context, block blocks.Block) error {
+	if transfer.blockWriter != nil {
+		return transfer.blockWriter.put(ctx, block)
+	}
+
+	return transfer.client.bs.Put(ctx, block)
+}
+
+// Looks up a block that's already available locally, returning nil if there
+// isn't one
+func (transfer *RetrievalTransfer) localBlock(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	var has bool
+	var err error
+	if transfer.blockWriter != nil {
+		has, err = transfer.blockWriter.has(ctx, c)
+	} else {
+		has, err = transfer.client.bs.Has(ctx, c)
+	}
+	if err != nil || !has {
+		return nil, err
+	}
+
+	if transfer.blockWriter != nil {
+		return transfer.blockWriter.get(ctx, c)
+	}
+
+	return transfer.client.bs.Get(ctx, c)
+}
+
+// Points graphsync at the link system registered for the proposal, if there is
+// one - called by the data transfer manager as channels are opened or
+// restarted
+func (client *Client) configureRetrievalTransport(
+	chanID datatransfer.ChannelID,
+	voucher datatransfer.Voucher,
+	transport datatransfer.Transport,
+) {
+	proposal, ok := voucher.(*retrievalmarket.DealProposal)
+	if !ok {
+		return
+	}
+
+	client.retrievalLinkSystemsLk.Lock()
+	lsys, ok := client.retrievalLinkSystems[proposal.ID]
+	client.retrievalLinkSystemsLk.Unlock()
+	if !ok {
+		return
+	}
+
+	gsTransport, ok := transport.(*graphsync.Transport)
+	if !ok {
+		log.Errorf("Cannot stream retrieval over unexpected transport type %T", transport)
+		return
+	}
+
+	if err := gsTransport.UseStore(chanID, lsys); err != nil {
+		log.Errorf("Failed to set link system for retrieval channel %s: %v", chanID, err)
+	}
+}
@@ -0,0 +1,172 @@
+package filclient
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-merkledag"
+	carv2 "github.com/ipld/go-car/v2"
+	"github.com/libp2p/go-libp2p/core/test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreamingRetrievalTransfer(t *testing.T) {
+	ctx := context.Background()
+
+	root, size, carData := testHTTPRetrievalCAR(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(carData)
+	}))
+	defer server.Close()
+
+	// Reads back the streamed CAR, checking it has the root and every block
+	// exactly once
+	readCAR := func(t *testing.T, data []byte) {
+		reader, err := carv2.NewBlockReader(bytes.NewReader(data))
+		require.NoError(t, err)
+		require.Equal(t, []cid.Cid{root}, reader.Roots)
+
+		seen := cid.NewSet()
+		var streamed uint64
+		for {
+			block, err := reader.Next()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			require.True(t, seen.Visit(block.Cid()), "block %s streamed twice", block.Cid())
+			streamed += uint64(len(block.RawData()))
+		}
+		require.True(t, seen.Has(root))
+		require.Equal(t, size, streamed)
+	}
+
+	retrieve := func(t *testing.T, fc *Client, options ...RetrievalOption) *RetrievalTransfer {
+		handle := fc.StorageProviderByPeerID(test.RandPeerIDFatal(t))
+		transfer, err := handle.StartHTTPRetrievalTransfer(ctx, server.URL, root, options...)
+		require.NoError(t, err)
+
+		select {
+		case <-transfer.Done():
+		case <-time.After(10 * time.Second):
+			t.Fatal("Retrieval did not finish")
+		}
+
+		require.NoError(t, transfer.Err())
+		require.Equal(t, size, transfer.Progress())
+
+		return transfer
+	}
+
+	t.Run("without persisting", func(t *testing.T) {
+		fc := initStandaloneClient(t, ctx, initDatastore(t))
+
+		var buf bytes.Buffer
+		transfer := retrieve(t, fc, RetrievalWithCARWriter(&buf), RetrievalWithoutPersisting())
+		readCAR(t, buf.Bytes())
+
+		has, err := fc.bs.Has(ctx, root)
+		require.NoError(t, err)
+		require.False(t, has)
+
+		// The temporary blockstore is gone once the transfer finishes
+		require.NotEmpty(t, transfer.blockWriter.tmpDir)
+		_, err = os.Stat(transfer.blockWriter.tmpDir)
+		require.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("persisting", func(t *testing.T) {
+		fc := initStandaloneClient(t, ctx, initDatastore(t))
+
+		var buf bytes.Buffer
+		retrieve(t, fc, RetrievalWithCARWriter(&buf))
+		readCAR(t, buf.Bytes())
+
+		has, err := fc.bs.Has(ctx, root)
+		require.NoError(t, err)
+		require.True(t, has)
+	})
+
+	t.Run("piece", func(t *testing.T) {
+		fc := initStandaloneClient(t, ctx, initDatastore(t))
+
+		// The roots only become known once the piece starts arriving
+		var buf bytes.Buffer
+		handle := fc.StorageProviderByPeerID(test.RandPeerIDFatal(t))
+		transfer, err := handle.StartHTTPPieceRetrievalTransfer(
+			ctx,
+			server.URL,
+			merkledag.NewRawNode([]byte("piece")).Cid(),
+			RetrievalWithCARWriter(&buf),
+			RetrievalWithoutPersisting(),
+		)
+		require.NoError(t, err)
+		<-transfer.Done()
+
+		require.NoError(t, transfer.Err())
+		readCAR(t, buf.Bytes())
+	})
+
+	t.Run("nothing to stream", func(t *testing.T) {
+		fc := initStandaloneClient(t, ctx, initDatastore(t))
+
+		handle := fc.StorageProviderByPeerID(test.RandPeerIDFatal(t))
+		_, err := handle.StartHTTPRetrievalTransfer(ctx, server.URL, root, RetrievalWithoutPersisting())
+		require.ErrorIs(t, err, ErrRetrievalNothingToStream)
+	})
+}
+
+func TestRetrievalCAROutputAcrossAttempts(t *testing.T) {
+	ctx := context.Background()
+
+	a := merkledag.NewRawNode([]byte("a"))
+	b := merkledag.NewRawNode([]byte("b"))
+
+	var buf bytes.Buffer
+	cfg := RetrievalConfig{
+		carWriter: &buf,
+		noPersist: true,
+		carOutput: newRetrievalCAROutput(&buf, a.Cid()),
+	}
+
+	// The first attempt fails after one block, and the second gets everything
+	first, err := newRetrievalBlockWriter(initBlockstore(t), a.Cid(), cfg)
+	require.NoError(t, err)
+	defer first.close()
+	require.NoError(t, first.put(ctx, a))
+
+	second, err := newRetrievalBlockWriter(initBlockstore(t), a.Cid(), cfg)
+	require.NoError(t, err)
+	defer second.close()
+	require.NoError(t, second.put(ctx, a))
+	require.NoError(t, second.put(ctx, b))
+
+	// The second attempt can still load the block it was sent, even though it
+	// went to the CAR in the first
+	has, err := second.has(ctx, a.Cid())
+	require.NoError(t, err)
+	require.True(t, has)
+
+	reader, err := carv2.NewBlockReader(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	require.Equal(t, []cid.Cid{a.Cid()}, reader.Roots)
+
+	var streamed []cid.Cid
+	for {
+		block, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		streamed = append(streamed, block.Cid())
+	}
+	require.Equal(t, []cid.Cid{a.Cid(), b.Cid()}, streamed)
+}
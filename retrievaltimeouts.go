@@ -0,0 +1,181 @@
+package filclient
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// retrievaltimeouts.go - per-phase timeouts and stall detection for retrieval
+// transfers
+
+type RetrievalTimeoutPhase uint
+
+const (
+	// No timeout has fired
+	RetrievalTimeoutPhaseNone RetrievalTimeoutPhase = iota
+
+	// The provider didn't accept the proposal in time
+	RetrievalTimeoutPhaseAccept
+
+	// The provider didn't send the first byte in time
+	RetrievalTimeoutPhaseFirstByte
+
+	// The provider stopped sending data partway through
+	RetrievalTimeoutPhaseStall
+
+	// The transfer as a whole took too long
+	RetrievalTimeoutPhaseTotal
+)
+
+func (phase RetrievalTimeoutPhase) String() string {
+	switch phase {
+	case RetrievalTimeoutPhaseNone:
+		return "none"
+	case RetrievalTimeoutPhaseAccept:
+		return "accept"
+	case RetrievalTimeoutPhaseFirstByte:
+		return "first byte"
+	case RetrievalTimeoutPhaseStall:
+		return "stall"
+	case RetrievalTimeoutPhaseTotal:
+		return "total"
+	default:
+		return "unknown"
+	}
+}
+
+// Limits on how long each phase of a retrieval transfer may take - zero means
+// no limit
+type retrievalTimeouts struct {
+	accept    time.Duration
+	firstByte time.Duration
+	stall     time.Duration
+	total     time.Duration
+}
+
+func (timeouts retrievalTimeouts) any() bool {
+	return timeouts.accept != 0 ||
+		timeouts.firstByte != 0 ||
+		timeouts.stall != 0 ||
+		timeouts.total != 0
+}
+
+// How often to check the timeouts - a quarter of the shortest one, kept
+// between 10ms and 1s
+func (timeouts retrievalTimeouts) checkInterval() time.Duration {
+	interval := time.Second
+	for _, timeout := range []time.Duration{
+		timeouts.accept,
+		timeouts.firstByte,
+		timeouts.stall,
+		timeouts.total,
+	} {
+		if timeout != 0 && timeout/4 < interval {
+			interval = timeout / 4
+		}
+	}
+
+	if interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+
+	return interval
+}
+
+// Which phase, if any, has run over its timeout at the given time - none
+// while the transfer is being verified, and the transfer lock must be held
+func (transfer *RetrievalTransfer) expiredPhase(now time.Time) (RetrievalTimeoutPhase, time.Duration) {
+	if transfer.verifying {
+		return RetrievalTimeoutPhaseNone, 0
+	}
+
+	timeouts := transfer.timeouts
+
+	if timeouts.total != 0 && now.Sub(transfer.startTime) > timeouts.total {
+		return RetrievalTimeoutPhaseTotal, timeouts.total
+	}
+
+	if timeouts.accept != 0 && transfer.acceptTime.IsZero() && transfer.firstByteTime.IsZero() &&
+		now.Sub(transfer.startTime) > timeouts.accept {
+		return RetrievalTimeoutPhaseAccept, timeouts.accept
+	}
+
+	if timeouts.firstByte != 0 && transfer.firstByteTime.IsZero() &&
+		now.Sub(transfer.startTime) > timeouts.firstByte {
+		return RetrievalTimeoutPhaseFirstByte, timeouts.firstByte
+	}
+
+	if timeouts.stall != 0 && !transfer.firstByteTime.IsZero() &&
+		now.Sub(transfer.lastDataTime) > timeouts.stall {
+		return RetrievalTimeoutPhaseStall, timeouts.stall
+	}
+
+	return RetrievalTimeoutPhaseNone, 0
+}
+
+// Watches the transfer until it is done, cancelling the channel and marking
+// the transfer errored if any phase runs over its timeout
+func (transfer *RetrievalTransfer) watchTimeouts(ctx context.Context) {
+	transfer.lk.Lock()
+	timeouts := transfer.timeouts
+	done := transfer.done()
+	transfer.lk.Unlock()
+
+	if !timeouts.any() {
+		return
+	}
+
+	ticker := time.NewTicker(timeouts.checkInterval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			transfer.lk.Lock()
+			phase, timeout := transfer.expiredPhase(now)
+			if phase != RetrievalTimeoutPhaseNone {
+				transfer.timedOutPhase = phase
+			}
+			transfer.lk.Unlock()
+
+			if phase == RetrievalTimeoutPhaseNone {
+				continue
+			}
+
+			errKind := ErrRetrievalTimedOut
+			if phase == RetrievalTimeoutPhaseStall {
+				errKind = ErrRetrievalStalled
+			}
+
+			log.Warnf("Retrieval transfer %s timed out in %s phase", transfer.chanID, phase)
+
+			if err := transfer.finish(
+				ctx,
+				RetrievalTransferStatusErrored,
+				errKind,
+				fmt.Sprintf("%s timeout of %s exceeded", phase, timeout),
+			); err != nil {
+				// The transfer finished some other way in the meantime
+				log.Debugf("Could not finish timed out retrieval transfer: %v", err)
+
+				transfer.lk.Lock()
+				transfer.timedOutPhase = RetrievalTimeoutPhaseNone
+				transfer.lk.Unlock()
+			}
+
+			return
+		}
+	}
+}
+
+// The phase whose timeout ended the transfer, or RetrievalTimeoutPhaseNone if
+// no timeout fired
+func (transfer *RetrievalTransfer) TimedOutPhase() RetrievalTimeoutPhase {
+	transfer.lk.Lock()
+	defer transfer.lk.Unlock()
+
+	return transfer.timedOutPhase
+}
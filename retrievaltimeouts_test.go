@@ -0,0 +1,119 @@
+package filclient
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetrievalTransferExpiredPhase(t *testing.T) {
+	start := time.Now()
+	transfer := &RetrievalTransfer{
+		timeouts: retrievalTimeouts{
+			accept:    time.Second,
+			firstByte: 2 * time.Second,
+			stall:     time.Second,
+			total:     time.Minute,
+		},
+		startTime: start,
+	}
+
+	phase, _ := transfer.expiredPhase(start.Add(500 * time.Millisecond))
+	require.Equal(t, RetrievalTimeoutPhaseNone, phase)
+
+	phase, _ = transfer.expiredPhase(start.Add(1500 * time.Millisecond))
+	require.Equal(t, RetrievalTimeoutPhaseAccept, phase)
+
+	transfer.acceptTime = start.Add(time.Second)
+	phase, _ = transfer.expiredPhase(start.Add(2500 * time.Millisecond))
+	require.Equal(t, RetrievalTimeoutPhaseFirstByte, phase)
+
+	transfer.firstByteTime = start.Add(2 * time.Second)
+	transfer.lastDataTime = start.Add(10 * time.Second)
+	phase, _ = transfer.expiredPhase(start.Add(10500 * time.Millisecond))
+	require.Equal(t, RetrievalTimeoutPhaseNone, phase)
+
+	phase, timeout := transfer.expiredPhase(start.Add(12 * time.Second))
+	require.Equal(t, RetrievalTimeoutPhaseStall, phase)
+	require.Equal(t, time.Second, timeout)
+
+	transfer.lastDataTime = start.Add(2 * time.Minute)
+	phase, _ = transfer.expiredPhase(start.Add(2 * time.Minute))
+	require.Equal(t, RetrievalTimeoutPhaseTotal, phase)
+
+	// Nothing expires while the DAG is verified
+	transfer.verifying = true
+	phase, _ = transfer.expiredPhase(start.Add(time.Hour))
+	require.Equal(t, RetrievalTimeoutPhaseNone, phase)
+}
+
+func TestRetrievalTransferTimeout(t *testing.T) {
+	ctx := context.Background()
+	fc := initStandaloneClient(t, ctx, initDatastore(t))
+
+	record := testRetrievalTransferRecord(t)
+	transfer := fc.retrievalTransferFromRecord(record)
+	transfer.timeouts.firstByte = 50 * time.Millisecond
+	transfer.startTime = time.Now()
+	fc.retrievalTransfers[record.ChannelID] = transfer
+
+	go transfer.watchTimeouts(ctx)
+
+	select {
+	case <-transfer.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Transfer did not time out")
+	}
+
+	require.Equal(t, RetrievalTransferStatusErrored, transfer.State())
+	require.Equal(t, RetrievalTimeoutPhaseFirstByte, transfer.TimedOutPhase())
+	require.ErrorIs(t, transfer.Err(), ErrRetrievalTimedOut)
+}
+
+func TestRetrieveTimeoutsCatchSilentProvider(t *testing.T) {
+	ctx := context.Background()
+
+	root, _, _ := testHTTPRetrievalCAR(t)
+
+	// Accepts the request, then never sends any data
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	fc := initStandaloneClient(t, ctx, initDatastore(t))
+	fc.retrievalStallTimeout = 100 * time.Millisecond
+	handle := fc.StorageProviderByPeerID(test.RandPeerIDFatal(t))
+
+	// The options Client.Retrieve adds when the retrieval sets no timeouts
+	transfer, err := handle.StartHTTPRetrievalTransfer(ctx, server.URL, root, fc.retrieveTimeoutOptions(RetrievalConfig{})...)
+	require.NoError(t, err)
+
+	select {
+	case <-transfer.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Silent provider was not timed out")
+	}
+
+	require.Equal(t, RetrievalTransferStatusErrored, transfer.State())
+	require.Equal(t, RetrievalTimeoutPhaseFirstByte, transfer.TimedOutPhase())
+
+	// Timeouts the retrieval sets itself are left alone
+	var cfg RetrievalConfig
+	for _, option := range fc.retrieveTimeoutOptions(RetrievalConfig{timeouts: retrievalTimeouts{firstByte: time.Hour}}) {
+		option(&cfg)
+	}
+	require.Equal(t, retrievalTimeouts{stall: 100 * time.Millisecond}, cfg.timeouts)
+}
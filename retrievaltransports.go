@@ -0,0 +1,365 @@
+package filclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/schema"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// retrievaltransports.go - discovery of the retrieval transports a provider
+// supports, and automatic selection between them
+
+var (
+	ErrRetrievalTransportNotSupported = errors.New("retrieval transport not supported by provider")
+	ErrUnknownRetrievalTransport      = errors.New("unknown retrieval transport")
+	ErrRetrievalPieceNotSupported     = errors.New("retrieval transport cannot retrieve from a specific piece")
+)
+
+const retrievalTransportsProtocolID = "/fil/retrieval/transports/1.0.0"
+
+// The order transports are picked in when the provider supports more than one
+// and the retrieval lets the transport be picked (see
+// RetrievalWithAutoTransport) - HTTP is the cheapest for both sides, and
+// graphsync copes with large DAGs better than bitswap
+var retrievalTransportPreference = []RetrievalTransport{
+	RetrievalTransportHTTP,
+	RetrievalTransportGraphsync,
+	RetrievalTransportBitswap,
+}
+
+// Parses the name of a transport as returned by RetrievalTransport.String()
+func ParseRetrievalTransport(str string) (RetrievalTransport, error) {
+	for _, transport := range retrievalTransportPreference {
+		if transport.String() == str {
+			return transport, nil
+		}
+	}
+
+	return 0, fmt.Errorf("%w: %s", ErrUnknownRetrievalTransport, str)
+}
+
+// A retrieval transport supported by a provider, and the addresses it can be
+// reached at
+type RetrievalTransportInfo struct {
+	Transport RetrievalTransport
+	Addresses []multiaddr.Multiaddr
+}
+
+// The wire format of the transports protocol response
+type retrievalTransportsResponse struct {
+	Protocols []retrievalTransportsProtocol
+}
+
+type retrievalTransportsProtocol struct {
+	Name      string
+	Addresses [][]byte
+}
+
+var retrievalTransportsResponseType = func() schema.Type {
+	ts, err := ipld.LoadSchemaBytes([]byte(`
+		type Multiaddr bytes
+
+		type Protocol struct {
+			Name String
+			Addresses [Multiaddr]
+		}
+
+		type QueryResponse struct {
+			Protocols [Protocol]
+		}
+	`))
+	if err != nil {
+		panic(err)
+	}
+
+	return ts.TypeByName("QueryResponse")
+}()
+
+// The provider sends its transports as soon as the stream is opened - the
+// response is a short list, so anything much bigger is refused
+var retrievalTransportsQueryProtocol = rpcProtocol[struct{}, retrievalTransportsResponse]{
+	versions: []rpcVersion[struct{}, retrievalTransportsResponse]{
+		receiveOnlyRPCVersion[retrievalTransportsResponse](retrievalTransportsProtocolID, retrievalTransportsResponseType),
+	},
+	maxResponseSize: 64 << 10,
+}
+
+// Maps the protocol names used by the transports protocol - graphsync is
+// listed as libp2p
+func retrievalTransportFromProtocolName(name string) (RetrievalTransport, bool) {
+	switch name {
+	case "libp2p", "graphsync":
+		return RetrievalTransportGraphsync, true
+	case "bitswap":
+		return RetrievalTransportBitswap, true
+	case "http":
+		return RetrievalTransportHTTP, true
+	default:
+		return 0, false
+	}
+}
+
+// Asks the provider which retrieval transports it supports - transports this
+// client doesn't know about are left out
+func (handle *StorageProviderHandle) QueryRetrievalTransports(ctx context.Context) ([]RetrievalTransportInfo, error) {
+	resp, version, err := runRPC(ctx, handle, retrievalTransportsQueryProtocol, struct{}{})
+	if err != nil {
+		return nil, err
+	}
+	log.Debugf("Queried retrieval transports of %s over %s", handle.peerID, version)
+
+	var infos []RetrievalTransportInfo
+	for _, protocol := range resp.Protocols {
+		transport, ok := retrievalTransportFromProtocolName(protocol.Name)
+		if !ok {
+			log.Debugf("Ignoring unknown retrieval transport %s", protocol.Name)
+			continue
+		}
+
+		info := RetrievalTransportInfo{Transport: transport}
+		for _, addrBytes := range protocol.Addresses {
+			addr, err := multiaddr.NewMultiaddrBytes(addrBytes)
+			if err != nil {
+				log.Debugf("Ignoring invalid %s transport multiaddr: %v", transport, err)
+				continue
+			}
+			info.Addresses = append(info.Addresses, addr)
+		}
+
+		infos = append(infos, info)
+	}
+
+	return infos, nil
+}
+
+// Start running a retrieval over graphsync, the transport set with
+// RetrievalWithTransport, or the best one the provider supports if the
+// retrieval uses RetrievalWithAutoTransport
+//
+// Providers that don't answer the transports query are assumed to only
+// support graphsync, and if the DAG is already complete locally, the provider
+// isn't contacted at all. Transports other than graphsync query the retrieval
+// ask for the size of the transfer, unless it's given with RetrievalWithAsk
+//
+// If the client's concurrency limits are reached, this blocks until the
+// retrieval's turn comes up in the queue (see RetrievalWithPriority), or the
+// context is cancelled
+func (handle *StorageProviderHandle) StartRetrievalTransfer(
+	ctx context.Context,
+	payloadCid cid.Cid,
+	options ...RetrievalOption,
+) (*RetrievalTransfer, error) {
+	if err := handle.CheckPolicy(ctx); err != nil {
+		return nil, err
+	}
+
+	var cfg RetrievalConfig
+	for _, option := range options {
+		option(&cfg)
+	}
+
+	// Nothing to queue for if the data is already here
+	localTransfer, localSize, err := handle.client.completeRetrievalLocally(ctx, payloadCid, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if localTransfer != nil {
+		return localTransfer, nil
+	}
+
+	// The transport doesn't need to walk the local DAG again
+	cfg.localSize = &localSize
+	options = append(append([]RetrievalOption{}, options...), func(cfg *RetrievalConfig) {
+		cfg.localSize = &localSize
+	})
+
+	peerID, err := handle.PeerID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Wait for a slot, which is held until the transfer is done
+	release, err := handle.client.retrievalScheduler.acquire(ctx, peerID, cfg.priority, cfg.onQueuePosition)
+	if err != nil {
+		return nil, err
+	}
+
+	transfer, err := handle.startRetrievalTransfer(ctx, payloadCid, cfg, options)
+	if err != nil {
+		release()
+		return nil, err
+	}
+
+	go func() {
+		<-transfer.Done()
+		release()
+	}()
+
+	return transfer, nil
+}
+
+func (handle *StorageProviderHandle) startRetrievalTransfer(
+	ctx context.Context,
+	payloadCid cid.Cid,
+	cfg RetrievalConfig,
+	options []RetrievalOption,
+) (*RetrievalTransfer, error) {
+	// Unless another transport was asked for, graphsync is used, so there's no
+	// need to ask the provider what it supports
+	supported := []RetrievalTransportInfo{{Transport: RetrievalTransportGraphsync}}
+	if cfg.transportForced || cfg.transportAuto {
+		queried, err := handle.QueryRetrievalTransports(ctx)
+		if err != nil {
+			log.Debugf("Could not query retrieval transports, assuming graphsync only: %v", err)
+		} else {
+			supported = queried
+		}
+	}
+
+	info, err := chooseRetrievalTransport(supported, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Infof("Retrieving over %s", info.Transport)
+
+	// The graphsync transport queries the ask itself, but the others only need
+	// it for the size of the transfer, so a failed query doesn't stop them
+	if info.Transport != RetrievalTransportGraphsync && cfg.ask == nil {
+		ask, err := handle.QueryRetrievalAsk(ctx, payloadCid, options...)
+		if err != nil {
+			log.Debugf("Could not query retrieval ask, transfer size will be unknown: %v", err)
+		} else {
+			options = append(options, RetrievalWithAsk(ask))
+		}
+	}
+
+	switch info.Transport {
+	case RetrievalTransportHTTP:
+		endpoint, err := httpEndpointFromMultiaddrs(info.Addresses)
+		if err != nil {
+			return nil, err
+		}
+		return handle.StartHTTPRetrievalTransfer(ctx, endpoint, payloadCid, options...)
+	case RetrievalTransportBitswap:
+		peers := handle.connectBitswapPeers(ctx, info.Addresses)
+		options = append(options, func(cfg *RetrievalConfig) {
+			cfg.bitswapPeers = peers
+		})
+		return handle.StartBitswapRetrievalTransfer(ctx, payloadCid, options...)
+	default:
+		return handle.StartGraphsyncRetrievalTransfer(ctx, payloadCid, options...)
+	}
+}
+
+// Picks the most preferred transport that's supported and usable with the
+// config, which is graphsync unless the config forces a transport or lets it
+// be picked automatically - only graphsync can be scoped to a piece, so it's
+// the only choice if the config has a piece CID
+func chooseRetrievalTransport(supported []RetrievalTransportInfo, cfg RetrievalConfig) (RetrievalTransportInfo, error) {
+	if cfg.pieceCid != nil && cfg.transportForced && cfg.transport != RetrievalTransportGraphsync {
+		return RetrievalTransportInfo{}, fmt.Errorf("%w: %s", ErrRetrievalPieceNotSupported, cfg.transport)
+	}
+
+	usable := func(info RetrievalTransportInfo) bool {
+		if cfg.pieceCid != nil {
+			return info.Transport == RetrievalTransportGraphsync
+		}
+
+		if info.Transport != RetrievalTransportHTTP {
+			return true
+		}
+
+		if cfg.selector != nil {
+			return false
+		}
+
+		_, err := httpEndpointFromMultiaddrs(info.Addresses)
+		return err == nil
+	}
+
+	preference := []RetrievalTransport{RetrievalTransportGraphsync}
+	if cfg.transportForced {
+		preference = []RetrievalTransport{cfg.transport}
+	} else if cfg.transportAuto {
+		preference = retrievalTransportPreference
+	}
+
+	for _, transport := range preference {
+		for _, info := range supported {
+			if info.Transport == transport && usable(info) {
+				return info, nil
+			}
+		}
+	}
+
+	if cfg.transportForced {
+		return RetrievalTransportInfo{}, fmt.Errorf("%w: %s", ErrRetrievalTransportNotSupported, cfg.transport)
+	}
+
+	return RetrievalTransportInfo{}, ErrRetrievalTransportNotSupported
+}
+
+// Returns the URL of the first HTTP endpoint in the list
+func httpEndpointFromMultiaddrs(addrs []multiaddr.Multiaddr) (string, error) {
+	for _, addr := range addrs {
+		var host, port, scheme string
+		multiaddr.ForEach(addr, func(c multiaddr.Component) bool {
+			switch c.Protocol().Code {
+			case multiaddr.P_IP4, multiaddr.P_IP6, multiaddr.P_DNS, multiaddr.P_DNS4, multiaddr.P_DNS6:
+				host = c.Value()
+			case multiaddr.P_TCP:
+				port = c.Value()
+			case multiaddr.P_TLS, multiaddr.P_HTTPS:
+				scheme = "https"
+			case multiaddr.P_HTTP:
+				if scheme == "" {
+					scheme = "http"
+				}
+			}
+			return true
+		})
+
+		if host == "" || scheme == "" {
+			continue
+		}
+
+		if port != "" {
+			host = net.JoinHostPort(host, port)
+		}
+
+		return scheme + "://" + host, nil
+	}
+
+	return "", fmt.Errorf("%w: no usable HTTP endpoint in %v", ErrRetrievalTransportNotSupported, addrs)
+}
+
+// Bitswap may be served from a different peer than the provider itself, in
+// which case its addresses include the peer ID - connecting to it makes it
+// available to the bitswap session, which only uses the peers returned here
+// besides the provider
+func (handle *StorageProviderHandle) connectBitswapPeers(ctx context.Context, addrs []multiaddr.Multiaddr) []peer.ID {
+	var peers []peer.ID
+	for _, addr := range addrs {
+		info, err := peer.AddrInfoFromP2pAddr(addr)
+		if err != nil {
+			continue
+		}
+
+		if err := handle.client.host.Connect(ctx, *info); err != nil {
+			log.Warnf("Could not connect to bitswap peer %s: %v", info.ID, err)
+			continue
+		}
+
+		peers = append(peers, info.ID)
+	}
+
+	return peers
+}
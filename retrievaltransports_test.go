@@ -0,0 +1,228 @@
+package filclient
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	cborutil "github.com/filecoin-project/go-cbor-util"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-merkledag"
+	carv2 "github.com/ipld/go-car/v2"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/codec/dagcbor"
+	selectorparse "github.com/ipld/go-ipld-prime/traversal/selector/parse"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/test"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryRetrievalTransports(t *testing.T) {
+	ctx := context.Background()
+
+	httpAddr := multiaddr.StringCast("/dns/provider.example/tcp/443/https")
+	fc, provider := initTransportsTestClient(t, ctx, retrievalTransportsResponse{
+		Protocols: []retrievalTransportsProtocol{
+			{Name: "libp2p", Addresses: [][]byte{multiaddr.StringCast("/ip4/1.2.3.4/tcp/1234").Bytes()}},
+			{Name: "http", Addresses: [][]byte{httpAddr.Bytes()}},
+			{Name: "carrier-pigeon"},
+		},
+	})
+
+	infos, err := fc.StorageProviderByPeerID(provider.ID()).QueryRetrievalTransports(ctx)
+	require.NoError(t, err)
+	require.Len(t, infos, 2)
+	require.Equal(t, RetrievalTransportGraphsync, infos[0].Transport)
+	require.Equal(t, RetrievalTransportHTTP, infos[1].Transport)
+	require.Equal(t, []multiaddr.Multiaddr{httpAddr}, infos[1].Addresses)
+
+	endpoint, err := httpEndpointFromMultiaddrs(infos[1].Addresses)
+	require.NoError(t, err)
+	require.Equal(t, "https://provider.example:443", endpoint)
+
+	// Responses far bigger than any real list of transports are refused
+	var oversized retrievalTransportsResponse
+	for i := 0; i < 2000; i++ {
+		oversized.Protocols = append(oversized.Protocols, retrievalTransportsProtocol{
+			Name:      "http",
+			Addresses: [][]byte{httpAddr.Bytes()},
+		})
+	}
+	fc, provider = initTransportsTestClient(t, ctx, oversized)
+
+	_, err = fc.StorageProviderByPeerID(provider.ID()).QueryRetrievalTransports(ctx)
+	require.ErrorIs(t, err, ErrRPCResponseTooLarge)
+}
+
+func TestChooseRetrievalTransport(t *testing.T) {
+	graphsync := RetrievalTransportInfo{Transport: RetrievalTransportGraphsync}
+	bitswap := RetrievalTransportInfo{Transport: RetrievalTransportBitswap}
+	httpInfo := RetrievalTransportInfo{
+		Transport: RetrievalTransportHTTP,
+		Addresses: []multiaddr.Multiaddr{multiaddr.StringCast("/ip4/127.0.0.1/tcp/80/http")},
+	}
+	httpWithoutAddrs := RetrievalTransportInfo{Transport: RetrievalTransportHTTP}
+
+	all := []RetrievalTransportInfo{bitswap, graphsync, httpInfo}
+	pieceCid := merkledag.NewRawNode([]byte("piece")).Cid()
+
+	for _, tc := range []struct {
+		name      string
+		supported []RetrievalTransportInfo
+		options   []RetrievalOption
+		expected  RetrievalTransport
+		err       error
+	}{
+		{name: "graphsync by default", supported: all, expected: RetrievalTransportGraphsync},
+		{name: "preferred", supported: all, options: []RetrievalOption{RetrievalWithAutoTransport()}, expected: RetrievalTransportHTTP},
+		{name: "selector skips http", supported: all, options: []RetrievalOption{RetrievalWithAutoTransport(), RetrievalWithSelector(selectorparse.CommonSelector_ExploreAllRecursively)}, expected: RetrievalTransportGraphsync},
+		{name: "http without endpoint", supported: []RetrievalTransportInfo{httpWithoutAddrs, bitswap}, options: []RetrievalOption{RetrievalWithAutoTransport()}, expected: RetrievalTransportBitswap},
+		{name: "forced", supported: all, options: []RetrievalOption{RetrievalWithTransport(RetrievalTransportBitswap)}, expected: RetrievalTransportBitswap},
+		{name: "forced unsupported", supported: []RetrievalTransportInfo{graphsync}, options: []RetrievalOption{RetrievalWithTransport(RetrievalTransportHTTP)}, err: ErrRetrievalTransportNotSupported},
+		{name: "piece only uses graphsync", supported: all, options: []RetrievalOption{RetrievalWithAutoTransport(), RetrievalWithPieceCID(pieceCid)}, expected: RetrievalTransportGraphsync},
+		{name: "piece without graphsync", supported: []RetrievalTransportInfo{httpInfo, bitswap}, options: []RetrievalOption{RetrievalWithAutoTransport(), RetrievalWithPieceCID(pieceCid)}, err: ErrRetrievalTransportNotSupported},
+		{name: "piece forced over http", supported: all, options: []RetrievalOption{RetrievalWithPieceCID(pieceCid), RetrievalWithTransport(RetrievalTransportHTTP)}, err: ErrRetrievalPieceNotSupported},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var cfg RetrievalConfig
+			for _, option := range tc.options {
+				option(&cfg)
+			}
+
+			info, err := chooseRetrievalTransport(tc.supported, cfg)
+			if tc.err != nil {
+				require.ErrorIs(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, info.Transport)
+		})
+	}
+}
+
+func TestStartRetrievalTransferPicksTransport(t *testing.T) {
+	ctx := context.Background()
+
+	root, size, carData := testHTTPRetrievalCAR(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(carData)
+	}))
+	defer server.Close()
+
+	port := server.Listener.Addr().(*net.TCPAddr).Port
+	httpAddr := multiaddr.StringCast(fmt.Sprintf("/ip4/127.0.0.1/tcp/%d/http", port))
+
+	fc, provider := initTransportsTestClient(t, ctx, retrievalTransportsResponse{
+		Protocols: []retrievalTransportsProtocol{
+			{Name: "libp2p"},
+			{Name: "http", Addresses: [][]byte{httpAddr.Bytes()}},
+		},
+	})
+
+	// The ask is queried for the size of the transfer
+	provider.SetStreamHandler(retrievalmarket.QueryProtocolID, func(stream network.Stream) {
+		defer stream.Close()
+
+		var query retrievalmarket.Query
+		if err := cborutil.ReadCborRPC(stream, &query); err != nil {
+			return
+		}
+		resp := retrievalmarket.QueryResponse{
+			Status:        retrievalmarket.QueryResponseAvailable,
+			PieceCIDFound: retrievalmarket.QueryItemAvailable,
+			Size:          size,
+		}
+		resp.PaymentAddress, _ = address.NewIDAddress(1000)
+		cborutil.WriteCborRPC(stream, &resp)
+	})
+
+	transfer, err := fc.StorageProviderByPeerID(provider.ID()).StartRetrievalTransfer(ctx, root, RetrievalWithAutoTransport())
+	require.NoError(t, err)
+	require.Equal(t, RetrievalTransportHTTP, transfer.Transport())
+	require.Equal(t, size, transfer.Size())
+
+	select {
+	case <-transfer.Done():
+	case <-time.After(10 * time.Second):
+		t.Fatal("Retrieval did not finish")
+	}
+
+	require.NoError(t, transfer.Err())
+	require.Equal(t, size, transfer.Progress())
+}
+
+func TestStartRetrievalTransferCompleteLocally(t *testing.T) {
+	ctx := context.Background()
+
+	fc := initStandaloneClient(t, ctx, initDatastore(t))
+	root, _, size := testDAGCBOR(t, ctx, fc.bs)
+
+	// The provider doesn't exist, so anything other than a local retrieval
+	// would fail
+	handle := fc.StorageProviderByPeerID(test.RandPeerIDFatal(t))
+
+	transfer, err := handle.StartRetrievalTransfer(ctx, root)
+	require.NoError(t, err)
+	require.Equal(t, RetrievalTransportLocal, transfer.Transport())
+	<-transfer.Done()
+	require.Equal(t, RetrievalTransferStatusCompleted, transfer.State())
+	require.Equal(t, size, transfer.Progress())
+
+	// Streaming still gets the blocks written out
+	var buf bytes.Buffer
+	transfer, err = handle.StartRetrievalTransfer(ctx, root, RetrievalWithCARWriter(&buf), RetrievalWithoutPersisting())
+	require.NoError(t, err)
+	require.Equal(t, RetrievalTransportLocal, transfer.Transport())
+
+	reader, err := carv2.NewBlockReader(&buf)
+	require.NoError(t, err)
+	require.Equal(t, []cid.Cid{root}, reader.Roots)
+	var streamed uint64
+	for {
+		block, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		streamed += uint64(len(block.RawData()))
+	}
+	require.Equal(t, size, streamed)
+}
+
+// Creates a client connected to a provider peer that answers the transports
+// protocol with the given response
+func initTransportsTestClient(t *testing.T, ctx context.Context, resp retrievalTransportsResponse) (*Client, host.Host) {
+	mn := mocknet.New()
+	clientHost, err := mn.GenPeer()
+	require.NoError(t, err)
+	providerHost, err := mn.GenPeer()
+	require.NoError(t, err)
+	require.NoError(t, mn.LinkAll())
+
+	// Write errors are left alone, since the client hangs up on responses that
+	// are too large
+	providerHost.SetStreamHandler(retrievalTransportsProtocolID, func(stream network.Stream) {
+		defer stream.Close()
+		ipld.MarshalStreaming(stream, dagcbor.Encode, &resp, retrievalTransportsResponseType)
+	})
+
+	fc, err := New(ctx, clientHost, nil, address.Undef, initBlockstore(t), initDatastore(t))
+	require.NoError(t, err)
+	t.Cleanup(fc.Close)
+
+	_, err = mn.ConnectPeers(clientHost.ID(), providerHost.ID())
+	require.NoError(t, err)
+
+	return fc, providerHost
+}
@@ -0,0 +1,257 @@
+package filclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	cborutil "github.com/filecoin-project/go-cbor-util"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/codec/dagcbor"
+	"github.com/ipld/go-ipld-prime/schema"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// rpc.go - typed request/response streams to storage providers, negotiating
+// the best protocol version both sides support
+
+var (
+	ErrRPCResponseTooLarge = errors.New("RPC response too large")
+)
+
+// The largest response message accepted, for protocols that don't set their
+// own limit
+const defaultMaxRPCResponseSize = 1 << 20
+
+// One version of an RPC protocol, translating between the request and response
+// types used by callers and the version's wire format
+type rpcVersion[Req any, Resp any] struct {
+	id           protocol.ID
+	writeRequest func(w io.Writer, req Req) error
+	readResponse func(r io.Reader) (Resp, error)
+}
+
+// A version whose wire format is Req and Resp themselves, CBOR-encoded
+func cborRPCVersion[Req any, Resp any](id protocol.ID) rpcVersion[Req, Resp] {
+	return rpcVersion[Req, Resp]{
+		id: id,
+		writeRequest: func(w io.Writer, req Req) error {
+			return cborutil.WriteCborRPC(w, &req)
+		},
+		readResponse: func(r io.Reader) (Resp, error) {
+			var resp Resp
+			err := cborutil.ReadCborRPC(r, &resp)
+			return resp, err
+		},
+	}
+}
+
+// A version with older CBOR wire types, which requests are converted to and
+// responses are converted from
+func migratedRPCVersion[Req any, Resp any, WireReq any, WireResp any](
+	id protocol.ID,
+	requestToWire func(Req) WireReq,
+	responseFromWire func(WireResp) (Resp, error),
+) rpcVersion[Req, Resp] {
+	wire := cborRPCVersion[WireReq, WireResp](id)
+
+	return rpcVersion[Req, Resp]{
+		id: id,
+		writeRequest: func(w io.Writer, req Req) error {
+			return wire.writeRequest(w, requestToWire(req))
+		},
+		readResponse: func(r io.Reader) (Resp, error) {
+			wireResp, err := wire.readResponse(r)
+			if err != nil {
+				var resp Resp
+				return resp, err
+			}
+			return responseFromWire(wireResp)
+		},
+	}
+}
+
+// A version for protocols where the provider sends its response as soon as the
+// stream opens, without a request - the response is DAG-CBOR with the schema
+// type
+func receiveOnlyRPCVersion[Resp any](id protocol.ID, respType schema.Type) rpcVersion[struct{}, Resp] {
+	return rpcVersion[struct{}, Resp]{
+		id: id,
+		writeRequest: func(w io.Writer, req struct{}) error {
+			return nil
+		},
+		readResponse: func(r io.Reader) (Resp, error) {
+			var resp Resp
+			_, err := ipld.UnmarshalStreaming(r, dagcbor.Decode, &resp, respType)
+			return resp, err
+		},
+	}
+}
+
+// All the versions of an RPC protocol that the client speaks
+type rpcProtocol[Req any, Resp any] struct {
+	// Most preferred first - the first one the provider supports is used
+	versions []rpcVersion[Req, Resp]
+
+	// The largest response message accepted, or 0 for
+	// defaultMaxRPCResponseSize
+	maxResponseSize int64
+}
+
+func (proto rpcProtocol[Req, Resp]) protocolIDs() []protocol.ID {
+	ids := make([]protocol.ID, len(proto.versions))
+	for i, version := range proto.versions {
+		ids[i] = version.id
+	}
+	return ids
+}
+
+// An open stream to a provider over the negotiated version of an RPC protocol,
+// for sending any number of requests and receiving any number of responses
+type rpcStream[Req any, Resp any] struct {
+	stream          network.Stream
+	version         rpcVersion[Req, Resp]
+	maxResponseSize int64
+}
+
+// Opens a stream with the best version of the protocol that the provider
+// supports - the stream's deadline follows the context's
+func openRPCStream[Req any, Resp any](
+	ctx context.Context,
+	handle *StorageProviderHandle,
+	proto rpcProtocol[Req, Resp],
+) (*rpcStream[Req, Resp], error) {
+	stream, err := handle.stream(ctx, proto.protocolIDs()...)
+	if err != nil {
+		return nil, err
+	}
+
+	var version *rpcVersion[Req, Resp]
+	for i := range proto.versions {
+		if proto.versions[i].id == stream.Protocol() {
+			version = &proto.versions[i]
+			break
+		}
+	}
+	if version == nil {
+		stream.Reset()
+		return nil, fmt.Errorf("%w: negotiated unrequested protocol %s", ErrMinerStreamFailed, stream.Protocol())
+	}
+
+	if dline, ok := ctx.Deadline(); ok {
+		stream.SetDeadline(dline)
+	}
+
+	maxResponseSize := proto.maxResponseSize
+	if maxResponseSize == 0 {
+		maxResponseSize = defaultMaxRPCResponseSize
+	}
+
+	return &rpcStream[Req, Resp]{
+		stream:          stream,
+		version:         *version,
+		maxResponseSize: maxResponseSize,
+	}, nil
+}
+
+// The protocol version that was negotiated
+func (stream *rpcStream[Req, Resp]) Protocol() protocol.ID {
+	return stream.version.id
+}
+
+func (stream *rpcStream[Req, Resp]) Send(req Req) error {
+	if err := stream.version.writeRequest(stream.stream, req); err != nil {
+		return fmt.Errorf("%w: %v", ErrCBORWriteFailed, err)
+	}
+
+	return nil
+}
+
+// Reads the next response, failing with ErrRPCResponseTooLarge if it's larger
+// than the protocol allows
+func (stream *rpcStream[Req, Resp]) Receive() (Resp, error) {
+	limited := &rpcLimitedReader{r: stream.stream, remaining: stream.maxResponseSize}
+
+	resp, err := stream.version.readResponse(limited)
+	if limited.exceeded {
+		var resp Resp
+		return resp, fmt.Errorf("%w: over %d bytes", ErrRPCResponseTooLarge, stream.maxResponseSize)
+	}
+	if err != nil {
+		var resp Resp
+		return resp, fmt.Errorf("%w: %v", ErrCBORReadFailed, err)
+	}
+
+	return resp, nil
+}
+
+// Tells the provider that no more requests will be sent, while responses can
+// still be received
+func (stream *rpcStream[Req, Resp]) CloseWrite() error {
+	return stream.stream.CloseWrite()
+}
+
+func (stream *rpcStream[Req, Resp]) Close() error {
+	return stream.stream.Close()
+}
+
+// Sends a single request and reads its response, returning the protocol
+// version that was used along with it - the exchange is limited to the
+// client's RPC timeout (see Config.RPCTimeout)
+func runRPC[Req any, Resp any](
+	ctx context.Context,
+	handle *StorageProviderHandle,
+	proto rpcProtocol[Req, Resp],
+	req Req,
+) (Resp, protocol.ID, error) {
+	var resp Resp
+
+	if handle.client.rpcTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, handle.client.rpcTimeout)
+		defer cancel()
+	}
+
+	stream, err := openRPCStream(ctx, handle, proto)
+	if err != nil {
+		return resp, "", err
+	}
+	defer stream.Close()
+
+	if err := stream.Send(req); err != nil {
+		return resp, stream.Protocol(), err
+	}
+
+	resp, err = stream.Receive()
+	if err != nil {
+		return resp, stream.Protocol(), err
+	}
+
+	return resp, stream.Protocol(), nil
+}
+
+// Fails reads past the limit instead of ending the stream early, so that an
+// oversized message can be told apart from a truncated one
+type rpcLimitedReader struct {
+	r         io.Reader
+	remaining int64
+	exceeded  bool
+}
+
+func (reader *rpcLimitedReader) Read(p []byte) (int, error) {
+	if reader.remaining <= 0 {
+		reader.exceeded = true
+		return 0, ErrRPCResponseTooLarge
+	}
+
+	if int64(len(p)) > reader.remaining {
+		p = p[:reader.remaining]
+	}
+
+	n, err := reader.r.Read(p)
+	reader.remaining -= int64(n)
+
+	return n, err
+}
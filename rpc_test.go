@@ -0,0 +1,139 @@
+package filclient
+
+import (
+	"context"
+	"testing"
+
+	"github.com/filecoin-project/go-address"
+	cborutil "github.com/filecoin-project/go-cbor-util"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	retrievalmigrations "github.com/filecoin-project/go-fil-markets/retrievalmarket/migrations"
+	"github.com/ipfs/go-merkledag"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRPCNegotiatesBestVersion(t *testing.T) {
+	ctx := context.Background()
+	payloadCid := merkledag.NewRawNode([]byte("payload")).Cid()
+
+	// Failures in the handlers surface as errors from runRPC, and what the old
+	// version was sent is checked below
+	oldQueries := make(chan retrievalmigrations.Query0, 1)
+	oldHandler := func(stream network.Stream) {
+		defer stream.Close()
+
+		var query retrievalmigrations.Query0
+		if err := cborutil.ReadCborRPC(stream, &query); err != nil {
+			stream.Reset()
+			return
+		}
+		oldQueries <- query
+
+		resp := retrievalmigrations.QueryResponse0{
+			Status:  retrievalmarket.QueryResponseAvailable,
+			Size:    1234,
+			Message: "old",
+		}
+		resp.PaymentAddress, _ = address.NewIDAddress(1000)
+		cborutil.WriteCborRPC(stream, &resp)
+	}
+	newHandler := func(stream network.Stream) {
+		defer stream.Close()
+
+		var query retrievalmarket.Query
+		if err := cborutil.ReadCborRPC(stream, &query); err != nil {
+			stream.Reset()
+			return
+		}
+
+		resp := retrievalmarket.QueryResponse{
+			Status:  retrievalmarket.QueryResponseAvailable,
+			Message: "new",
+		}
+		resp.PaymentAddress, _ = address.NewIDAddress(1000)
+		cborutil.WriteCborRPC(stream, &resp)
+	}
+
+	// A provider with only the old version
+	fc, provider := initTransportsTestClient(t, ctx, retrievalTransportsResponse{})
+	provider.SetStreamHandler(retrievalmarket.OldQueryProtocolID, oldHandler)
+	handle := fc.StorageProviderByPeerID(provider.ID())
+
+	resp, version, err := runRPC(ctx, handle, retrievalQueryProtocol, retrievalmarket.Query{PayloadCID: payloadCid})
+	require.NoError(t, err)
+	require.Equal(t, retrievalmarket.OldQueryProtocolID, version)
+	require.Equal(t, "old", resp.Message)
+	require.Equal(t, uint64(1234), resp.Size)
+	require.Equal(t, payloadCid, (<-oldQueries).PayloadCID)
+
+	// A provider with both prefers the current version
+	fc, provider = initTransportsTestClient(t, ctx, retrievalTransportsResponse{})
+	provider.SetStreamHandler(retrievalmarket.OldQueryProtocolID, oldHandler)
+	provider.SetStreamHandler(retrievalmarket.QueryProtocolID, newHandler)
+	handle = fc.StorageProviderByPeerID(provider.ID())
+
+	resp, version, err = runRPC(ctx, handle, retrievalQueryProtocol, retrievalmarket.Query{PayloadCID: payloadCid})
+	require.NoError(t, err)
+	require.Equal(t, retrievalmarket.QueryProtocolID, version)
+	require.Equal(t, "new", resp.Message)
+}
+
+func TestRPCStream(t *testing.T) {
+	ctx := context.Background()
+
+	const testProtocolID = protocol.ID("/filclient/test/rpc/1.0.0")
+	testProtocol := rpcProtocol[retrievalmarket.Query, retrievalmarket.QueryResponse]{
+		versions: []rpcVersion[retrievalmarket.Query, retrievalmarket.QueryResponse]{
+			cborRPCVersion[retrievalmarket.Query, retrievalmarket.QueryResponse](testProtocolID),
+		},
+		maxResponseSize: 512,
+	}
+
+	fc, provider := initTransportsTestClient(t, ctx, retrievalTransportsResponse{})
+	handle := fc.StorageProviderByPeerID(provider.ID())
+
+	// Answers each query until the client stops sending
+	provider.SetStreamHandler(testProtocolID, func(stream network.Stream) {
+		defer stream.Close()
+
+		for {
+			var query retrievalmarket.Query
+			if err := cborutil.ReadCborRPC(stream, &query); err != nil {
+				return
+			}
+
+			resp := retrievalmarket.QueryResponse{
+				Status:  retrievalmarket.QueryResponseAvailable,
+				Message: "ok",
+			}
+			resp.PaymentAddress, _ = address.NewIDAddress(1000)
+			if err := cborutil.WriteCborRPC(stream, &resp); err != nil {
+				return
+			}
+		}
+	})
+
+	small := merkledag.NewRawNode([]byte("small")).Cid()
+
+	stream, err := openRPCStream(ctx, handle, testProtocol)
+	require.NoError(t, err)
+	require.Equal(t, testProtocolID, stream.Protocol())
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, stream.Send(retrievalmarket.Query{PayloadCID: small}))
+
+		resp, err := stream.Receive()
+		require.NoError(t, err)
+		require.Equal(t, retrievalmarket.QueryResponseAvailable, resp.Status)
+	}
+	require.NoError(t, stream.CloseWrite())
+	require.NoError(t, stream.Close())
+
+	// Responses over the limit are rejected
+	testProtocol.maxResponseSize = 16
+
+	_, _, err = runRPC(ctx, handle, testProtocol, retrievalmarket.Query{PayloadCID: small})
+	require.ErrorIs(t, err, ErrRPCResponseTooLarge)
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 
 	"github.com/filecoin-project/go-fil-markets/storagemarket"
+	storagemigrations "github.com/filecoin-project/go-fil-markets/storagemarket/migrations"
 	"github.com/filecoin-project/go-fil-markets/storagemarket/network"
 	"github.com/filecoin-project/go-state-types/crypto"
 )
@@ -16,13 +17,15 @@ import (
 
 // Queries a storage ask, returning the signature without validating it
 func (handle *StorageProviderHandle) QueryStorageAskUnchecked(ctx context.Context) (storagemarket.StorageAsk, crypto.Signature, error) {
-	const protocol = "/fil/storage/ask/1.1.0"
+	if err := handle.CheckPolicy(ctx); err != nil {
+		return storagemarket.StorageAsk{}, crypto.Signature{}, err
+	}
 
-	req := network.AskRequest{Miner: handle.addr}
-	var resp network.AskResponse
-	if err := handle.runSingleRPC(ctx, &req, &resp, protocol); err != nil {
+	resp, version, err := runRPC(ctx, handle, storageAskProtocol, network.AskRequest{Miner: handle.addr})
+	if err != nil {
 		return storagemarket.StorageAsk{}, crypto.Signature{}, err
 	}
+	log.Debugf("Queried storage ask of %s over %s", handle.addr, version)
 
 	if resp.Ask == nil || resp.Ask.Ask == nil || resp.Ask.Signature == nil {
 		return storagemarket.StorageAsk{}, crypto.Signature{}, fmt.Errorf("seemingly valid response contained nil fields")
@@ -31,6 +34,34 @@ func (handle *StorageProviderHandle) QueryStorageAskUnchecked(ctx context.Contex
 	return *resp.Ask.Ask, *resp.Ask.Signature, nil
 }
 
+// Storage ask queries, falling back on the old tuple-encoded version for
+// providers that don't support the current one
+//
+// Asks received over the old version are converted to the current type, so
+// their signatures are over the old encoding
+var storageAskProtocol = rpcProtocol[network.AskRequest, network.AskResponse]{
+	versions: []rpcVersion[network.AskRequest, network.AskResponse]{
+		cborRPCVersion[network.AskRequest, network.AskResponse](storagemarket.AskProtocolID),
+		migratedRPCVersion(
+			storagemarket.OldAskProtocolID,
+			func(req network.AskRequest) storagemigrations.AskRequest0 {
+				return storagemigrations.AskRequest0{Miner: req.Miner}
+			},
+			func(resp storagemigrations.AskResponse0) (network.AskResponse, error) {
+				if resp.Ask == nil || resp.Ask.Ask == nil {
+					return network.AskResponse{}, nil
+				}
+				return network.AskResponse{
+					Ask: &storagemarket.SignedStorageAsk{
+						Ask:       storagemigrations.MigrateStorageAsk0To1(resp.Ask.Ask),
+						Signature: resp.Ask.Signature,
+					},
+				}, nil
+			},
+		),
+	},
+}
+
 // TODO
 // // Checks the validity of the ask against its signature, returning nil if ok, or
 // // erroring if invalid
@@ -0,0 +1,221 @@
+package filclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/ipfs/go-datastore"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// storageproviderindex.go - reverse lookup of storage provider addresses by
+// peer ID, built by scanning the miners on chain
+
+var (
+	ErrStorageProviderNotFound = errors.New("no storage provider found on chain with that peer ID")
+)
+
+// How long a miner's indexed peer ID is trusted before it's looked up again -
+// miners rarely change peer ID, so this is long
+const storageProviderIndexMaxAge = 24 * time.Hour
+
+// A lookup that misses the index only rescans the chain if the last scan was
+// longer ago than this, so that unknown peer IDs don't cause a scan every time
+const storageProviderIndexMinRefreshInterval = 10 * time.Minute
+
+var (
+	storageProviderIndexByAddressKey = datastore.NewKey("/StorageProviders/ByAddress")
+	storageProviderIndexByPeerIDKey  = datastore.NewKey("/StorageProviders/ByPeerID")
+)
+
+// What's known about a miner address from its last miner info lookup
+type storageProviderIndexEntry struct {
+	// Nil if the miner has no peer ID set on chain
+	PeerID    *peer.ID
+	CheckedAt time.Time
+}
+
+func storageProviderIndexAddressKey(addr address.Address) datastore.Key {
+	return storageProviderIndexByAddressKey.ChildString(addr.String())
+}
+
+func storageProviderIndexPeerIDKey(peerID peer.ID) datastore.Key {
+	return storageProviderIndexByPeerIDKey.ChildString(peerID.String())
+}
+
+// Looks up the address of the storage provider with the peer ID, scanning the
+// chain for miners that are new or haven't been checked in a while if it isn't
+// already indexed
+//
+// If several miners share a peer ID, whichever was indexed last is returned
+func (client *Client) StorageProviderAddressByPeerID(ctx context.Context, peerID peer.ID) (address.Address, error) {
+	addr, err := client.indexedStorageProviderAddress(ctx, peerID)
+	if err == nil || !errors.Is(err, ErrStorageProviderNotFound) {
+		return addr, err
+	}
+
+	client.storageProviderIndexLk.Lock()
+	defer client.storageProviderIndexLk.Unlock()
+
+	// Another lookup may have already scanned while waiting for the lock
+	if time.Since(client.storageProviderIndexRefreshed) > storageProviderIndexMinRefreshInterval {
+		if err := client.refreshStorageProviderIndexLocked(ctx); err != nil {
+			return address.Undef, err
+		}
+	}
+
+	return client.indexedStorageProviderAddress(ctx, peerID)
+}
+
+// Brings the peer ID index up to date with the miners on chain, looking up only
+// miners that are new or haven't been checked in a while
+//
+// The first scan looks up every miner on chain, which can take a long time
+func (client *Client) RefreshStorageProviderIndex(ctx context.Context) error {
+	client.storageProviderIndexLk.Lock()
+	defer client.storageProviderIndexLk.Unlock()
+
+	return client.refreshStorageProviderIndexLocked(ctx)
+}
+
+func (client *Client) indexedStorageProviderAddress(ctx context.Context, peerID peer.ID) (address.Address, error) {
+	data, err := client.ds.Get(ctx, storageProviderIndexPeerIDKey(peerID))
+	if err != nil {
+		if errors.Is(err, datastore.ErrNotFound) {
+			return address.Undef, fmt.Errorf("%w: %s", ErrStorageProviderNotFound, peerID)
+		}
+		return address.Undef, err
+	}
+
+	return address.NewFromString(string(data))
+}
+
+func (client *Client) refreshStorageProviderIndexLocked(ctx context.Context) error {
+	if client.api == nil {
+		return fmt.Errorf("%w: no chain connection to scan miners with", ErrLotusError)
+	}
+
+	addrs, err := client.api.StateListMiners(ctx, types.EmptyTSK)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrLotusError, err)
+	}
+
+	var stale []address.Address
+	for _, addr := range addrs {
+		entry, ok, err := client.storageProviderIndexEntry(ctx, addr)
+		if err != nil {
+			return err
+		}
+
+		if !ok || time.Since(entry.CheckedAt) > storageProviderIndexMaxAge {
+			stale = append(stale, addr)
+		}
+	}
+
+	log.Infof("Indexing peer IDs of %d out of %d miners", len(stale), len(addrs))
+
+	queue := make(chan address.Address)
+	var wg sync.WaitGroup
+	// Miner info lookups run in parallel (see Config.StorageProviderIndexWorkers)
+	for i := 0; i < client.storageProviderIndexWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for addr := range queue {
+				// Failed miners are left stale, to be tried again next time
+				if err := client.indexStorageProvider(ctx, addr); err != nil {
+					log.Debugf("Could not index miner %s: %v", addr, err)
+				}
+			}
+		}()
+	}
+
+	for _, addr := range stale {
+		select {
+		case queue <- addr:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	close(queue)
+	wg.Wait()
+
+	// Miners indexed before an interruption are kept, and skipped by the next
+	// scan as fresh, so it carries on where this one stopped - recording the
+	// attempt keeps lookups from rescanning straight away either way
+	client.storageProviderIndexRefreshed = time.Now()
+
+	return ctx.Err()
+}
+
+func (client *Client) storageProviderIndexEntry(
+	ctx context.Context,
+	addr address.Address,
+) (storageProviderIndexEntry, bool, error) {
+	data, err := client.ds.Get(ctx, storageProviderIndexAddressKey(addr))
+	if err != nil {
+		if errors.Is(err, datastore.ErrNotFound) {
+			return storageProviderIndexEntry{}, false, nil
+		}
+		return storageProviderIndexEntry{}, false, err
+	}
+
+	var entry storageProviderIndexEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		// Treated as missing, so it gets overwritten
+		log.Errorf("Skipping unreadable storage provider index entry for %s: %v", addr, err)
+		return storageProviderIndexEntry{}, false, nil
+	}
+
+	return entry, true, nil
+}
+
+// Looks up the miner's peer ID and updates both directions of the index
+func (client *Client) indexStorageProvider(ctx context.Context, addr address.Address) error {
+	info, err := client.api.StateMinerInfo(ctx, addr, types.EmptyTSK)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrLotusError, err)
+	}
+
+	entry := storageProviderIndexEntry{
+		PeerID:    info.PeerId,
+		CheckedAt: time.Now(),
+	}
+
+	previous, ok, err := client.storageProviderIndexEntry(ctx, addr)
+	if err != nil {
+		return err
+	}
+
+	// Drop the reverse mapping of a peer ID the miner no longer uses, unless
+	// another miner has taken it over since
+	if ok && previous.PeerID != nil && (entry.PeerID == nil || *previous.PeerID != *entry.PeerID) {
+		indexed, err := client.indexedStorageProviderAddress(ctx, *previous.PeerID)
+		if err == nil && indexed == addr {
+			if err := client.ds.Delete(ctx, storageProviderIndexPeerIDKey(*previous.PeerID)); err != nil {
+				return err
+			}
+		}
+	}
+
+	if entry.PeerID != nil {
+		if err := client.ds.Put(ctx, storageProviderIndexPeerIDKey(*entry.PeerID), []byte(addr.String())); err != nil {
+			return err
+		}
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	return client.ds.Put(ctx, storageProviderIndexAddressKey(addr), data)
+}
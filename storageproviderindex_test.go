@@ -0,0 +1,169 @@
+package filclient
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/actors/builtin/power"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/test"
+	"github.com/stretchr/testify/require"
+)
+
+// Answers miner lookups from a fixed set of miners, and fails everything else
+type testMinerGateway struct {
+	api.Gateway
+
+	lk          sync.Mutex
+	miners      map[address.Address]peer.ID
+	multiaddrs  map[address.Address][]abi.Multiaddrs
+	infoLookups int
+}
+
+func (gateway *testMinerGateway) StateListMiners(ctx context.Context, tsk types.TipSetKey) ([]address.Address, error) {
+	gateway.lk.Lock()
+	defer gateway.lk.Unlock()
+
+	var addrs []address.Address
+	for addr := range gateway.miners {
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
+
+func (gateway *testMinerGateway) StateMinerInfo(
+	ctx context.Context,
+	addr address.Address,
+	tsk types.TipSetKey,
+) (api.MinerInfo, error) {
+	gateway.lk.Lock()
+	defer gateway.lk.Unlock()
+
+	gateway.infoLookups++
+
+	var info api.MinerInfo
+	if peerID := gateway.miners[addr]; peerID != "" {
+		info.PeerId = &peerID
+	}
+	info.Multiaddrs = gateway.multiaddrs[addr]
+	return info, nil
+}
+
+func (gateway *testMinerGateway) StateMinerPower(
+	ctx context.Context,
+	addr address.Address,
+	tsk types.TipSetKey,
+) (*api.MinerPower, error) {
+	gateway.lk.Lock()
+	defer gateway.lk.Unlock()
+
+	if _, ok := gateway.miners[addr]; !ok {
+		return nil, fmt.Errorf("actor not found")
+	}
+
+	return &api.MinerPower{
+		MinerPower: power.Claim{
+			RawBytePower:    abi.NewStoragePower(1 << 40),
+			QualityAdjPower: abi.NewStoragePower(10 << 40),
+		},
+		HasMinPower: true,
+	}, nil
+}
+
+func TestStorageProviderAddressByPeerID(t *testing.T) {
+	ctx := context.Background()
+
+	peerA := test.RandPeerIDFatal(t)
+	peerB := test.RandPeerIDFatal(t)
+	addrA, err := address.NewIDAddress(1000)
+	require.NoError(t, err)
+	addrB, err := address.NewIDAddress(1001)
+	require.NoError(t, err)
+	addrNoPeer, err := address.NewIDAddress(1002)
+	require.NoError(t, err)
+
+	gateway := &testMinerGateway{miners: map[address.Address]peer.ID{
+		addrA:      peerA,
+		addrB:      peerB,
+		addrNoPeer: "",
+	}}
+
+	fc := initStandaloneClient(t, ctx, initDatastore(t))
+	fc.api = gateway
+
+	addr, err := fc.StorageProviderByPeerID(peerA).Address(ctx)
+	require.NoError(t, err)
+	require.Equal(t, addrA, addr)
+	require.Equal(t, 3, gateway.infoLookups)
+
+	// Already indexed, so no more lookups
+	addr, err = fc.StorageProviderAddressByPeerID(ctx, peerB)
+	require.NoError(t, err)
+	require.Equal(t, addrB, addr)
+	require.Equal(t, 3, gateway.infoLookups)
+
+	// A miss right after a scan doesn't scan again
+	_, err = fc.StorageProviderAddressByPeerID(ctx, test.RandPeerIDFatal(t))
+	require.ErrorIs(t, err, ErrStorageProviderNotFound)
+	require.Equal(t, 3, gateway.infoLookups)
+
+	// Only the new miner is looked up on refresh, and a changed peer ID
+	// replaces the old one once the miner is looked up again
+	peerC := test.RandPeerIDFatal(t)
+	addrC, err := address.NewIDAddress(1003)
+	require.NoError(t, err)
+	gateway.lk.Lock()
+	gateway.miners[addrC] = peerC
+	gateway.lk.Unlock()
+
+	require.NoError(t, fc.RefreshStorageProviderIndex(ctx))
+	require.Equal(t, 4, gateway.infoLookups)
+
+	addr, err = fc.StorageProviderAddressByPeerID(ctx, peerC)
+	require.NoError(t, err)
+	require.Equal(t, addrC, addr)
+
+	peerA2 := test.RandPeerIDFatal(t)
+	gateway.lk.Lock()
+	gateway.miners[addrA] = peerA2
+	gateway.lk.Unlock()
+	require.NoError(t, fc.indexStorageProvider(ctx, addrA))
+
+	_, err = fc.indexedStorageProviderAddress(ctx, peerA)
+	require.ErrorIs(t, err, ErrStorageProviderNotFound)
+	addr, err = fc.StorageProviderAddressByPeerID(ctx, peerA2)
+	require.NoError(t, err)
+	require.Equal(t, addrA, addr)
+}
+
+func TestStorageProviderIndexNotScannedOnConnect(t *testing.T) {
+	ctx := context.Background()
+
+	addrA, err := address.NewIDAddress(1000)
+	require.NoError(t, err)
+	gateway := &testMinerGateway{miners: map[address.Address]peer.ID{
+		addrA: test.RandPeerIDFatal(t),
+	}}
+
+	fc := initStandaloneClient(t, ctx, initDatastore(t))
+	fc.api = gateway
+
+	// Connecting an unindexed peer ID with nowhere to dial fails without
+	// scanning the chain
+	_, err = fc.StorageProviderByPeerID(test.RandPeerIDFatal(t)).Connect(ctx)
+	require.Error(t, err)
+	require.Equal(t, 0, gateway.infoLookups)
+
+	// An interrupted scan still counts as a refresh, so lookups don't rescan
+	// straight away
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	require.ErrorIs(t, fc.RefreshStorageProviderIndex(cancelled), context.Canceled)
+	require.False(t, fc.storageProviderIndexRefreshed.IsZero())
+}
@@ -0,0 +1,86 @@
+package filclient
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/libp2p/go-libp2p"
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnectWithPeerRouting(t *testing.T) {
+	ctx := context.Background()
+
+	// Mocknet hosts can dial each other without knowing any multiaddrs, so
+	// real hosts on loopback are used to make the multiaddrs matter
+	genPeer := func() host.Host {
+		h, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+		require.NoError(t, err)
+		t.Cleanup(func() { h.Close() })
+		return h
+	}
+	providerHost := genPeer()
+	bootstrapHost := genPeer()
+	clientHost := genPeer()
+
+	newDHT := func(h host.Host) *dht.IpfsDHT {
+		d, err := dht.New(
+			ctx,
+			h,
+			dht.Mode(dht.ModeServer),
+			dht.ProtocolPrefix("/filclient-test"),
+			dht.DisableAutoRefresh(),
+		)
+		require.NoError(t, err)
+		t.Cleanup(func() { d.Close() })
+		return d
+	}
+	newDHT(providerHost)
+	bootstrapDHT := newDHT(bootstrapHost)
+	clientDHT := newDHT(clientHost)
+
+	// Only the bootstrap node knows where the provider is
+	for _, h := range []host.Host{providerHost, clientHost} {
+		require.NoError(t, h.Connect(ctx, peer.AddrInfo{ID: bootstrapHost.ID(), Addrs: bootstrapHost.Addrs()}))
+	}
+	require.Eventually(t, func() bool {
+		return bootstrapDHT.RoutingTable().Find(providerHost.ID()) != "" &&
+			clientDHT.RoutingTable().Find(bootstrapHost.ID()) != ""
+	}, 5*time.Second, 10*time.Millisecond)
+
+	t.Run("without peer routing", func(t *testing.T) {
+		fc, err := New(ctx, clientHost, nil, address.Undef, initBlockstore(t), initDatastore(t))
+		require.NoError(t, err)
+		defer fc.Close()
+
+		_, err = fc.StorageProviderByPeerID(providerHost.ID()).Connect(ctx)
+		require.ErrorIs(t, err, ErrMinerConnectionFailed)
+	})
+
+	t.Run("with peer routing", func(t *testing.T) {
+		fc, err := New(
+			ctx,
+			clientHost,
+			nil,
+			address.Undef,
+			initBlockstore(t),
+			initDatastore(t),
+			WithPeerRouting(clientDHT),
+		)
+		require.NoError(t, err)
+		defer fc.Close()
+
+		handle := fc.StorageProviderByPeerID(providerHost.ID())
+		require.Equal(t, StorageProviderAddrSourceUnknown, handle.AddrSource())
+
+		peerID, err := handle.Connect(ctx)
+		require.NoError(t, err)
+		require.Equal(t, providerHost.ID(), peerID)
+		require.Equal(t, StorageProviderAddrSourcePeerRouting, handle.AddrSource())
+	})
+}
@@ -4,11 +4,8 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"time"
 
 	"github.com/filecoin-project/go-address"
-	cborutil "github.com/filecoin-project/go-cbor-util"
-	"github.com/filecoin-project/lotus/chain/types"
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/libp2p/go-libp2p/core/protocol"
@@ -31,7 +28,44 @@ type StorageProviderHandle struct {
 	addr address.Address
 	// WARNING: may be uninitialized - use .PeerID()
 	peerID peer.ID
-	client *Client
+	// Known multiaddrs of the peer, used to connect when there is no address
+	// to look them up on chain with
+	addrs []multiaddr.Multiaddr
+	// Where the multiaddrs of the last successful connection came from
+	addrSource StorageProviderAddrSource
+	client     *Client
+}
+
+// Where the multiaddrs a provider was connected with came from
+type StorageProviderAddrSource uint
+
+const (
+	// Not connected through this handle yet, or it was already connected
+	StorageProviderAddrSourceUnknown StorageProviderAddrSource = iota
+
+	// Multiaddrs given with the handle, or already in the peerstore
+	StorageProviderAddrSourceKnown
+
+	// The provider's miner info on chain
+	StorageProviderAddrSourceChain
+
+	// The client's peer routing (see Config.PeerRouting)
+	StorageProviderAddrSourcePeerRouting
+)
+
+func (source StorageProviderAddrSource) String() string {
+	switch source {
+	case StorageProviderAddrSourceUnknown:
+		return "unknown"
+	case StorageProviderAddrSourceKnown:
+		return "known"
+	case StorageProviderAddrSourceChain:
+		return "chain"
+	case StorageProviderAddrSourcePeerRouting:
+		return "peer routing"
+	default:
+		return "invalid"
+	}
 }
 
 func (client *Client) StorageProviderByAddress(addr address.Address) *StorageProviderHandle {
@@ -48,35 +82,60 @@ func (client *Client) StorageProviderByPeerID(peerID peer.ID) *StorageProviderHa
 	}
 }
 
-// Returns the stored address of the provider, or errors if it is not known
-//
-// In the future, this function may be able to derive the address from the peer
-// ID
+// Creates a handle for a provider found off chain (e.g. through the indexer),
+// which can be connected to without a chain lookup
+func (client *Client) StorageProviderByAddrInfo(info peer.AddrInfo) *StorageProviderHandle {
+	return &StorageProviderHandle{
+		peerID: info.ID,
+		addrs:  info.Addrs,
+		client: client,
+	}
+}
+
+// Returns the address of the provider, looking it up in the peer ID index if
+// not already stored (see StorageProviderAddressByPeerID)
 func (handle *StorageProviderHandle) Address(ctx context.Context) (address.Address, error) {
-	if handle.addr == address.Undef {
-		return address.Undef, fmt.Errorf("peer ID to address mapping is not yet implemented")
+	if handle.addr != address.Undef {
+		return handle.addr, nil
+	}
+
+	addr, err := handle.client.StorageProviderAddressByPeerID(ctx, handle.peerID)
+	if err != nil {
+		return address.Undef, err
 	}
 
+	handle.addr = addr
+
 	return handle.addr, nil
 }
 
-// Returns the peer ID of the provider, looking it up on chain using the address
-// if not already stored
+// Returns the peer ID of the provider, looking it up in the miner info using
+// the address if not already stored
 func (handle *StorageProviderHandle) PeerID(ctx context.Context) (peer.ID, error) {
-	info, err := handle.client.api.StateMinerInfo(ctx, handle.addr, types.EmptyTSK)
+	if handle.peerID != "" {
+		return handle.peerID, nil
+	}
+
+	info, err := handle.client.MinerInfo(ctx, handle.addr)
 	if err != nil {
-		return "", fmt.Errorf("%w: %v", ErrLotusError, err)
+		return "", err
 	}
 
-	if info.PeerId == nil {
+	if info.PeerID == nil {
 		return "", fmt.Errorf("%w: miner info has no peer ID set on chain", ErrLotusError)
 	}
 
-	handle.peerID = *info.PeerId
+	handle.peerID = *info.PeerID
 
 	return handle.peerID, nil
 }
 
+// Where the multiaddrs the provider was last connected with through this handle
+// came from
+func (handle *StorageProviderHandle) AddrSource() StorageProviderAddrSource {
+	return handle.addrSource
+}
+
 // Looks up the version string of the miner
 func (handle *StorageProviderHandle) Version(ctx context.Context) (string, error) {
 	peer, err := handle.Connect(ctx)
@@ -107,49 +166,80 @@ func (handle *StorageProviderHandle) stream(ctx context.Context, protocols ...pr
 	return stream, nil
 }
 
-// Sends a single RPC request, and puts the response into resp - handy but not
-// ideal for multiple requests
+// Makes sure that the storage provider is connected
 //
-// TODO(@elijaharita): generics
-func (handle *StorageProviderHandle) runSingleRPC(ctx context.Context, req interface{}, resp interface{}, protocols ...protocol.ID) error {
-	stream, err := handle.stream(ctx, protocols...)
-	if err != nil {
-		return err
+// BEHAVIOR CHANGE - no longer errors on invalid multiaddr if at least one valid
+// multiaddr exists
+//
+// If the provider has no usable multiaddrs on chain, or none of them can be
+// dialed, and the client has peer routing, the multiaddrs are looked up there
+// instead
+//
+// Providers the client's policy doesn't allow aren't connected to (see
+// CheckPolicy)
+func (handle *StorageProviderHandle) Connect(ctx context.Context) (peer.ID, error) {
+	if handle.client.connectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, handle.client.connectTimeout)
+		defer cancel()
 	}
-	defer stream.Close()
 
-	dline, ok := ctx.Deadline()
-	if ok {
-		stream.SetDeadline(dline)
-		defer stream.SetDeadline(time.Time{})
+	if err := handle.CheckPolicy(ctx); err != nil {
+		return "", err
 	}
 
-	if err := cborutil.WriteCborRPC(stream, req); err != nil {
-		return fmt.Errorf("%w: %v", ErrCBORWriteFailed, err)
+	// Nothing to do if the peer ID is known and it's already connected
+	if handle.peerID != "" &&
+		handle.client.host.Network().Connectedness(handle.peerID) == network.Connected {
+		return handle.peerID, nil
 	}
 
-	if err := cborutil.ReadCborRPC(stream, resp); err != nil {
-		return fmt.Errorf("%w: %v", ErrCBORReadFailed, err)
+	// With no multiaddrs to go on, use the address from the peer ID index so
+	// they can be looked up on chain - the index isn't refreshed here, since a
+	// full scan takes far longer than a connection is given
+	if handle.addr == address.Undef && handle.peerID != "" &&
+		len(handle.addrs) == 0 && len(handle.client.host.Peerstore().Addrs(handle.peerID)) == 0 {
+		if addr, err := handle.client.indexedStorageProviderAddress(ctx, handle.peerID); err == nil {
+			handle.addr = addr
+		} else {
+			log.Debugf("Could not find address of %s to look up its multiaddrs: %v", handle.peerID, err)
+		}
 	}
 
-	return nil
-}
+	// Without an address there's nothing to look up on chain, so connect using
+	// the known multiaddrs, or whatever the peerstore already has
+	if handle.addr == address.Undef && handle.peerID != "" {
+		if err := handle.client.host.Connect(ctx, peer.AddrInfo{
+			ID:    handle.peerID,
+			Addrs: handle.addrs,
+		}); err != nil {
+			return handle.connectWithPeerRouting(ctx, fmt.Errorf("%w: %v", ErrMinerConnectionFailed, err))
+		}
 
-// Makes sure that the storage provider is connected
-//
-// BEHAVIOR CHANGE - no longer errors on invalid multiaddr if at least one valid
-// multiaddr exists
-func (handle *StorageProviderHandle) Connect(ctx context.Context) (peer.ID, error) {
-	info, err := handle.client.api.StateMinerInfo(ctx, handle.addr, types.EmptyTSK)
+		handle.addrSource = StorageProviderAddrSourceKnown
+
+		return handle.peerID, nil
+	}
+
+	info, err := handle.client.MinerInfo(ctx, handle.addr)
 	if err != nil {
-		return "", fmt.Errorf("%w: %v", ErrLotusError, err)
+		return "", err
+	}
+
+	if info.PeerID == nil {
+		return "", fmt.Errorf("%w: miner info has no peer ID set on chain", ErrLotusError)
 	}
 
 	// We have to find the peer ID here anyway, so populate it
-	handle.peerID = *info.PeerId
+	handle.peerID = *info.PeerID
 
-	if info.PeerId == nil {
-		return "", fmt.Errorf("%w: miner info has no peer ID set on chain", ErrLotusError)
+	if err := handle.CheckPolicy(ctx); err != nil {
+		return "", err
+	}
+
+	// Now that the peer ID is known, it may turn out to be connected already
+	if handle.client.host.Network().Connectedness(handle.peerID) == network.Connected {
+		return handle.peerID, nil
 	}
 
 	// Parse the multiaddr bytes
@@ -165,27 +255,63 @@ func (handle *StorageProviderHandle) Connect(ctx context.Context) (peer.ID, erro
 
 		multiaddrs = append(multiaddrs, multiaddr)
 	}
-	fmt.Printf("Connecting to %v (%s)\n", multiaddrs, handle.peerID)
+	log.Debugf("Connecting to %v (%s)", multiaddrs, handle.peerID)
 
-	// FIXME - lotus-client-proper falls back on the DHT when it has a peerid but no multiaddr
-	// filc should do the same
 	if len(multiaddrs) == 0 {
 		// If there were addresses and they were all invalid (hadInvalid marked
 		// true and multiaddrs length 0), specifically mention that
 		if hadInvalid {
-			return "", fmt.Errorf("%w: miner info has only invalid multiaddrs", ErrMinerConnectionFailed)
+			return handle.connectWithPeerRouting(
+				ctx,
+				fmt.Errorf("%w: miner info has only invalid multiaddrs", ErrMinerConnectionFailed),
+			)
 		}
 
 		// Otherwise, just mention no multiaddrs available
-		return "", fmt.Errorf("%w: miner info has no multiaddrs", ErrMinerConnectionFailed)
+		return handle.connectWithPeerRouting(
+			ctx,
+			fmt.Errorf("%w: miner info has no multiaddrs", ErrMinerConnectionFailed),
+		)
 	}
 
 	if err := handle.client.host.Connect(ctx, peer.AddrInfo{
-		ID:    *info.PeerId,
+		ID:    handle.peerID,
 		Addrs: multiaddrs,
 	}); err != nil {
-		return "", fmt.Errorf("%w: %v", ErrMinerConnectionFailed, err)
+		// The cached multiaddrs may be out of date, so look them up again next
+		// time
+		if err := handle.client.InvalidateMinerInfo(ctx, handle.addr); err != nil {
+			log.Errorf("Failed to invalidate miner info of %s: %v", handle.addr, err)
+		}
+
+		return handle.connectWithPeerRouting(ctx, fmt.Errorf("%w: %v", ErrMinerConnectionFailed, err))
+	}
+
+	handle.addrSource = StorageProviderAddrSourceChain
+
+	return handle.peerID, nil
+}
+
+// Looks up the provider's multiaddrs with the client's peer routing and
+// connects to them - if there's no peer routing, or it doesn't help, the error
+// from the first attempt is returned along with why
+func (handle *StorageProviderHandle) connectWithPeerRouting(ctx context.Context, firstErr error) (peer.ID, error) {
+	if handle.client.peerRouting == nil {
+		return "", firstErr
 	}
 
-	return *info.PeerId, nil
+	log.Debugf("Looking up %s with peer routing after: %v", handle.peerID, firstErr)
+
+	info, err := handle.client.peerRouting.FindPeer(ctx, handle.peerID)
+	if err != nil {
+		return "", fmt.Errorf("%w (peer routing lookup also failed: %v)", firstErr, err)
+	}
+
+	if err := handle.client.host.Connect(ctx, info); err != nil {
+		return "", fmt.Errorf("%w (multiaddrs from peer routing also failed: %v)", firstErr, err)
+	}
+
+	handle.addrSource = StorageProviderAddrSourcePeerRouting
+
+	return handle.peerID, nil
 }
@@ -30,22 +30,16 @@ func TestStorageProviderAddressToPeerID(t *testing.T) {
 	fmt.Printf("Mapped miner address %s to peer ID %s\n", miner.ActorAddr, minerPeerID)
 }
 
-// TODO(@elijaharita): peer id -> address mapping is not functional yet
-
-// func TestMinerPeerIDToAddress(t *testing.T) {
-// 	app := cli.NewApp()
-// 	app.Action = func(ctx *cli.Context) error {
-// 		_, miner, _, fc, closer := initEnsemble(t, ctx)
-// 		defer closer()
-
-// 		minerPeerID, err := miner.ID(ctx.Context)
-// 		require.NoError(t, err)
+func TestStorageProviderPeerIDToAddress(t *testing.T) {
+	ctx := context.TODO()
+	_, miner, _, fc, closer := initEnsemble(t, ctx)
+	defer closer()
 
-// 		minerAddr, err := fc.MinerByPeerID(minerPeerID).Address(ctx.Context)
-// 		require.NoError(t, err)
-// 		fmt.Printf("Mapped miner peer ID %s to address %s\n", minerPeerID, minerAddr)
+	minerPeerID, err := fc.StorageProviderByAddress(miner.ActorAddr).PeerID(ctx)
+	require.NoError(t, err)
 
-// 		return nil
-// 	}
-// 	require.NoError(t, app.Run([]string{""}))
-// }
+	minerAddr, err := fc.StorageProviderByPeerID(minerPeerID).Address(ctx)
+	require.NoError(t, err)
+	require.Equal(t, miner.ActorAddr, minerAddr)
+	fmt.Printf("Mapped miner peer ID %s to address %s\n", minerPeerID, minerAddr)
+}